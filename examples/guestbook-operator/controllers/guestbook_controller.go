@@ -53,7 +53,7 @@ func (r *GuestbookReconciler) setupReconciler(mgr ctrl.Manager) error {
 		declarative.WithLabels(r.watchLabels),
 		declarative.WithStatus(status.NewBasic(mgr.GetClient())),
 		declarative.WithPreserveNamespace(),
-		declarative.WithApplyPrune(),
+		declarative.WithInventoryPrune(),
 		declarative.WithObjectTransform(addon.ApplyPatches),
 
 		// Add other optional options for testing
@@ -87,8 +87,8 @@ func (r *GuestbookReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return nil
 }
 
-// for WithApplyPrune
-// +kubebuilder:rbac:groups=*,resources=*,verbs=list
+// for WithInventoryPrune, and to read the kinds of objects with owner annotations from inventories
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;create;update
 
 // +kubebuilder:rbac:groups=addons.example.org,resources=guestbooks,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=addons.example.org,resources=guestbooks/status,verbs=get;update;patch
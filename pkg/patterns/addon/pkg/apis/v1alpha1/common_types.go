@@ -40,6 +40,12 @@ type CommonSpec struct {
 	// Channel specifies a channel that can be used to resolve a specific addon, eg: stable
 	// It will be ignored if Version is specified
 	Channel string `json:"channel,omitempty"`
+	// Paused suspends reconciliation of the addon, so that the deployed objects can be edited by hand.
+	// It has the same effect as the addons.k8s.io/paused annotation.
+	Paused bool `json:"paused,omitempty"`
+	// RollbackTo specifies a revision (see status.currentRevision) to apply instead of the
+	// version or channel, when the operator keeps a revision history
+	RollbackTo int64 `json:"rollbackTo,omitempty"`
 }
 
 //go:generate go run ../../../../../../vendor/k8s.io/code-generator/cmd/deepcopy-gen/main.go -O zz_generated.deepcopy -i ./... -h ../../../../../../hack/boilerplate.go.txt
@@ -50,6 +56,11 @@ type CommonStatus struct {
 	Healthy bool     `json:"healthy"`
 	Errors  []string `json:"errors,omitempty"`
 	Phase   string   `json:"phase,omitempty"`
+	// CurrentRevision is the revision of the manifest that was last applied,
+	// when the operator keeps a revision history
+	CurrentRevision int64 `json:"currentRevision,omitempty"`
+	// Conditions describe the state of the addon in more detail than Phase
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 // Patchable is a trait for addon CRDs that expose a raw set of Patches to be
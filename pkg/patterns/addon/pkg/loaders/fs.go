@@ -22,7 +22,9 @@ import (
 	"fmt"
 	"strings"
 
+	"go.opentelemetry.io/otel/trace"
 	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/addon/pkg/utils"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative"
 
 	"k8s.io/apimachinery/pkg/runtime"
 	"sigs.k8s.io/controller-runtime/pkg/log"
@@ -107,6 +109,8 @@ func (c *ManifestLoader) ResolveManifest(ctx context.Context, object runtime.Obj
 	} else {
 		log.WithValues("version", version).Info("using specified version")
 	}
+	trace.SpanFromContext(ctx).SetAttributes(declarative.VersionAttribute.String(id))
+
 	s := make(map[string]string)
 	s, err = c.repo.LoadManifest(ctx, componentName, id)
 	if err != nil {
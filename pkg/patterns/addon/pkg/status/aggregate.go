@@ -108,7 +108,7 @@ func (a *aggregator) Reconciled(ctx context.Context, src declarative.Declarative
 func (a *aggregator) deployment(ctx context.Context, key client.ObjectKey) (bool, error) {
 	dep := &appsv1.Deployment{}
 
-	if err := a.client.Get(ctx, key, dep); err != nil {
+	if err := declarative.TargetClient(ctx, a.client).Get(ctx, key, dep); err != nil {
 		return false, fmt.Errorf("error reading deployment (%s): %v", key, err)
 	}
 
@@ -123,7 +123,7 @@ func (a *aggregator) deployment(ctx context.Context, key client.ObjectKey) (bool
 
 func (a *aggregator) service(ctx context.Context, key client.ObjectKey) (bool, error) {
 	svc := &corev1.Service{}
-	err := a.client.Get(ctx, key, svc)
+	err := declarative.TargetClient(ctx, a.client).Get(ctx, key, svc)
 	if err != nil {
 		return false, fmt.Errorf("error reading service (%s): %v", key, err)
 	}
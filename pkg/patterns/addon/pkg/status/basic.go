@@ -21,34 +21,106 @@ import (
 	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative"
 )
 
+// Option adds the reporting of an optional feature of the declarative reconciler to the
+// declarative.Status built by NewBasic, NewBasicVersionChecks or NewKstatusCheck.  Options are
+// named after the reconciler option that enables the feature, where there is one, and should only
+// be set along with it, so that addons do not get conditions for features they do not use.
+type Option func(client client.Client, status *declarative.StatusBuilder)
+
+// WithFinalizer reports the teardown of the deployed objects in a Deleting phase and condition
+func WithFinalizer() Option {
+	return func(client client.Client, status *declarative.StatusBuilder) {
+		status.DeletingImpl = NewDeletingStatus(client)
+	}
+}
+
+// WithPause reports reconciliation paused by the addons.k8s.io/paused annotation or spec.paused
+// in a Paused phase and condition.
+//
+// Deprecated: the paused state is always reported by NewBasic, NewBasicVersionChecks and
+// NewKstatusCheck.
+func WithPause() Option {
+	return func(client client.Client, status *declarative.StatusBuilder) {
+		status.PausedImpl = NewPausedStatus(client)
+	}
+}
+
+// WithRevisionHistory reports the applied revision in currentRevision, and automatic rollbacks
+// (with WithAutoRollback) in a RolledBack condition
+func WithRevisionHistory() Option {
+	return func(client client.Client, status *declarative.StatusBuilder) {
+		revisions := NewRevisionStatus(client)
+		status.RevisionedImpl = revisions
+		status.RolledBackImpl = revisions
+	}
+}
+
+// WithDriftDetection reports drift in a Drifted condition
+func WithDriftDetection() Option {
+	return func(client client.Client, status *declarative.StatusBuilder) {
+		status.DriftedImpl = NewDriftedStatus(client)
+	}
+}
+
+// WithAdoptionPolicy reports objects managed by another addon in a Conflict condition
+func WithAdoptionPolicy() Option {
+	return func(client client.Client, status *declarative.StatusBuilder) {
+		status.ConflictedImpl = NewConflictStatus(client)
+	}
+}
+
+// WithPruneThreshold reports a blocked prune in a PruneBlocked condition
+func WithPruneThreshold() Option {
+	return func(client client.Client, status *declarative.StatusBuilder) {
+		status.PruneBlockedImpl = NewPruneBlockedStatus(client)
+	}
+}
+
+// WithReconcileErrors reports why the last reconcile failed in a Failed condition
+func WithReconcileErrors() Option {
+	return func(client client.Client, status *declarative.StatusBuilder) {
+		status.FailedImpl = NewFailedStatus(client)
+	}
+}
+
+func newStatusBuilder(client client.Client, status *declarative.StatusBuilder, opts []Option) *declarative.StatusBuilder {
+	for _, opt := range opts {
+		opt(client, status)
+	}
+	return status
+}
+
 // Deprecated: This function exists for backward compatibility, please use NewKstatusCheck
 
 // NewBasic provides an implementation of declarative.Status that
 // performs no preflight checks.
-func NewBasic(client client.Client) declarative.Status {
-	return &declarative.StatusBuilder{
+func NewBasic(client client.Client, opts ...Option) declarative.Status {
+	return newStatusBuilder(client, &declarative.StatusBuilder{
 		ReconciledImpl: NewAggregator(client),
+		PausedImpl:     NewPausedStatus(client),
 		// no preflight checks
-	}
+	}, opts)
 }
 
 // NewBasicVersionCheck provides an implementation of declarative.Status that
 // performs version checks for the version of the operator that the manifest requires.
-func NewBasicVersionChecks(client client.Client, version string) (declarative.Status, error) {
+func NewBasicVersionChecks(client client.Client, version string, opts ...Option) (declarative.Status, error) {
 	v, err := NewVersionCheck(client, version)
 	if err != nil {
 		return nil, err
 	}
 
-	return &declarative.StatusBuilder{
+	return newStatusBuilder(client, &declarative.StatusBuilder{
 		ReconciledImpl:   NewAggregator(client),
 		VersionCheckImpl: v,
+		PausedImpl:       NewPausedStatus(client),
 		// no preflight checks
-	}, nil
+	}, opts), nil
 }
 
-func NewKstatusCheck(client client.Client, d *declarative.Reconciler) declarative.Status {
-	return &declarative.StatusBuilder{
+func NewKstatusCheck(client client.Client, d *declarative.Reconciler, opts ...Option) declarative.Status {
+	return newStatusBuilder(client, &declarative.StatusBuilder{
 		ReconciledImpl: NewKstatusAgregator(client, d),
-	}
+		PausedImpl:     NewPausedStatus(client),
+	}, opts)
 }
@@ -0,0 +1,77 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package status
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	addonsv1alpha1 "sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/addon/pkg/apis/v1alpha1"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/addon/pkg/utils"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative"
+)
+
+// updateStatus applies mutate to a copy of the CommonStatus of src, and updates the status of
+// src if that changed anything
+func updateStatus(ctx context.Context, c client.Client, src declarative.DeclarativeObject, mutate func(status *addonsv1alpha1.CommonStatus)) error {
+	log := log.Log
+
+	currentStatus, err := utils.GetCommonStatus(src)
+	if err != nil {
+		return err
+	}
+
+	status := *currentStatus.DeepCopy()
+	mutate(&status)
+	if reflect.DeepEqual(status, currentStatus) {
+		return nil
+	}
+
+	if err := utils.SetCommonStatus(src, status); err != nil {
+		return err
+	}
+
+	log.WithValues("name", src.GetName()).WithValues("phase", status.Phase).Info("updating status")
+	if err := c.Status().Update(ctx, src); err != nil {
+		log.Error(err, "updating status")
+		return err
+	}
+	return nil
+}
+
+// setCondition sets condition on the CommonStatus of src, observed at the generation of src
+func setCondition(ctx context.Context, c client.Client, src declarative.DeclarativeObject, condition metav1.Condition) error {
+	condition.ObservedGeneration = src.GetGeneration()
+	return updateStatus(ctx, c, src, func(status *addonsv1alpha1.CommonStatus) {
+		meta.SetStatusCondition(&status.Conditions, condition)
+	})
+}
+
+// objectsMessage describes objects in a condition message, e.g. "2 objects have drifted: Deployment a, Service b"
+func objectsMessage(refs []declarative.ObjectRef, format string) string {
+	var names []string
+	for _, ref := range refs {
+		names = append(names, ref.Kind+" "+ref.Name)
+	}
+	return fmt.Sprintf(format, len(refs), strings.Join(names, ", "))
+}
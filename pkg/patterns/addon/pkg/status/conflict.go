@@ -0,0 +1,54 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package status
+
+import (
+	"context"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative"
+)
+
+// ConflictCondition is the type of the condition reporting whether objects of the manifest are managed by another addon
+const ConflictCondition = "Conflict"
+
+// NewConflictStatus provides an implementation of declarative.Conflicted that
+// reports conflicts in a Conflict condition on the CommonStatus of an addon
+func NewConflictStatus(client client.Client) *conflictStatus {
+	return &conflictStatus{client: client}
+}
+
+type conflictStatus struct {
+	client client.Client
+}
+
+func (c *conflictStatus) Conflicted(ctx context.Context, src declarative.DeclarativeObject, conflicts []declarative.ObjectRef) error {
+	if len(conflicts) == 0 {
+		return setCondition(ctx, c.client, src, metav1.Condition{
+			Type:   ConflictCondition,
+			Status: metav1.ConditionFalse,
+			Reason: "NoConflict",
+		})
+	}
+	return setCondition(ctx, c.client, src, metav1.Condition{
+		Type:    ConflictCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  "ManagedElsewhere",
+		Message: objectsMessage(conflicts, "%d objects are managed by another object: %s"),
+	})
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package status
+
+import (
+	"context"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	addonsv1alpha1 "sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/addon/pkg/apis/v1alpha1"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative"
+)
+
+const (
+	// DeletingPhase is the phase reported on CommonStatus while the deployed objects are torn down
+	DeletingPhase = "Deleting"
+	// DeletingCondition is the type of the condition reporting the progress of the teardown
+	DeletingCondition = "Deleting"
+)
+
+// NewDeletingStatus provides an implementation of declarative.Deleting that
+// reports the objects still awaiting deletion in a Deleting condition on the CommonStatus of an addon
+func NewDeletingStatus(client client.Client) *deletingStatus {
+	return &deletingStatus{client: client}
+}
+
+type deletingStatus struct {
+	client client.Client
+}
+
+func (d *deletingStatus) Deleting(ctx context.Context, src declarative.DeclarativeObject, remaining []declarative.ObjectRef) error {
+	condition := metav1.Condition{
+		Type:               DeletingCondition,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: src.GetGeneration(),
+		Reason:             "ObjectsDeleted",
+		Message:            "all objects have been deleted",
+	}
+	if len(remaining) != 0 {
+		condition.Reason = "WaitingForDeletion"
+		condition.Message = objectsMessage(remaining, "waiting for deletion of %d objects: %s")
+	}
+
+	return updateStatus(ctx, d.client, src, func(status *addonsv1alpha1.CommonStatus) {
+		status.Healthy = false
+		status.Phase = DeletingPhase
+		meta.SetStatusCondition(&status.Conditions, condition)
+	})
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package status
+
+import (
+	"context"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative"
+)
+
+// DriftedCondition is the type of the condition reporting whether deployed objects have drifted from the manifest
+const DriftedCondition = "Drifted"
+
+// NewDriftedStatus provides an implementation of declarative.Drifted that
+// reports drift in a Drifted condition on the CommonStatus of an addon
+func NewDriftedStatus(client client.Client) *driftedStatus {
+	return &driftedStatus{client: client}
+}
+
+type driftedStatus struct {
+	client client.Client
+}
+
+func (d *driftedStatus) Drifted(ctx context.Context, src declarative.DeclarativeObject, drifted []declarative.ObjectRef) error {
+	if len(drifted) == 0 {
+		return setCondition(ctx, d.client, src, metav1.Condition{
+			Type:   DriftedCondition,
+			Status: metav1.ConditionFalse,
+			Reason: "NoDrift",
+		})
+	}
+	return setCondition(ctx, d.client, src, metav1.Condition{
+		Type:    DriftedCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  "ObjectsDrifted",
+		Message: objectsMessage(drifted, "%d objects have drifted from the manifest: %s"),
+	})
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package status
+
+import (
+	"context"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative"
+)
+
+// FailedCondition is the type of the condition reporting why the last reconcile failed
+const FailedCondition = "Failed"
+
+// NewFailedStatus provides an implementation of declarative.Failed that
+// reports reconcile errors in a Failed condition on the CommonStatus of an addon.
+// The reason of the condition is the reason of the declarative.ReconcileError.
+func NewFailedStatus(client client.Client) *failedStatus {
+	return &failedStatus{client: client}
+}
+
+type failedStatus struct {
+	client client.Client
+}
+
+func (f *failedStatus) Failed(ctx context.Context, src declarative.DeclarativeObject, reconcileErr declarative.ReconcileError) error {
+	if reconcileErr == nil {
+		return setCondition(ctx, f.client, src, metav1.Condition{
+			Type:   FailedCondition,
+			Status: metav1.ConditionFalse,
+			Reason: "Reconciled",
+		})
+	}
+
+	message := reconcileErr.Error()
+	if !reconcileErr.IsRetryable() {
+		message += " (not retrying until the object changes)"
+	}
+	return setCondition(ctx, f.client, src, metav1.Condition{
+		Type:    FailedCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  reconcileErr.Reason(),
+		Message: message,
+	})
+}
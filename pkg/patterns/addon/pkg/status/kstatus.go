@@ -28,7 +28,7 @@ func (k *kstatusAggregator) Reconciled(ctx context.Context, src declarative.Decl
 	statusMap := make(map[status.Status]bool)
 	for _, object := range objs.Items {
 
-		unstruct, err := declarative.GetObjectFromCluster(object, k.reconciler)
+		unstruct, err := declarative.GetObjectFromTargetCluster(ctx, object, k.reconciler)
 		if err != nil {
 			log.WithValues("object", object.Kind+"/"+object.Name).Error(err, "Unable to get status of object")
 			return err
@@ -0,0 +1,67 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package status
+
+import (
+	"context"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	addonsv1alpha1 "sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/addon/pkg/apis/v1alpha1"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative"
+)
+
+const (
+	// PausedPhase is the phase reported on CommonStatus while reconciliation is suspended
+	PausedPhase = "Paused"
+	// PausedCondition is the type of the condition reporting whether reconciliation is suspended
+	PausedCondition = "Paused"
+)
+
+// NewPausedStatus provides an implementation of declarative.Paused that
+// reports a Paused phase and condition on the CommonStatus of an addon
+func NewPausedStatus(client client.Client) *pausedStatus {
+	return &pausedStatus{client: client}
+}
+
+type pausedStatus struct {
+	client client.Client
+}
+
+func (p *pausedStatus) Paused(ctx context.Context, src declarative.DeclarativeObject, paused bool) error {
+	return updateStatus(ctx, p.client, src, func(status *addonsv1alpha1.CommonStatus) {
+		if paused {
+			status.Phase = PausedPhase
+			meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+				Type:               PausedCondition,
+				Status:             metav1.ConditionTrue,
+				ObservedGeneration: src.GetGeneration(),
+				Reason:             "Paused",
+				Message:            "reconciliation is paused by the " + declarative.PausedAnnotation + " annotation or spec.paused",
+			})
+		} else if meta.FindStatusCondition(status.Conditions, PausedCondition) != nil {
+			// Only report resuming on addons that have been paused; the phase is updated once reconciled
+			meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+				Type:               PausedCondition,
+				Status:             metav1.ConditionFalse,
+				ObservedGeneration: src.GetGeneration(),
+				Reason:             "Resumed",
+			})
+		}
+	})
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package status
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative"
+)
+
+// PruneBlockedCondition is the type of the condition reporting whether pruning is blocked by the prune threshold
+const PruneBlockedCondition = "PruneBlocked"
+
+// NewPruneBlockedStatus provides an implementation of declarative.PruneBlocked that
+// reports a blocked prune in a PruneBlocked condition on the CommonStatus of an addon
+func NewPruneBlockedStatus(client client.Client) *pruneBlockedStatus {
+	return &pruneBlockedStatus{client: client}
+}
+
+type pruneBlockedStatus struct {
+	client client.Client
+}
+
+func (p *pruneBlockedStatus) PruneBlocked(ctx context.Context, src declarative.DeclarativeObject, blocked []declarative.ObjectRef, allow string) error {
+	if len(blocked) == 0 {
+		return setCondition(ctx, p.client, src, metav1.Condition{
+			Type:   PruneBlockedCondition,
+			Status: metav1.ConditionFalse,
+			Reason: "WithinThreshold",
+		})
+	}
+	return setCondition(ctx, p.client, src, metav1.Condition{
+		Type:   PruneBlockedCondition,
+		Status: metav1.ConditionTrue,
+		Reason: "ThresholdExceeded",
+		Message: objectsMessage(blocked, "%d objects were not pruned: %s") +
+			fmt.Sprintf("; set annotation %s=%s to prune them", declarative.AllowPruneAnnotation, allow),
+	})
+}
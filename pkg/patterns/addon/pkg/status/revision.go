@@ -0,0 +1,67 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package status
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	addonsv1alpha1 "sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/addon/pkg/apis/v1alpha1"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative"
+)
+
+// RolledBackCondition is the type of the condition reporting that the addon was automatically rolled back
+const RolledBackCondition = "RolledBack"
+
+// NewRevisionStatus provides an implementation of declarative.Revisioned and declarative.RolledBack
+// that reports the applied revision in the currentRevision field of the CommonStatus of an addon,
+// and automatic rollbacks in a RolledBack condition
+func NewRevisionStatus(client client.Client) *revisionStatus {
+	return &revisionStatus{client: client}
+}
+
+type revisionStatus struct {
+	client client.Client
+}
+
+func (s *revisionStatus) Revisioned(ctx context.Context, src declarative.DeclarativeObject, revision int64) error {
+	return updateStatus(ctx, s.client, src, func(status *addonsv1alpha1.CommonStatus) {
+		status.CurrentRevision = revision
+		rolledBack := meta.FindStatusCondition(status.Conditions, RolledBackCondition)
+		if rolledBack != nil && rolledBack.Status == metav1.ConditionTrue && rolledBack.ObservedGeneration != src.GetGeneration() {
+			// The spec has changed since the rollback, so the rollback is over
+			meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+				Type:               RolledBackCondition,
+				Status:             metav1.ConditionFalse,
+				ObservedGeneration: src.GetGeneration(),
+				Reason:             "SpecChanged",
+			})
+		}
+	})
+}
+
+func (s *revisionStatus) RolledBack(ctx context.Context, src declarative.DeclarativeObject, revision int64, reason string) error {
+	return setCondition(ctx, s.client, src, metav1.Condition{
+		Type:    RolledBackCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  "RolloutFailed",
+		Message: fmt.Sprintf("rolled back to revision %d: %s", revision, reason),
+	})
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+// AdoptionPolicy selects which existing objects a DeclarativeObject may take over when they are
+// in its manifest
+type AdoptionPolicy string
+
+const (
+	// AdoptUnowned takes over existing objects unless they are managed by another DeclarativeObject.
+	// This is the default.
+	AdoptUnowned AdoptionPolicy = "adopt-unowned"
+	// AdoptAll takes over every existing object, even one managed by another DeclarativeObject,
+	// as before conflicts were detected.  Objects managed by another DeclarativeObject are still
+	// reported as conflicts.
+	AdoptAll AdoptionPolicy = "adopt-all"
+	// AdoptNever only applies objects that do not exist yet, or that the DeclarativeObject already manages
+	AdoptNever AdoptionPolicy = "never"
+)
+
+// ownership is who manages a live object, relative to a DeclarativeObject
+type ownership int
+
+const (
+	// unowned objects have no sign of being managed by any DeclarativeObject of the kind
+	unowned ownership = iota
+	// ownedByInstance objects are managed by the DeclarativeObject
+	ownedByInstance
+	// ownedByOther objects are managed by another DeclarativeObject of the same kind
+	ownedByOther
+)
+
+// ownershipOf works out who manages live, from its owner references, the OwnerAnnotation and
+// OwnerUIDLabel, and the labels of the LabelMaker (labels).  instanceGVK is the kind of instance.
+// An owner of the same kind and name as instance is taken to be an earlier instance that was
+// recreated, so its objects are still managed by instance.  The labels only show another owner
+// when they are all set and some value differs; objects with some of them are unowned.
+func ownershipOf(live *unstructured.Unstructured, instance DeclarativeObject, instanceGVK schema.GroupVersionKind, labels map[string]string) ownership {
+	other := false
+
+	for _, ref := range live.GetOwnerReferences() {
+		gv, err := schema.ParseGroupVersion(ref.APIVersion)
+		if err != nil || gv.Group != instanceGVK.Group || ref.Kind != instanceGVK.Kind {
+			continue
+		}
+		if ref.UID == instance.GetUID() {
+			return ownedByInstance
+		}
+		if ref.Name == instance.GetName() && (instance.GetNamespace() == "" || live.GetNamespace() == instance.GetNamespace()) {
+			// Left behind by an earlier DeclarativeObject of the same name
+			return ownedByInstance
+		}
+		other = true
+	}
+
+	if owner, ok := live.GetAnnotations()[OwnerAnnotation]; ok {
+		if live.GetLabels()[OwnerUIDLabel] == string(instance.GetUID()) {
+			return ownedByInstance
+		}
+		gk, name, ok := parseOwnerString(owner)
+		if ok && gk == instanceGVK.GroupKind() {
+			if name.Namespace == instance.GetNamespace() && name.Name == instance.GetName() {
+				// Left behind by an earlier DeclarativeObject of the same name
+				return ownedByInstance
+			}
+			other = true
+		}
+	}
+	if other {
+		return ownedByOther
+	}
+
+	if len(labels) == 0 {
+		return unowned
+	}
+	differs := false
+	for k, v := range labels {
+		value, ok := live.GetLabels()[k]
+		if !ok {
+			return unowned
+		}
+		if value != v {
+			differs = true
+		}
+	}
+	if differs {
+		return ownedByOther
+	}
+	return ownedByInstance
+}
+
+// parseOwnerString parses the value of an OwnerAnnotation, as formatted by ownerString
+func parseOwnerString(s string) (schema.GroupKind, types.NamespacedName, bool) {
+	parts := strings.Split(s, "/")
+	switch len(parts) {
+	case 4:
+		// v1/<kind>/<namespace>/<name>
+		return schema.GroupKind{Kind: parts[1]}, types.NamespacedName{Namespace: parts[2], Name: parts[3]}, true
+	case 5:
+		// <group>/<version>/<kind>/<namespace>/<name>
+		return schema.GroupKind{Group: parts[0], Kind: parts[2]}, types.NamespacedName{Namespace: parts[3], Name: parts[4]}, true
+	}
+	return schema.GroupKind{}, types.NamespacedName{}, false
+}
+
+// adopts reports whether the adoption policy lets instance apply obj over the live object, and
+// whether the live object is managed by another DeclarativeObject.  Only AdoptAll applies objects
+// that conflict.
+func (r *Reconciler) adopts(ctx context.Context, instance DeclarativeObject, obj *manifest.Object, live *unstructured.Unstructured) (adopt bool, conflict bool, err error) {
+	if live == nil {
+		return true, false, nil
+	}
+
+	instanceGVK, err := apiutil.GVKForObject(instance, r.mgr.GetScheme())
+	if err != nil {
+		return false, false, err
+	}
+	var labels map[string]string
+	if r.options.labelMaker != nil {
+		labels = r.options.labelMaker(ctx, instance)
+	}
+
+	switch ownershipOf(live, instance, instanceGVK, labels) {
+	case ownedByInstance:
+		return true, false, nil
+	case ownedByOther:
+		return r.options.adoptionPolicy == AdoptAll, true, nil
+	default:
+		return r.options.adoptionPolicy != AdoptNever, false, nil
+	}
+}
+
+// reportConflicts reports the objects that are managed by another DeclarativeObject, in a Conflict
+// event and through the optional Conflicted interface of the Status.  They were not applied, unless
+// the adoption policy is AdoptAll.  It is called on every apply, so that the Status can clear a
+// resolved conflict.
+func (r *Reconciler) reportConflicts(ctx context.Context, instance DeclarativeObject, conflicts []ObjectRef) {
+	log := log.Log.WithValues("object", instance.GetNamespace()+"/"+instance.GetName())
+
+	if len(conflicts) != 0 {
+		var names []string
+		for _, ref := range conflicts {
+			names = append(names, ref.Kind+" "+ref.Name)
+		}
+		outcome := "were not applied"
+		if r.options.adoptionPolicy == AdoptAll {
+			outcome = "were taken over"
+		}
+		log.WithValues("conflicts", len(conflicts)).WithValues("policy", r.options.adoptionPolicy).Info("objects are managed by another object")
+		r.recordEvent(instance, "Warning", "Conflict", fmt.Sprintf("%d objects are managed by another object and %s: %s", len(conflicts), outcome, summarizeNames(names)))
+	}
+
+	if r.options.status != nil {
+		if c, ok := r.options.status.(Conflicted); ok {
+			if err := c.Conflicted(ctx, instance, conflicts); err != nil {
+				log.Error(err, "failed to report conflicts")
+			}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+func Test_ownershipOf(t *testing.T) {
+	instanceGVK := schema.GroupVersionKind{Group: "addons.example.org", Version: "v1", Kind: "Addon"}
+	instance := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "addon", UID: types.UID("1234")}}
+	labels := map[string]string{"addon": "addon", "app": "guestbook"}
+
+	ownerRef := func(kind string, uid types.UID) metav1.OwnerReference {
+		return metav1.OwnerReference{APIVersion: "addons.example.org/v1", Kind: kind, Name: "other", UID: uid}
+	}
+
+	tests := []struct {
+		name        string
+		ownerRefs   []metav1.OwnerReference
+		annotations map[string]string
+		labels      map[string]string
+		want        ownership
+	}{
+		{
+			name: "no owner",
+			want: unowned,
+		},
+		{
+			name:      "owner reference to instance",
+			ownerRefs: []metav1.OwnerReference{ownerRef("Addon", "1234")},
+			labels:    map[string]string{"addon": "other"},
+			want:      ownedByInstance,
+		},
+		{
+			name:      "owner reference to another instance",
+			ownerRefs: []metav1.OwnerReference{ownerRef("Addon", "5678")},
+			want:      ownedByOther,
+		},
+		{
+			name:      "owner reference to an earlier instance of the same name",
+			ownerRefs: []metav1.OwnerReference{{APIVersion: "addons.example.org/v1", Kind: "Addon", Name: "addon", UID: "0000"}},
+			want:      ownedByInstance,
+		},
+		{
+			name:      "owner reference of another kind",
+			ownerRefs: []metav1.OwnerReference{ownerRef("Other", "5678")},
+			want:      unowned,
+		},
+		{
+			name:        "owner annotation of instance",
+			annotations: map[string]string{OwnerAnnotation: "addons.example.org/v1/Addon/ns/addon"},
+			labels:      map[string]string{OwnerUIDLabel: "1234"},
+			want:        ownedByInstance,
+		},
+		{
+			name:        "owner annotation of an earlier instance of the same name",
+			annotations: map[string]string{OwnerAnnotation: "addons.example.org/v1/Addon/ns/addon"},
+			labels:      map[string]string{OwnerUIDLabel: "0000"},
+			want:        ownedByInstance,
+		},
+		{
+			name:        "owner annotation of another instance",
+			annotations: map[string]string{OwnerAnnotation: "addons.example.org/v1/Addon/ns/other"},
+			labels:      map[string]string{OwnerUIDLabel: "5678"},
+			want:        ownedByOther,
+		},
+		{
+			name:   "labels of instance",
+			labels: map[string]string{"addon": "addon", "app": "guestbook"},
+			want:   ownedByInstance,
+		},
+		{
+			name:   "labels of another instance",
+			labels: map[string]string{"addon": "other", "app": "guestbook"},
+			want:   ownedByOther,
+		},
+		{
+			name:   "some of the labels",
+			labels: map[string]string{"addon": "other"},
+			want:   unowned,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			live := &unstructured.Unstructured{}
+			live.SetNamespace("ns")
+			live.SetOwnerReferences(tt.ownerRefs)
+			live.SetAnnotations(tt.annotations)
+			live.SetLabels(tt.labels)
+			assert.Equal(t, tt.want, ownershipOf(live, instance, instanceGVK, labels))
+		})
+	}
+}
+
+func Test_adopts(t *testing.T) {
+	ctx := context.Background()
+	instance := newTestInstance("ns", "guestbook", "uid-1")
+
+	foreign := newTestConfigMap("ns", "foreign")
+	foreign.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: "addons.example.org/v1alpha1", Kind: "Guestbook", Name: "other", UID: "uid-2"}})
+	obj, err := manifest.NewObject(newTestConfigMap("ns", "foreign"))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		policy       AdoptionPolicy
+		wantAdopt    bool
+		wantConflict bool
+	}{
+		{policy: "", wantConflict: true},
+		{policy: AdoptAll, wantAdopt: true, wantConflict: true},
+		{policy: AdoptUnowned, wantConflict: true},
+		{policy: AdoptNever, wantConflict: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			r, _, _ := newTestReconciler(t)
+			r.options.adoptionPolicy = tt.policy
+			adopt, conflict, err := r.adopts(ctx, instance, obj, foreign)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantAdopt, adopt)
+			assert.Equal(t, tt.wantConflict, conflict)
+		})
+	}
+}
+
+func Test_reportConflicts(t *testing.T) {
+	ctx := context.Background()
+	instance := newTestInstance("ns", "guestbook", "uid-1")
+	conflicts := []ObjectRef{{Kind: "ConfigMap", Namespace: "ns", Name: "foreign"}}
+
+	r, _, _ := newTestReconciler(t)
+	r.reportConflicts(ctx, instance, conflicts)
+	assert.Equal(t, "Warning Conflict 1 objects are managed by another object and were not applied: ConfigMap foreign", nextEvent(r))
+
+	// Objects taken over by AdoptAll are still reported
+	r, _, _ = newTestReconciler(t)
+	r.options.adoptionPolicy = AdoptAll
+	r.reportConflicts(ctx, instance, conflicts)
+	assert.Equal(t, "Warning Conflict 1 objects are managed by another object and were taken over: ConfigMap foreign", nextEvent(r))
+}
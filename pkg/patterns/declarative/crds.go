@@ -0,0 +1,215 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/applier"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+func isCRD(obj *manifest.Object) bool {
+	return obj.Group == "apiextensions.k8s.io" && obj.Kind == "CustomResourceDefinition"
+}
+
+// reconcileCRDs applies the CustomResourceDefinitions in objects ahead of the other objects, and
+// reports whether they are all established.  If not, the reconcile is requeued rather than
+// blocking the worker.  The RESTMapper is then refreshed if it does not yet know the kinds they
+// define, so that the instances of those kinds can be looked up and applied.  objects must have
+// been through selectObjects, so that CustomResourceDefinitions get the same ignore and adoption
+// checks as other objects.  The outcome of the apply is recorded in Events on instance.
+func (r *Reconciler) reconcileCRDs(ctx context.Context, instance DeclarativeObject, objects *manifest.Objects, options applier.ApplyOptions) (bool, error) {
+	log := log.Log
+
+	crds := &manifest.Objects{}
+	for _, obj := range objects.Items {
+		if isCRD(obj) {
+			crds.Items = append(crds.Items, obj)
+		}
+	}
+	if len(crds.Items) == 0 {
+		return true, nil
+	}
+
+	// CRDs are applied again (as a no-op) with the rest of the manifest, so are never pruned here
+	options.PruneSelector = ""
+	options.Namespace = ""
+	// A CRD that is deleted and recreated takes all its objects with it, so conflicts are never
+	// forced (client-side apply forces by deleting and recreating)
+	options.Force = r.options.serverSideApply && r.options.forceConflicts
+	result, err := r.applier.Apply(ctx, crds, options)
+	r.recordApplyEvents(instance, result)
+	if err != nil {
+		for _, failed := range result.Filter(applier.OperationFailed) {
+			log.WithValues("name", failed.Name).Error(failed.Error, "applying CustomResourceDefinition")
+		}
+		return false, fmt.Errorf("error applying CustomResourceDefinitions: %v", err)
+	}
+
+	needsRefresh := false
+	for _, crd := range crds.Items {
+		live, err := r.getCRD(ctx, crd.Name)
+		if err != nil {
+			return false, err
+		}
+		if live == nil || !crdEstablished(live) {
+			log.WithValues("name", crd.Name).Info("CustomResourceDefinition is not established yet")
+			return false, nil
+		}
+
+		if !needsRefresh {
+			for _, gvk := range crdKinds(crd) {
+				if _, err := r.restMapper.RESTMapping(gvk.GroupKind(), gvk.Version); meta.IsNoMatchError(err) {
+					needsRefresh = true
+				}
+			}
+		}
+	}
+
+	if needsRefresh {
+		if resettable, ok := r.restMapper.(*resettableRESTMapper); ok {
+			log.Info("refreshing RESTMapper for new CustomResourceDefinitions")
+			if err := resettable.reset(); err != nil {
+				return false, fmt.Errorf("error refreshing RESTMapper: %v", err)
+			}
+		}
+	}
+	return true, nil
+}
+
+// getCRD returns the live CustomResourceDefinition, or nil if it does not exist
+func (r *Reconciler) getCRD(ctx context.Context, name string) (*unstructured.Unstructured, error) {
+	resource := schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}
+	live, err := r.dynamicClient.Resource(resource).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error getting CustomResourceDefinition %s: %v", name, err)
+	}
+	return live, nil
+}
+
+func crdEstablished(crd *unstructured.Unstructured) bool {
+	conditions, _, _ := unstructured.NestedSlice(crd.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if condition["type"] == "Established" && condition["status"] == "True" {
+			return true
+		}
+	}
+	return false
+}
+
+// crdKinds returns the kinds served by a CustomResourceDefinition
+func crdKinds(crd *manifest.Object) []schema.GroupVersionKind {
+	u := crd.UnstructuredObject()
+	group, _, _ := unstructured.NestedString(u.Object, "spec", "group")
+	kind, _, _ := unstructured.NestedString(u.Object, "spec", "names", "kind")
+
+	var kinds []schema.GroupVersionKind
+	versions, _, _ := unstructured.NestedSlice(u.Object, "spec", "versions")
+	for _, v := range versions {
+		version, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if name, ok := version["name"].(string); ok {
+			kinds = append(kinds, schema.GroupVersionKind{Group: group, Version: name, Kind: kind})
+		}
+	}
+	// apiextensions.k8s.io/v1beta1 allows a single version
+	if version, found, _ := unstructured.NestedString(u.Object, "spec", "version"); found && len(kinds) == 0 {
+		kinds = append(kinds, schema.GroupVersionKind{Group: group, Version: version, Kind: kind})
+	}
+	return kinds
+}
+
+var _ meta.RESTMapper = &resettableRESTMapper{}
+
+// resettableRESTMapper delegates to a RESTMapper that can be replaced with a freshly discovered
+// one, so that kinds from newly established CustomResourceDefinitions are found straight away
+type resettableRESTMapper struct {
+	mutex    sync.RWMutex
+	delegate meta.RESTMapper
+	config   *rest.Config
+}
+
+func newResettableRESTMapper(delegate meta.RESTMapper, config *rest.Config) *resettableRESTMapper {
+	return &resettableRESTMapper{delegate: delegate, config: config}
+}
+
+// reset replaces the delegate with a RESTMapper built from fresh discovery
+func (m *resettableRESTMapper) reset() error {
+	delegate, err := apiutil.NewDynamicRESTMapper(m.config)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.delegate = delegate
+	return nil
+}
+
+func (m *resettableRESTMapper) get() meta.RESTMapper {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.delegate
+}
+
+func (m *resettableRESTMapper) KindFor(resource schema.GroupVersionResource) (schema.GroupVersionKind, error) {
+	return m.get().KindFor(resource)
+}
+
+func (m *resettableRESTMapper) KindsFor(resource schema.GroupVersionResource) ([]schema.GroupVersionKind, error) {
+	return m.get().KindsFor(resource)
+}
+
+func (m *resettableRESTMapper) ResourceFor(input schema.GroupVersionResource) (schema.GroupVersionResource, error) {
+	return m.get().ResourceFor(input)
+}
+
+func (m *resettableRESTMapper) ResourcesFor(input schema.GroupVersionResource) ([]schema.GroupVersionResource, error) {
+	return m.get().ResourcesFor(input)
+}
+
+func (m *resettableRESTMapper) RESTMapping(gk schema.GroupKind, versions ...string) (*meta.RESTMapping, error) {
+	return m.get().RESTMapping(gk, versions...)
+}
+
+func (m *resettableRESTMapper) RESTMappings(gk schema.GroupKind, versions ...string) ([]*meta.RESTMapping, error) {
+	return m.get().RESTMappings(gk, versions...)
+}
+
+func (m *resettableRESTMapper) ResourceSingularizer(resource string) (string, error) {
+	return m.get().ResourceSingularizer(resource)
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/applier"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+func Test_crdKinds(t *testing.T) {
+	objects, err := manifest.ParseObjects(context.Background(), `
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.org
+spec:
+  group: example.org
+  names:
+    kind: Widget
+    plural: widgets
+  scope: Namespaced
+  versions:
+  - name: v1beta1
+  - name: v1
+---
+apiVersion: apiextensions.k8s.io/v1beta1
+kind: CustomResourceDefinition
+metadata:
+  name: gadgets.example.org
+spec:
+  group: example.org
+  names:
+    kind: Gadget
+    plural: gadgets
+  version: v1alpha1
+`)
+	if err != nil {
+		t.Fatalf("error parsing manifest: %v", err)
+	}
+
+	assert.True(t, isCRD(objects.Items[0]))
+	assert.Equal(t, []schema.GroupVersionKind{
+		{Group: "example.org", Version: "v1beta1", Kind: "Widget"},
+		{Group: "example.org", Version: "v1", Kind: "Widget"},
+	}, crdKinds(objects.Items[0]))
+	assert.Equal(t, []schema.GroupVersionKind{
+		{Group: "example.org", Version: "v1alpha1", Kind: "Gadget"},
+	}, crdKinds(objects.Items[1]))
+}
+
+// recordingApplier records the options of each Apply, without applying anything
+type recordingApplier struct {
+	options []applier.ApplyOptions
+}
+
+func (a *recordingApplier) Apply(ctx context.Context, objects *manifest.Objects, options applier.ApplyOptions) (*applier.ApplyResult, error) {
+	a.options = append(a.options, options)
+	return &applier.ApplyResult{}, nil
+}
+
+// failingApplier fails to apply every object
+type failingApplier struct{}
+
+func (failingApplier) Apply(ctx context.Context, objects *manifest.Objects, options applier.ApplyOptions) (*applier.ApplyResult, error) {
+	result := &applier.ApplyResult{}
+	for _, obj := range objects.Items {
+		result.Objects = append(result.Objects, applier.ObjectResult{Group: obj.Group, Kind: obj.Kind, Name: obj.Name, Operation: applier.OperationFailed, Error: errors.New("forbidden")})
+	}
+	return result, errors.New("forbidden")
+}
+
+func Test_reconcileCRDs(t *testing.T) {
+	ctx := context.Background()
+	objects, err := manifest.ParseObjects(ctx, `
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: guestbooks.addons.example.org
+spec:
+  group: addons.example.org
+  names:
+    kind: Guestbook
+  scope: Namespaced
+  versions:
+  - name: v1alpha1
+`)
+	assert.NoError(t, err)
+
+	established := &unstructured.Unstructured{}
+	established.SetAPIVersion("apiextensions.k8s.io/v1")
+	established.SetKind("CustomResourceDefinition")
+	established.SetName("guestbooks.addons.example.org")
+	assert.NoError(t, unstructured.SetNestedSlice(established.Object, []interface{}{
+		map[string]interface{}{"type": "Established", "status": "True"},
+	}, "status", "conditions"))
+
+	instance := newTestInstance("ns", "guestbook", "uid-1")
+
+	tests := []struct {
+		name  string
+		live  []runtime.Object
+		ready bool
+	}{
+		{name: "not created yet", ready: false},
+		{name: "established", live: []runtime.Object{established}, ready: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _, _ := newTestReconciler(t, tt.live...)
+			a := &recordingApplier{}
+			r.applier = a
+
+			ready, err := r.reconcileCRDs(ctx, instance, objects, applier.ApplyOptions{Force: true, PruneSelector: "app=guestbook"})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.ready, ready)
+			// Never deleted and recreated, nor pruned
+			assert.Equal(t, []applier.ApplyOptions{{}}, a.options)
+		})
+	}
+
+	// Failures are recorded in Events, as for the other objects
+	r, _, _ := newTestReconciler(t)
+	r.applier = failingApplier{}
+	_, err = r.reconcileCRDs(ctx, instance, objects, applier.ApplyOptions{})
+	assert.Error(t, err)
+	assert.Equal(t, "Warning ApplyFailed Failed to apply 1 objects: CustomResourceDefinition guestbooks.addons.example.org (forbidden)", nextEvent(r))
+}
@@ -0,0 +1,257 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+// DriftMode selects what happens when the live objects have drifted from the manifest
+type DriftMode string
+
+const (
+	// DriftReportOnly only reports drift; it is corrected by the next reconcile of the DeclarativeObject
+	DriftReportOnly DriftMode = "ReportOnly"
+	// DriftAutoCorrect reports drift and corrects it by reapplying the manifest
+	DriftAutoCorrect DriftMode = "AutoCorrect"
+)
+
+// appliedManifests remembers the hash of the manifest last applied for each DeclarativeObject, so
+// that a change to the manifest (e.g. a new version) is not mistaken for drift, and when it was applied
+type appliedManifests struct {
+	mutex  sync.Mutex
+	hashes map[types.NamespacedName]string
+	times  map[types.NamespacedName]time.Time
+}
+
+func (a *appliedManifests) set(name types.NamespacedName, hash string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.hashes == nil {
+		a.hashes = map[types.NamespacedName]string{}
+		a.times = map[types.NamespacedName]time.Time{}
+	}
+	a.hashes[name] = hash
+	a.times[name] = time.Now()
+}
+
+// appliedAt returns when the manifest of name was last applied, or the zero time if it has not
+// been applied since the operator started
+func (a *appliedManifests) appliedAt(name types.NamespacedName) time.Time {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.times[name]
+}
+
+func (a *appliedManifests) get(name types.NamespacedName) string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.hashes[name]
+}
+
+// forget drops what is remembered of name, once it has been deleted
+func (a *appliedManifests) forget(name types.NamespacedName) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	delete(a.hashes, name)
+	delete(a.times, name)
+}
+
+// appliedHash returns the hash of the manifest last applied for instance.  It is read from the
+// AppliedHashAnnotation, which is recorded with WithDriftDetection, so that it outlives a restart
+// of the operator.
+func (r *Reconciler) appliedHash(name types.NamespacedName, instance DeclarativeObject) string {
+	if hash, found := instance.GetAnnotations()[AppliedHashAnnotation]; found {
+		return hash
+	}
+	return r.appliedManifests.get(name)
+}
+
+// forgetDrift drops the drift of a deleted DeclarativeObject from the drifted_objects_record
+// metric, and what is remembered of its manifest
+func (r *Reconciler) forgetDrift(name types.NamespacedName) {
+	r.appliedManifests.forget(name)
+	if gvk, err := apiutil.GVKForObject(r.prototype, r.mgr.GetScheme()); err == nil {
+		driftedObjectsRecord.DeleteLabelValues(gvkString(gvk), name.Namespace, name.Name)
+	}
+}
+
+// detectDrift returns the objects that differ from the live objects, ignoring fields that are not
+// set in the manifest (such as defaulted and status fields).  Objects that are missing, and with
+// WithApplyPrune objects that would be pruned, have drifted too.  Nothing is returned if hash
+// is not that of the manifest that was last applied, as the differences are then not drift.
+func (r *Reconciler) detectDrift(ctx context.Context, name types.NamespacedName, instance DeclarativeObject, objects *manifest.Objects, hash string, defaultNamespace string) ([]ObjectRef, error) {
+	if r.appliedHash(name, instance) != hash {
+		return nil, nil
+	}
+
+	plan, err := r.buildPlan(ctx, instance, objects, defaultNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	var drifted []ObjectRef
+	drifted = append(drifted, plan.Added...)
+	drifted = append(drifted, plan.Changed...)
+	drifted = append(drifted, plan.Pruned...)
+	return drifted, nil
+}
+
+// reportDrift reports drifted objects in the drifted_objects_record metric, an Event and
+// through the optional Drifted interface of the Status
+func (r *Reconciler) reportDrift(ctx context.Context, instance DeclarativeObject, drifted []ObjectRef) {
+	log := log.Log.WithValues("object", instance.GetNamespace()+"/"+instance.GetName())
+
+	if gvk, err := apiutil.GVKForObject(instance, r.mgr.GetScheme()); err == nil {
+		driftedObjectsRecord.WithLabelValues(gvkString(gvk), instance.GetNamespace(), instance.GetName()).Set(float64(len(drifted)))
+	}
+
+	if len(drifted) != 0 {
+		var names []string
+		for _, ref := range drifted {
+			names = append(names, ref.Kind+" "+ref.Name)
+		}
+		message := fmt.Sprintf("%d objects have drifted from the manifest: %s", len(drifted), summarizeNames(names))
+		if r.options.driftMode == DriftAutoCorrect {
+			message += "; correcting"
+		}
+		log.WithValues("drifted", len(drifted)).Info("detected drift")
+		r.recordEvent(instance, "Warning", "Drifted", message)
+	}
+
+	if r.options.status != nil {
+		if d, ok := r.options.status.(Drifted); ok {
+			if err := d.Drifted(ctx, instance, drifted); err != nil {
+				log.Error(err, "failed to report drift")
+			}
+		}
+	}
+}
+
+// desiredObjects builds the objects that reconcileExists would apply for instance, with
+// buildDesired and selectObjects, and the hash of the manifest before ignored objects and fields
+// are taken into account.  defaultNamespace is the namespace the objects are applied in.
+func (r *Reconciler) desiredObjects(ctx context.Context, name types.NamespacedName, instance DeclarativeObject, defaultNamespace string) (*manifest.Objects, string, error) {
+	desired, err := r.buildDesired(ctx, name, instance)
+	if err != nil {
+		return nil, "", err
+	}
+	// Objects that are ignored or managed by another DeclarativeObject are not kept in sync
+	if _, err := r.selectObjects(ctx, instance, desired.objects, nil, defaultNamespace); err != nil {
+		return nil, "", err
+	}
+	return desired.objects, desired.hash, nil
+}
+
+var _ manager.Runnable = &driftDetector{}
+
+// driftDetector periodically reports drift of every DeclarativeObject, for DriftReportOnly
+type driftDetector struct {
+	r        *Reconciler
+	interval time.Duration
+}
+
+func (d *driftDetector) Start(ctx context.Context) error {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := d.detectAll(ctx); err != nil {
+				log.Log.Error(err, "detecting drift")
+			}
+		}
+	}
+}
+
+func (d *driftDetector) detectAll(ctx context.Context) error {
+	r := d.r
+
+	gvk, err := apiutil.GVKForObject(r.prototype, r.mgr.GetScheme())
+	if err != nil {
+		return err
+	}
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+	if err := r.client.List(ctx, list); err != nil {
+		return fmt.Errorf("error listing %v: %v", gvk, err)
+	}
+
+	for i := range list.Items {
+		item := &list.Items[i]
+		if !r.owns(item) {
+			continue
+		}
+		name := types.NamespacedName{Namespace: item.GetNamespace(), Name: item.GetName()}
+		log := log.Log.WithValues("object", name.String())
+
+		instance := r.prototype.DeepCopyObject().(DeclarativeObject)
+		if err := r.client.Get(ctx, name, instance); err != nil {
+			if !apierrors.IsNotFound(err) {
+				log.Error(err, "error reading object")
+			}
+			continue
+		}
+		if instance.GetDeletionTimestamp() != nil {
+			continue
+		}
+		// The objects of a paused DeclarativeObject may be edited by hand, so they have not drifted
+		if paused, err := IsPaused(instance); err != nil || paused {
+			continue
+		}
+
+		targetCtx, target, err := r.forTargetCluster(ctx, instance)
+		if err != nil {
+			log.Error(err, "connecting to target cluster to detect drift")
+			continue
+		}
+		ns := ""
+		if !r.options.preserveNamespace {
+			ns = name.Namespace
+		}
+		objects, hash, err := target.desiredObjects(targetCtx, name, instance, ns)
+		if err != nil {
+			log.Error(err, "building objects to detect drift")
+			continue
+		}
+		drifted, err := target.detectDrift(targetCtx, name, instance, objects, hash, ns)
+		if err != nil {
+			log.Error(err, "detecting drift")
+			continue
+		}
+		target.reportDrift(targetCtx, instance, drifted)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// newTestLiveConfigMap returns the live ConfigMap of newTestManifest(value)
+func newTestLiveConfigMap(value string) *unstructured.Unstructured {
+	u := newTestConfigMap("ns", "config")
+	u.Object["data"] = map[string]interface{}{"value": value}
+	return u
+}
+
+func Test_detectDrift(t *testing.T) {
+	ctx := context.Background()
+	name := types.NamespacedName{Namespace: "ns", Name: "guestbook"}
+	instance := newTestInstance("ns", "guestbook", "uid-1")
+	r, _, _ := newTestReconciler(t, newTestLiveConfigMap("one"))
+
+	_, applied, err := manifestHash(newTestManifest(t, "one"))
+	assert.NoError(t, err)
+	_, changed, err := manifestHash(newTestManifest(t, "two"))
+	assert.NoError(t, err)
+
+	// Nothing has been applied since the operator started, and the hash was not recorded
+	drifted, err := r.detectDrift(ctx, name, instance, newTestManifest(t, "one"), applied, "ns")
+	assert.NoError(t, err)
+	assert.Empty(t, drifted)
+
+	r.appliedManifests.set(name, applied)
+	drifted, err = r.detectDrift(ctx, name, instance, newTestManifest(t, "one"), applied, "ns")
+	assert.NoError(t, err)
+	assert.Empty(t, drifted)
+
+	// The live object was edited
+	r, _, _ = newTestReconciler(t, newTestLiveConfigMap("edited"))
+	r.appliedManifests.set(name, applied)
+	drifted, err = r.detectDrift(ctx, name, instance, newTestManifest(t, "one"), applied, "ns")
+	assert.NoError(t, err)
+	assert.Equal(t, []ObjectRef{{Kind: "ConfigMap", Namespace: "ns", Name: "config"}}, drifted)
+
+	// A new manifest is not drift
+	drifted, err = r.detectDrift(ctx, name, instance, newTestManifest(t, "two"), changed, "ns")
+	assert.NoError(t, err)
+	assert.Empty(t, drifted)
+
+	// The live object was deleted; the applied hash is read from the annotation after a restart
+	r, _, _ = newTestReconciler(t)
+	instance.SetAnnotations(map[string]string{AppliedHashAnnotation: applied})
+	drifted, err = r.detectDrift(ctx, name, instance, newTestManifest(t, "one"), applied, "ns")
+	assert.NoError(t, err)
+	assert.Equal(t, []ObjectRef{{Kind: "ConfigMap", Namespace: "ns", Name: "config"}}, drifted)
+}
+
+func Test_detectAll(t *testing.T) {
+	ctx := context.Background()
+	r, _, c := newTestReconciler(t, newTestLiveConfigMap("edited"))
+	r.prototype = newTestInstance("", "", "")
+	r.options.driftMode = DriftReportOnly
+	r.options.manifestController = staticManifestController{"manifest.yaml": `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: ns
+data:
+  value: one
+`}
+
+	applied := func(name string, annotations map[string]string) *unstructured.Unstructured {
+		instance := newTestInstance("ns", name, types.UID(name))
+		_, hash, err := r.desiredObjects(ctx, types.NamespacedName{Namespace: "ns", Name: name}, instance, "ns")
+		assert.NoError(t, err)
+		annotations[AppliedHashAnnotation] = hash
+		instance.SetAnnotations(annotations)
+		assert.NoError(t, c.Create(ctx, instance))
+		return instance
+	}
+	applied("guestbook", map[string]string{})
+	applied("paused", map[string]string{PausedAnnotation: "true"})
+
+	assert.NoError(t, (&driftDetector{r: r}).detectAll(ctx))
+
+	// Only the DeclarativeObject that is not paused reports drift
+	assert.Equal(t, "Warning Drifted 1 objects have drifted from the manifest: ConfigMap config", nextEvent(r))
+	assert.Equal(t, "", nextEvent(r))
+	gvk := "addons.example.org/v1alpha1/Guestbook"
+	assert.Equal(t, float64(1), testutil.ToFloat64(driftedObjectsRecord.WithLabelValues(gvk, "ns", "guestbook")))
+
+	// The metric of a deleted DeclarativeObject is removed
+	r.forgetDrift(types.NamespacedName{Namespace: "ns", Name: "guestbook"})
+	assert.False(t, driftedObjectsRecord.DeleteLabelValues(gvk, "ns", "guestbook"))
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/applier"
+)
+
+// Reasons of the ReconcileErrors, as reported on status conditions
+const (
+	LoadFailedReason      = "LoadFailed"
+	TransformFailedReason = "TransformFailed"
+	ApplyFailedReason     = "ApplyFailed"
+	StatusFailedReason    = "StatusFailed"
+)
+
+// ReconcileError is an error that the reconciler knows how to handle.  Retryable errors are
+// retried with an exponential backoff; other errors are not retried until the DeclarativeObject
+// (or an object it watches) changes.  Transforms and manifest loaders can return these errors to
+// classify their own failures.
+type ReconcileError interface {
+	error
+	// Reason is reported as the reason of status conditions
+	Reason() string
+	// IsRetryable reports whether retrying the reconcile can succeed without a change
+	IsRetryable() bool
+}
+
+// LoadError is returned when the manifest cannot be loaded (e.g. its channel is unreachable) or parsed
+type LoadError struct {
+	Err       error
+	Retryable bool
+}
+
+func (e *LoadError) Error() string     { return fmt.Sprintf("error loading manifest: %v", e.Err) }
+func (e *LoadError) Unwrap() error     { return e.Err }
+func (e *LoadError) Reason() string    { return LoadFailedReason }
+func (e *LoadError) IsRetryable() bool { return e.Retryable }
+
+// TransformError is returned when the manifest cannot be transformed into the objects to apply
+type TransformError struct {
+	Err       error
+	Retryable bool
+}
+
+func (e *TransformError) Error() string     { return fmt.Sprintf("error transforming manifest: %v", e.Err) }
+func (e *TransformError) Unwrap() error     { return e.Err }
+func (e *TransformError) Reason() string    { return TransformFailedReason }
+func (e *TransformError) IsRetryable() bool { return e.Retryable }
+
+// ApplyError is returned when the objects cannot be applied, e.g. because the API server is
+// unavailable (retryable) or because an admission webhook denied an object (not retryable)
+type ApplyError struct {
+	Err       error
+	Retryable bool
+}
+
+func (e *ApplyError) Error() string     { return fmt.Sprintf("error applying manifest: %v", e.Err) }
+func (e *ApplyError) Unwrap() error     { return e.Err }
+func (e *ApplyError) Reason() string    { return ApplyFailedReason }
+func (e *ApplyError) IsRetryable() bool { return e.Retryable }
+
+// StatusError is returned when the Status fails its preflight or version checks
+type StatusError struct {
+	Err       error
+	Retryable bool
+}
+
+func (e *StatusError) Error() string     { return fmt.Sprintf("error checking status: %v", e.Err) }
+func (e *StatusError) Unwrap() error     { return e.Err }
+func (e *StatusError) Reason() string    { return StatusFailedReason }
+func (e *StatusError) IsRetryable() bool { return e.Retryable }
+
+// classified returns err if it is already a ReconcileError, or the result of wrap otherwise,
+// so that the classification of a transform or loader is kept
+func classified(err error, wrap func(error) ReconcileError) error {
+	var reconcileErr ReconcileError
+	if errors.As(err, &reconcileErr) {
+		return err
+	}
+	return wrap(err)
+}
+
+// applyError classifies a failed apply.  It is not retryable if every object failed because
+// it was rejected by validation or by an admission webhook, as only a change can fix that.
+func applyError(result *applier.ApplyResult, err error) error {
+	permanent := isRejected(err)
+	if result != nil {
+		if failed := result.Filter(applier.OperationFailed); len(failed) != 0 {
+			permanent = true
+			for _, f := range failed {
+				if !isRejected(f.Error) {
+					permanent = false
+				}
+			}
+		}
+	}
+	return &ApplyError{Err: err, Retryable: !permanent}
+}
+
+// isRejected reports whether err is the API server refusing an object, as reported by the API
+// or by kubectl
+func isRejected(err error) bool {
+	if err == nil {
+		return false
+	}
+	if apierrors.IsInvalid(err) || apierrors.IsBadRequest(err) {
+		return true
+	}
+	message := err.Error()
+	return strings.Contains(message, "denied the request") ||
+		strings.Contains(message, "Error from server (Invalid)") ||
+		strings.Contains(message, "Error from server (BadRequest)")
+}
+
+// handleError maps the outcome of a reconcile of name to its result.  ReconcileErrors are
+// reported through the optional Failed interface of the Status and requeued with a backoff when
+// retryable; other errors are returned as they are, to be retried by the controller.
+func (r *Reconciler) handleError(ctx context.Context, name types.NamespacedName, instance DeclarativeObject, result reconcile.Result, err error) (reconcile.Result, error) {
+	log := log.Log.WithValues("object", name.String())
+
+	var reconcileErr ReconcileError
+	if err != nil && !errors.As(err, &reconcileErr) {
+		return result, err
+	}
+
+	if r.options.status != nil {
+		if failed, ok := r.options.status.(Failed); ok {
+			if statusErr := failed.Failed(ctx, instance, reconcileErr); statusErr != nil {
+				log.Error(statusErr, "failed to report reconcile error")
+			}
+		}
+	}
+
+	if reconcileErr == nil {
+		r.errorBackoff.reset(name)
+		return result, nil
+	}
+	if !reconcileErr.IsRetryable() {
+		r.errorBackoff.reset(name)
+		log.WithValues("reason", reconcileErr.Reason()).Info("reconcile failed, not retrying until the object changes", "error", reconcileErr.Error())
+		return reconcile.Result{}, nil
+	}
+	delay := r.errorBackoff.next(name)
+	log.WithValues("reason", reconcileErr.Reason()).WithValues("delay", delay.String()).Info("reconcile failed, requeueing", "error", reconcileErr.Error())
+	return reconcile.Result{RequeueAfter: delay}, nil
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/applier"
+)
+
+func Test_classified(t *testing.T) {
+	wrap := func(err error) ReconcileError {
+		return &TransformError{Err: err}
+	}
+
+	err := classified(errors.New("bad"), wrap)
+	var transformErr *TransformError
+	assert.True(t, errors.As(err, &transformErr))
+	assert.Equal(t, TransformFailedReason, transformErr.Reason())
+	assert.False(t, transformErr.IsRetryable())
+
+	// A transform can classify its own errors
+	err = classified(fmt.Errorf("in transform: %w", &LoadError{Err: errors.New("unreachable"), Retryable: true}), wrap)
+	var reconcileErr ReconcileError
+	assert.True(t, errors.As(err, &reconcileErr))
+	assert.Equal(t, LoadFailedReason, reconcileErr.Reason())
+	assert.True(t, reconcileErr.IsRetryable())
+}
+
+func Test_applyError(t *testing.T) {
+	gr := schema.GroupResource{Group: "apps", Resource: "deployments"}
+	invalid := apierrors.NewInvalid(schema.GroupKind{Group: "apps", Kind: "Deployment"}, "app", nil)
+
+	tests := []struct {
+		name      string
+		result    *applier.ApplyResult
+		err       error
+		retryable bool
+	}{
+		{
+			name:      "unavailable",
+			err:       apierrors.NewServiceUnavailable("unavailable"),
+			retryable: true,
+		},
+		{
+			name:      "denied by webhook",
+			err:       errors.New(`Error from server: admission webhook "validate.example.org" denied the request: no`),
+			retryable: false,
+		},
+		{
+			name: "every object invalid",
+			result: &applier.ApplyResult{Objects: []applier.ObjectResult{
+				{Kind: "Deployment", Name: "app", Operation: applier.OperationFailed, Error: fmt.Errorf("error applying: %w", invalid)},
+			}},
+			err:       errors.New("1 objects failed"),
+			retryable: false,
+		},
+		{
+			name: "some objects not rejected",
+			result: &applier.ApplyResult{Objects: []applier.ObjectResult{
+				{Kind: "Deployment", Name: "app", Operation: applier.OperationFailed, Error: invalid},
+				{Kind: "Deployment", Name: "other", Operation: applier.OperationFailed, Error: apierrors.NewConflict(gr, "other", errors.New("conflict"))},
+			}},
+			err:       errors.New("2 objects failed"),
+			retryable: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var applyErr *ApplyError
+			assert.True(t, errors.As(applyError(tt.result, tt.err), &applyErr))
+			assert.Equal(t, tt.retryable, applyErr.IsRetryable())
+			assert.Equal(t, ApplyFailedReason, applyErr.Reason())
+		})
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/applier"
+)
+
+// EventInterval is how long an Event is suppressed for after an identical Event
+// was recorded on the same DeclarativeObject
+const EventInterval = 10 * time.Minute
+
+// maxObjectsInEvent is the number of objects named in an Event
+const maxObjectsInEvent = 10
+
+// applyEventReasons are the reasons of the Events recorded for each Operation.
+// Unchanged objects are not reported.
+var applyEventReasons = []struct {
+	operation applier.Operation
+	reason    string
+}{
+	{applier.OperationCreated, "Created"},
+	{applier.OperationConfigured, "Configured"},
+	{applier.OperationPruned, "Pruned"},
+}
+
+// eventKey identifies the Events of one reason on one DeclarativeObject
+type eventKey struct {
+	name   types.NamespacedName
+	reason string
+}
+
+// sentEvent is the last Event recorded for an eventKey
+type sentEvent struct {
+	message string
+	at      time.Time
+}
+
+// eventLimiter suppresses Events that repeat the last Event of the same reason on the same
+// DeclarativeObject within EventInterval, e.g. when a failing apply is retried
+type eventLimiter struct {
+	mutex sync.Mutex
+	sent  map[eventKey]sentEvent
+	// evicted is when expired Events were last removed from sent
+	evicted time.Time
+}
+
+// allow reports whether an Event should be recorded, remembering it if so
+func (l *eventLimiter) allow(name types.NamespacedName, reason, message string, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.sent == nil {
+		l.sent = map[eventKey]sentEvent{}
+	}
+	// Expired Events no longer suppress anything, so they are removed at most once per
+	// EventInterval to keep sent from growing with every DeclarativeObject ever seen
+	if now.Sub(l.evicted) >= EventInterval {
+		for key, last := range l.sent {
+			if now.Sub(last.at) >= EventInterval {
+				delete(l.sent, key)
+			}
+		}
+		l.evicted = now
+	}
+	key := eventKey{name: name, reason: reason}
+	if last, ok := l.sent[key]; ok && last.message == message && now.Sub(last.at) < EventInterval {
+		return false
+	}
+	l.sent[key] = sentEvent{message: message, at: now}
+	return true
+}
+
+// recordEvent records an Event on instance, unless it is suppressed by the eventLimiter
+func (r *Reconciler) recordEvent(instance DeclarativeObject, eventType, reason, message string) {
+	name := types.NamespacedName{Namespace: instance.GetNamespace(), Name: instance.GetName()}
+	if !r.events.allow(name, reason, message, time.Now()) {
+		return
+	}
+	r.recorder.Event(instance, eventType, reason, message)
+}
+
+// recordApplyEvents records an Event on instance for each kind of change in result, naming the
+// objects that were changed, and a Warning naming the objects that failed to apply and why
+func (r *Reconciler) recordApplyEvents(instance DeclarativeObject, result *applier.ApplyResult) {
+	if result == nil {
+		return
+	}
+
+	for _, e := range applyEventReasons {
+		objects := result.Filter(e.operation)
+		if len(objects) == 0 {
+			continue
+		}
+		var names []string
+		for _, o := range objects {
+			names = append(names, o.Kind+" "+objectName(o.Namespace, o.Name))
+		}
+		message := fmt.Sprintf("%s %d objects: %s", e.reason, len(objects), summarizeNames(names))
+		r.recordEvent(instance, "Normal", e.reason, message)
+	}
+
+	failed := result.Filter(applier.OperationFailed)
+	if len(failed) != 0 {
+		var names []string
+		objects := 0
+		for _, o := range failed {
+			if o.Name == "" {
+				// The failure is not about any one object
+				names = append(names, o.Error.Error())
+				continue
+			}
+			objects++
+			names = append(names, fmt.Sprintf("%s %s (%v)", o.Kind, objectName(o.Namespace, o.Name), o.Error))
+		}
+		message := fmt.Sprintf("Failed to apply %d objects: %s", objects, summarizeNames(names))
+		if objects == 0 {
+			message = fmt.Sprintf("Failed to apply: %s", summarizeNames(names))
+		}
+		r.recordEvent(instance, "Warning", "ApplyFailed", message)
+	}
+}
+
+// objectName returns namespace/name, or name for cluster-scoped objects
+func objectName(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
+
+// summarizeNames joins names for an Event, naming at most maxObjectsInEvent of them
+func summarizeNames(names []string) string {
+	if len(names) > maxObjectsInEvent {
+		more := len(names) - maxObjectsInEvent
+		names = append(names[:maxObjectsInEvent:maxObjectsInEvent], fmt.Sprintf("and %d more", more))
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	recorder "k8s.io/client-go/tools/record"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/applier"
+)
+
+func Test_eventLimiter(t *testing.T) {
+	l := &eventLimiter{}
+	name := types.NamespacedName{Namespace: "ns", Name: "addon"}
+	now := time.Now()
+
+	assert.True(t, l.allow(name, "Created", "a", now))
+	assert.False(t, l.allow(name, "Created", "a", now.Add(time.Minute)))
+	assert.True(t, l.allow(name, "Configured", "a", now.Add(time.Minute)))
+	assert.True(t, l.allow(name, "Created", "b", now.Add(time.Minute)))
+	assert.True(t, l.allow(name, "Created", "b", now.Add(time.Minute+EventInterval)))
+	assert.True(t, l.allow(types.NamespacedName{Namespace: "ns", Name: "other"}, "Created", "b", now))
+
+	// Expired Events are evicted
+	assert.True(t, l.allow(name, "Pruned", "c", now.Add(3*EventInterval)))
+	assert.Len(t, l.sent, 1)
+}
+
+func Test_summarizeNames(t *testing.T) {
+	var names []string
+	for i := 0; i < maxObjectsInEvent+2; i++ {
+		names = append(names, fmt.Sprintf("o%d", i))
+	}
+	assert.Equal(t, "o0, o1", summarizeNames(names[:2]))
+	assert.Equal(t, "o0, o1, o2, o3, o4, o5, o6, o7, o8, o9, and 2 more", summarizeNames(names))
+}
+
+func Test_recordApplyEvents(t *testing.T) {
+	fakeRecorder := recorder.NewFakeRecorder(10)
+	r := &Reconciler{recorder: fakeRecorder, events: &eventLimiter{}}
+	instance := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "addon"}}
+
+	result := &applier.ApplyResult{Objects: []applier.ObjectResult{
+		{Kind: "Deployment", Namespace: "ns", Name: "app", Operation: applier.OperationCreated},
+		{Kind: "ClusterRole", Name: "app", Operation: applier.OperationCreated},
+		{Kind: "Service", Namespace: "ns", Name: "app", Operation: applier.OperationUnchanged},
+		{Kind: "ConfigMap", Namespace: "ns", Name: "old", Operation: applier.OperationPruned},
+		{Kind: "Secret", Namespace: "ns", Name: "app", Operation: applier.OperationFailed, Error: errors.New("forbidden")},
+	}}
+	r.recordApplyEvents(instance, result)
+	r.recordApplyEvents(instance, result)
+	close(fakeRecorder.Events)
+
+	var events []string
+	for e := range fakeRecorder.Events {
+		events = append(events, e)
+	}
+	assert.Equal(t, []string{
+		"Normal Created Created 2 objects: Deployment ns/app, ClusterRole app",
+		"Normal Pruned Pruned 1 objects: ConfigMap ns/old",
+		"Warning ApplyFailed Failed to apply 1 objects: Secret ns/app (forbidden)",
+	}, events)
+
+	// A failure that is not about an object is reported as it is
+	fakeRecorder = recorder.NewFakeRecorder(10)
+	r = &Reconciler{recorder: fakeRecorder, events: &eventLimiter{}}
+	r.recordApplyEvents(instance, &applier.ApplyResult{Objects: []applier.ObjectResult{
+		{Operation: applier.OperationFailed, Error: errors.New("exit status 1")},
+	}})
+	assert.Equal(t, "Warning ApplyFailed Failed to apply: exit status 1", <-fakeRecorder.Events)
+}
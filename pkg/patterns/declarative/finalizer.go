@@ -0,0 +1,301 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/applier"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+// DeletionPollInterval is how long we wait before checking again that deleted objects are gone
+const DeletionPollInterval = 5 * time.Second
+
+// reconcileFinalizer ensures the finalizer is present on a live DeclarativeObject
+func (r *Reconciler) reconcileFinalizer(ctx context.Context, instance DeclarativeObject) error {
+	if controllerutil.ContainsFinalizer(instance, r.options.finalizer) {
+		return nil
+	}
+
+	controllerutil.AddFinalizer(instance, r.options.finalizer)
+	if err := r.client.Update(ctx, instance); err != nil {
+		return fmt.Errorf("error adding finalizer: %v", err)
+	}
+	return nil
+}
+
+// reconcileDelete tears down the objects managed by a DeclarativeObject that is being deleted,
+// in the reverse of DefaultObjectOrder.  Objects are deleted one tier (sort score) at a time,
+// and the next tier is only deleted once the previous one is gone.  The finalizer is removed
+// once every object has been deleted.
+func (r *Reconciler) reconcileDelete(ctx context.Context, name types.NamespacedName, instance DeclarativeObject) (reconcile.Result, error) {
+	log := log.Log.WithValues("object", name.String())
+
+	if !controllerutil.ContainsFinalizer(instance, r.options.finalizer) {
+		return reconcile.Result{}, nil
+	}
+
+	ns := ""
+	if !r.options.preserveNamespace {
+		ns = name.Namespace
+	}
+
+	refs, hooks, hash, err := r.deletionRefs(ctx, name, instance, ns)
+	if err != nil {
+		log.Error(err, "finding objects to delete")
+		return reconcile.Result{}, err
+	}
+
+	if len(hooks) != 0 {
+		applyOptions := applier.ApplyOptions{
+			Namespace: ns,
+			Validate:  r.options.validate,
+			Force:     true,
+		}
+		if r.options.serverSideApply {
+			applyOptions.Force = r.options.forceConflicts
+		}
+		done, err := r.runHooks(ctx, instance, hooks, HookPreDelete, hash, ns, applyOptions)
+		if err != nil {
+			log.Error(err, "running hooks")
+			return reconcile.Result{}, fmt.Errorf("error running %s hooks: %v", HookPreDelete, err)
+		}
+		if !done {
+			log.Info("waiting for pre-delete hooks")
+			return reconcile.Result{RequeueAfter: DeletionPollInterval}, nil
+		}
+		// Hooks left behind are deleted along with the other objects, once they are gone
+		hookRefs, err := r.objectRefs(&manifest.Objects{Items: hooks}, ns)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		for ref := range hookRefs {
+			refs[ref] = true
+		}
+	}
+
+	score := DefaultObjectOrder(ctx)
+	tiers := map[int][]ObjectRef{}
+	for ref := range refs {
+		s := score(&manifest.Object{Group: ref.Group, Kind: ref.Kind, Namespace: ref.Namespace, Name: ref.Name})
+		tiers[s] = append(tiers[s], ref)
+	}
+	var scores []int
+	for s := range tiers {
+		scores = append(scores, s)
+	}
+	sort.Ints(scores)
+
+	// Objects are created in increasing score, so are deleted in decreasing score
+	var remaining []ObjectRef
+	for i := len(scores) - 1; i >= 0; i-- {
+		tier := tiers[scores[i]]
+		sort.Slice(tier, func(i, j int) bool {
+			return fmt.Sprintf("%v", tier[i]) < fmt.Sprintf("%v", tier[j])
+		})
+		for _, ref := range tier {
+			gone, err := r.deleteRef(ctx, instance, ref)
+			if err != nil {
+				log.WithValues("kind", ref.Kind).WithValues("name", ref.Name).Error(err, "deleting object")
+				return reconcile.Result{}, err
+			}
+			if !gone {
+				remaining = append(remaining, ref)
+			}
+		}
+		if len(remaining) != 0 {
+			break
+		}
+	}
+
+	if r.options.status != nil {
+		if deleting, ok := r.options.status.(Deleting); ok {
+			if err := deleting.Deleting(ctx, instance, remaining); err != nil {
+				log.Error(err, "failed to report deletion status")
+			}
+		}
+	}
+
+	if len(remaining) != 0 {
+		log.WithValues("remaining", len(remaining)).Info("waiting for objects to be deleted")
+		return reconcile.Result{RequeueAfter: DeletionPollInterval}, nil
+	}
+
+	log.Info("all objects deleted, removing finalizer")
+	controllerutil.RemoveFinalizer(instance, r.options.finalizer)
+	if err := r.client.Update(ctx, instance); err != nil {
+		return reconcile.Result{}, fmt.Errorf("error removing finalizer: %v", err)
+	}
+	return reconcile.Result{}, nil
+}
+
+// deletionRefs returns the objects to delete for instance, along with the pre-delete hooks of
+// its manifest and the hash of the manifest.  The objects are those of the applied revision
+// (with WithRevisionHistory) and of the inventory (with WithInventoryPrune), as recorded when
+// they were applied, plus those of the current manifest.  If the manifest cannot be built (e.g.
+// its channel is unreachable), the recorded objects are deleted without running the hooks, so
+// that the DeclarativeObject is not stuck; without a record the error is returned.
+func (r *Reconciler) deletionRefs(ctx context.Context, name types.NamespacedName, instance DeclarativeObject, defaultNamespace string) (map[ObjectRef]bool, []*manifest.Object, string, error) {
+	log := log.Log.WithValues("object", name.String())
+
+	refs := map[ObjectRef]bool{}
+	recorded := false
+	if r.options.revisionHistoryLimit > 0 {
+		objects, err := r.appliedRevision(ctx, instance)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		if objects != nil {
+			recorded = true
+			revisionRefs, err := r.objectRefs(objects, defaultNamespace)
+			if err != nil {
+				return nil, nil, "", err
+			}
+			for ref := range revisionRefs {
+				refs[ref] = true
+			}
+		}
+	}
+	if r.options.inventoryPrune {
+		inventory, err := r.loadInventory(ctx, instance)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		if inventory != nil {
+			recorded = true
+		}
+		for _, ref := range inventory {
+			refs[ref] = true
+		}
+	}
+
+	objects, err := r.BuildDeploymentObjects(ctx, name, instance)
+	if err == nil {
+		objects, err = parseListKind(objects)
+	}
+	if err != nil {
+		if !recorded {
+			return nil, nil, "", fmt.Errorf("error building deployment objects: %v", err)
+		}
+		log.Error(err, "building deployment objects for deletion, deleting the recorded objects without running hooks")
+		r.recordEvent(instance, "Warning", "HooksSkipped", fmt.Sprintf("deleting the recorded objects without running %s hooks, as the manifest cannot be built: %v", HookPreDelete, err))
+		return refs, nil, "", nil
+	}
+
+	_, hash, err := manifestHash(objects)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	hooks, err := splitHooks(objects)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	manifestRefs, err := r.objectRefs(objects, defaultNamespace)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	for ref := range manifestRefs {
+		refs[ref] = true
+	}
+
+	var preDelete []*manifest.Object
+	for _, hook := range hooks {
+		if hasHookPhase(hook, HookPreDelete) {
+			preDelete = append(preDelete, hook)
+		}
+	}
+	// Hooks of other phases may have been left behind, so are deleted too
+	hookRefs, err := r.objectRefs(&manifest.Objects{Items: hooks}, defaultNamespace)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	for ref := range hookRefs {
+		refs[ref] = true
+	}
+	return refs, preDelete, hash, nil
+}
+
+// deleteRef issues a delete for the object of ref if it still exists, and reports whether it is
+// gone.  Objects that have the ignore annotation, or that are now managed by another
+// DeclarativeObject, are left alone.
+func (r *Reconciler) deleteRef(ctx context.Context, instance DeclarativeObject, ref ObjectRef) (bool, error) {
+	mapping, err := r.restMapper.RESTMapping(schema.GroupKind{Group: ref.Group, Kind: ref.Kind})
+	if err != nil {
+		if meta.IsNoMatchError(err) {
+			// The kind no longer exists (e.g. its CRD was deleted), so neither can the object
+			return true, nil
+		}
+		return false, err
+	}
+	var resource dynamic.ResourceInterface = r.dynamicClient.Resource(mapping.Resource)
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		resource = r.dynamicClient.Resource(mapping.Resource).Namespace(ref.Namespace)
+	}
+
+	live, err := resource.Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	if _, ok := live.GetAnnotations()["addons.k8s.io/ignore"]; ok {
+		// The object has been handed over to the user, leave it alone
+		return true, nil
+	}
+	instanceGVK, err := apiutil.GVKForObject(instance, r.mgr.GetScheme())
+	if err != nil {
+		return false, err
+	}
+	var labels map[string]string
+	if r.options.labelMaker != nil {
+		labels = r.options.labelMaker(ctx, instance)
+	}
+	if ownershipOf(live, instance, instanceGVK, labels) == ownedByOther {
+		return true, nil
+	}
+
+	if live.GetDeletionTimestamp() != nil {
+		return false, nil
+	}
+
+	uid := live.GetUID()
+	propagation := metav1.DeletePropagationBackground
+	err = resource.Delete(ctx, ref.Name, metav1.DeleteOptions{
+		Preconditions:     &metav1.Preconditions{UID: &uid},
+		PropagationPolicy: &propagation,
+	})
+	if err != nil && !apierrors.IsNotFound(err) && !apierrors.IsConflict(err) {
+		return false, err
+	}
+	return false, nil
+}
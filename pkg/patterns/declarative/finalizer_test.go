@@ -0,0 +1,104 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// failingManifestController fails to load any manifest, as when its channel is unreachable
+type failingManifestController struct{}
+
+func (failingManifestController) ResolveManifest(ctx context.Context, object runtime.Object) (map[string]string, error) {
+	return nil, errors.New("channel is unreachable")
+}
+
+func Test_reconcileDelete(t *testing.T) {
+	ctx := context.Background()
+	configMaps := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	deployments := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+
+	deployment := &unstructured.Unstructured{}
+	deployment.SetAPIVersion("apps/v1")
+	deployment.SetKind("Deployment")
+	deployment.SetNamespace("ns")
+	deployment.SetName("guestbook")
+
+	r, dynamicClient, c := newTestReconciler(t, newTestConfigMap("ns", "config"), deployment)
+	r.prototype = newTestInstance("", "", "")
+	r.options.finalizer = "addons.example.org/finalizer"
+	r.options.inventoryPrune = true
+	r.options.manifestController = failingManifestController{}
+
+	instance := newTestInstance("ns", "guestbook", "1")
+	instance.SetFinalizers([]string{r.options.finalizer})
+	assert.NoError(t, c.Create(ctx, instance))
+	assert.NoError(t, r.saveInventory(ctx, instance, map[ObjectRef]bool{
+		{Kind: "ConfigMap", Namespace: "ns", Name: "config"}:                    true,
+		{Group: "apps", Kind: "Deployment", Namespace: "ns", Name: "guestbook"}: true,
+	}))
+	name := types.NamespacedName{Namespace: "ns", Name: "guestbook"}
+
+	// The manifest cannot be loaded, but the inventory records what to delete; the Deployment
+	// is created after the ConfigMap, so is deleted first
+	result, err := r.reconcileDelete(ctx, name, instance)
+	assert.NoError(t, err)
+	assert.NotZero(t, result.RequeueAfter)
+	_, err = dynamicClient.Resource(deployments).Namespace("ns").Get(ctx, "guestbook", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	_, err = dynamicClient.Resource(configMaps).Namespace("ns").Get(ctx, "config", metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	result, err = r.reconcileDelete(ctx, name, instance)
+	assert.NoError(t, err)
+	assert.NotZero(t, result.RequeueAfter)
+	_, err = dynamicClient.Resource(configMaps).Namespace("ns").Get(ctx, "config", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+
+	// Everything is gone, so the finalizer is removed
+	result, err = r.reconcileDelete(ctx, name, instance)
+	assert.NoError(t, err)
+	assert.Zero(t, result.RequeueAfter)
+	assert.Empty(t, instance.GetFinalizers())
+}
+
+func Test_reconcileDeleteWithoutRecord(t *testing.T) {
+	ctx := context.Background()
+	r, _, c := newTestReconciler(t)
+	r.prototype = newTestInstance("", "", "")
+	r.options.finalizer = "addons.example.org/finalizer"
+	r.options.manifestController = failingManifestController{}
+
+	instance := newTestInstance("ns", "guestbook", "1")
+	instance.SetFinalizers([]string{r.options.finalizer})
+	assert.NoError(t, c.Create(ctx, instance))
+
+	// Without a record of the applied objects, deleting nothing would leak them
+	_, err := r.reconcileDelete(ctx, types.NamespacedName{Namespace: "ns", Name: "guestbook"}, instance)
+	assert.Error(t, err)
+	assert.Equal(t, []string{r.options.finalizer}, instance.GetFinalizers())
+}
@@ -0,0 +1,331 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/cli-utils/pkg/kstatus/status"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/applier"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+const (
+	// HookAnnotation marks an object of the manifest as a hook, run at the comma-separated
+	// HookPhases rather than applied with the rest of the manifest
+	HookAnnotation = "addons.k8s.io/hook"
+	// HookDeletePolicyAnnotation lists the comma-separated HookDeletePolicies of a hook
+	HookDeletePolicyAnnotation = "addons.k8s.io/hook-delete-policy"
+	// HookRunAnnotation is set on hook objects to the phase and manifest hash they were run for
+	HookRunAnnotation = "addons.k8s.io/hook-run"
+
+	// AppliedHashAnnotation is set on the DeclarativeObject to the hash of the manifest that was
+	// last fully applied, including its post-install or post-upgrade hooks
+	AppliedHashAnnotation = "addons.k8s.io/applied-hash"
+	// CompletedHooksAnnotation is set on the DeclarativeObject to the phase and manifest hash of
+	// the hooks that last completed
+	CompletedHooksAnnotation = "addons.k8s.io/completed-hooks"
+)
+
+// HookPhase is when a hook is run
+type HookPhase string
+
+const (
+	// HookPreInstall hooks run before the manifest is first applied
+	HookPreInstall HookPhase = "pre-install"
+	// HookPostInstall hooks run once the manifest has first been applied
+	HookPostInstall HookPhase = "post-install"
+	// HookPreUpgrade hooks run before a changed manifest is applied
+	HookPreUpgrade HookPhase = "pre-upgrade"
+	// HookPostUpgrade hooks run once a changed manifest has been applied
+	HookPostUpgrade HookPhase = "post-upgrade"
+	// HookPreDelete hooks run before the objects of a deleted DeclarativeObject are deleted.
+	// Requires WithFinalizer.
+	HookPreDelete HookPhase = "pre-delete"
+)
+
+var hookPhases = map[HookPhase]bool{
+	HookPreInstall:  true,
+	HookPostInstall: true,
+	HookPreUpgrade:  true,
+	HookPostUpgrade: true,
+	HookPreDelete:   true,
+}
+
+// HookDeletePolicy is when a hook object is deleted
+type HookDeletePolicy string
+
+const (
+	// HookBeforeCreation deletes the hook object of an earlier run before it is run again.
+	// This always happens, as hooks such as Jobs cannot be updated.
+	HookBeforeCreation HookDeletePolicy = "before-hook-creation"
+	// HookSucceeded deletes the hook object once it has succeeded
+	HookSucceeded HookDeletePolicy = "hook-succeeded"
+	// HookFailed deletes the hook object if it fails, so that it is run again on the next reconcile
+	HookFailed HookDeletePolicy = "hook-failed"
+)
+
+// splitHooks removes the hooks from objects and returns them
+func splitHooks(objects *manifest.Objects) ([]*manifest.Object, error) {
+	var items, hooks []*manifest.Object
+	for _, obj := range objects.Items {
+		value, ok := obj.UnstructuredObject().GetAnnotations()[HookAnnotation]
+		if !ok {
+			items = append(items, obj)
+			continue
+		}
+		for _, phase := range splitList(value) {
+			if !hookPhases[HookPhase(phase)] {
+				return nil, fmt.Errorf("invalid %s annotation %q on %s %s", HookAnnotation, value, obj.Kind, obj.Name)
+			}
+		}
+		hooks = append(hooks, obj)
+	}
+	objects.Items = items
+	return hooks, nil
+}
+
+// hasHookPhase reports whether hook is run at phase
+func hasHookPhase(hook *manifest.Object, phase HookPhase) bool {
+	for _, p := range splitList(hook.UnstructuredObject().GetAnnotations()[HookAnnotation]) {
+		if HookPhase(p) == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// hasDeletePolicy reports whether hook has the HookDeletePolicy policy
+func hasDeletePolicy(hook *manifest.Object, policy HookDeletePolicy) bool {
+	for _, p := range splitList(hook.UnstructuredObject().GetAnnotations()[HookDeletePolicyAnnotation]) {
+		if HookDeletePolicy(p) == policy {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(s string) []string {
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// hookPhasesFor returns the hook phases to run around applying the manifest with hash: install
+// if no manifest has been applied, upgrade if a different one has.  Both are empty if the manifest
+// has already been applied.
+func hookPhasesFor(instance DeclarativeObject, hash string) (pre HookPhase, post HookPhase) {
+	applied, found := instance.GetAnnotations()[AppliedHashAnnotation]
+	switch {
+	case !found:
+		return HookPreInstall, HookPostInstall
+	case applied != hash:
+		return HookPreUpgrade, HookPostUpgrade
+	}
+	return "", ""
+}
+
+// runHooks runs the hooks for phase, and reports whether they have all succeeded.  Hooks are
+// run for a manifest once: their completion is recorded in the CompletedHooksAnnotation.  If a
+// hook fails an error is returned.
+func (r *Reconciler) runHooks(ctx context.Context, instance DeclarativeObject, hooks []*manifest.Object, phase HookPhase, hash string, defaultNamespace string, options applier.ApplyOptions) (bool, error) {
+	log := log.Log.WithValues("object", instance.GetNamespace()+"/"+instance.GetName()).WithValues("phase", phase)
+
+	run := string(phase) + "/" + hash
+	if instance.GetAnnotations()[CompletedHooksAnnotation] == run {
+		return true, nil
+	}
+
+	var selected []*manifest.Object
+	for _, hook := range hooks {
+		if hasHookPhase(hook, phase) {
+			selected = append(selected, hook)
+		}
+	}
+	if len(selected) == 0 {
+		return true, nil
+	}
+
+	// Hooks are applied on their own, so must never prune the rest of the manifest
+	options.PruneSelector = ""
+
+	pending := false
+	var succeeded, failed []*manifest.Object
+	var messages []string
+	for _, hook := range selected {
+		resource, err := r.resourceFor(hook, defaultNamespace)
+		if err != nil {
+			return false, fmt.Errorf("unable to get mapping for hook %s %s: %v", hook.Kind, hook.Name, err)
+		}
+		live, err := resource.Get(ctx, hook.Name, metav1.GetOptions{})
+		if err != nil {
+			if !apierrors.IsNotFound(err) {
+				return false, fmt.Errorf("unable to get hook %s %s: %v", hook.Kind, hook.Name, err)
+			}
+			live = nil
+		}
+
+		if live != nil && live.GetAnnotations()[HookRunAnnotation] != run {
+			// Left behind by an earlier run
+			if live.GetDeletionTimestamp() == nil {
+				log.WithValues("kind", hook.Kind).WithValues("name", hook.Name).Info("deleting hook of an earlier run")
+				if err := r.deleteHook(ctx, hook, defaultNamespace); err != nil {
+					return false, err
+				}
+			}
+			pending = true
+			continue
+		}
+
+		if live == nil {
+			log.WithValues("kind", hook.Kind).WithValues("name", hook.Name).Info("running hook")
+			if err := r.startHook(ctx, instance, hook, run, options); err != nil {
+				return false, err
+			}
+			pending = true
+			continue
+		}
+
+		res, err := status.Compute(live)
+		if err != nil {
+			return false, fmt.Errorf("unable to compute status of hook %s %s: %v", hook.Kind, hook.Name, err)
+		}
+		switch res.Status {
+		case status.CurrentStatus:
+			succeeded = append(succeeded, hook)
+		case status.FailedStatus:
+			failed = append(failed, hook)
+			messages = append(messages, fmt.Sprintf("%s %s: %s", hook.Kind, hook.Name, res.Message))
+		default:
+			log.WithValues("kind", hook.Kind).WithValues("name", hook.Name).WithValues("status", res.Status).Info("waiting for hook")
+			pending = true
+		}
+	}
+
+	if len(failed) != 0 {
+		for _, hook := range failed {
+			if hasDeletePolicy(hook, HookFailed) {
+				if err := r.deleteHook(ctx, hook, defaultNamespace); err != nil {
+					log.WithValues("kind", hook.Kind).WithValues("name", hook.Name).Error(err, "deleting failed hook")
+				}
+			}
+		}
+		message := fmt.Sprintf("%s hooks failed: %s", phase, strings.Join(messages, "; "))
+		r.recordEvent(instance, "Warning", "HookFailed", message)
+		return false, fmt.Errorf("%s", message)
+	}
+	if pending {
+		return false, nil
+	}
+
+	// Record completion before deleting the hooks, so that they are not run again
+	if err := r.setAnnotations(ctx, instance, map[string]string{CompletedHooksAnnotation: run}); err != nil {
+		return false, err
+	}
+	var names []string
+	for _, hook := range succeeded {
+		names = append(names, hook.Kind+" "+hook.Name)
+		if hasDeletePolicy(hook, HookSucceeded) {
+			if err := r.deleteHook(ctx, hook, defaultNamespace); err != nil {
+				log.WithValues("kind", hook.Kind).WithValues("name", hook.Name).Error(err, "deleting succeeded hook")
+			}
+		}
+	}
+	r.recordEvent(instance, "Normal", "HooksCompleted", fmt.Sprintf("%s hooks completed: %s", phase, summarizeNames(names)))
+	return true, nil
+}
+
+// startHook applies hook, marked with run.  The labels of the LabelMaker are removed, so that the
+// hook is neither pruned nor watched while it runs.
+func (r *Reconciler) startHook(ctx context.Context, instance DeclarativeObject, hook *manifest.Object, run string, options applier.ApplyOptions) error {
+	u := hook.UnstructuredObject()
+	annotations := u.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[HookRunAnnotation] = run
+	if err := hook.SetNestedStringMap(annotations, "metadata", "annotations"); err != nil {
+		return err
+	}
+	if r.options.labelMaker != nil {
+		labels := u.GetLabels()
+		for k := range r.options.labelMaker(ctx, instance) {
+			delete(labels, k)
+		}
+		if len(labels) == 0 {
+			unstructured.RemoveNestedField(u.Object, "metadata", "labels")
+		} else if err := hook.SetNestedStringMap(labels, "metadata", "labels"); err != nil {
+			return err
+		}
+	}
+
+	result, err := r.applier.Apply(ctx, &manifest.Objects{Items: []*manifest.Object{hook}}, options)
+	if result != nil {
+		r.recordApplyEvents(instance, result)
+	}
+	if err != nil {
+		return fmt.Errorf("error applying hook %s %s: %v", hook.Kind, hook.Name, err)
+	}
+	return nil
+}
+
+// deleteHook deletes the live object of hook, along with its dependents (e.g. the Pods of a Job)
+func (r *Reconciler) deleteHook(ctx context.Context, hook *manifest.Object, defaultNamespace string) error {
+	resource, err := r.resourceFor(hook, defaultNamespace)
+	if err != nil {
+		return err
+	}
+	propagation := metav1.DeletePropagationBackground
+	err = resource.Delete(ctx, hook.Name, metav1.DeleteOptions{PropagationPolicy: &propagation})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error deleting hook %s %s: %v", hook.Kind, hook.Name, err)
+	}
+	return nil
+}
+
+// setAnnotations sets annotations on the DeclarativeObject, if they are not already set
+func (r *Reconciler) setAnnotations(ctx context.Context, instance DeclarativeObject, set map[string]string) error {
+	annotations := instance.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	changed := false
+	for k, v := range set {
+		if current, found := annotations[k]; !found || current != v {
+			annotations[k] = v
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	instance.SetAnnotations(annotations)
+	if err := r.client.Update(ctx, instance); err != nil {
+		return fmt.Errorf("error setting annotations: %v", err)
+	}
+	return nil
+}
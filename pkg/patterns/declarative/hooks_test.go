@@ -0,0 +1,103 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+func Test_splitHooks(t *testing.T) {
+	objects, err := manifest.ParseObjects(context.Background(), `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate
+  annotations:
+    addons.k8s.io/hook: pre-install, pre-upgrade
+    addons.k8s.io/hook-delete-policy: hook-succeeded
+`)
+	assert.NoError(t, err)
+
+	hooks, err := splitHooks(objects)
+	assert.NoError(t, err)
+	assert.Len(t, objects.Items, 1)
+	assert.Equal(t, "config", objects.Items[0].Name)
+	assert.Len(t, hooks, 1)
+	assert.True(t, hasHookPhase(hooks[0], HookPreInstall))
+	assert.True(t, hasHookPhase(hooks[0], HookPreUpgrade))
+	assert.False(t, hasHookPhase(hooks[0], HookPostInstall))
+	assert.True(t, hasDeletePolicy(hooks[0], HookSucceeded))
+	assert.False(t, hasDeletePolicy(hooks[0], HookFailed))
+
+	invalid, err := manifest.ParseObjects(context.Background(), `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate
+  annotations:
+    addons.k8s.io/hook: pre-rollback
+`)
+	assert.NoError(t, err)
+	_, err = splitHooks(invalid)
+	assert.Error(t, err)
+}
+
+func Test_hookPhasesFor(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]interface{}
+		pre, post   HookPhase
+	}{
+		{
+			name:        "never applied",
+			annotations: map[string]interface{}{},
+			pre:         HookPreInstall,
+			post:        HookPostInstall,
+		},
+		{
+			name:        "applied another manifest",
+			annotations: map[string]interface{}{AppliedHashAnnotation: "old"},
+			pre:         HookPreUpgrade,
+			post:        HookPostUpgrade,
+		},
+		{
+			name:        "applied this manifest",
+			annotations: map[string]interface{}{AppliedHashAnnotation: "new"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := &unstructured.Unstructured{Object: map[string]interface{}{
+				"metadata": map[string]interface{}{"name": "guestbook", "annotations": tt.annotations},
+			}}
+			pre, post := hookPhasesFor(instance, "new")
+			assert.Equal(t, tt.pre, pre)
+			assert.Equal(t, tt.post, post)
+		})
+	}
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+// IgnoreFieldsAnnotation lists fields of a live object that are managed by the user rather than
+// the manifest, separated by commas.  Each field is a dot separated path, where list items are
+// selected by a key, e.g. spec.template.spec.containers[name=app].resources
+const IgnoreFieldsAnnotation = "addons.k8s.io/ignore-fields"
+
+// fieldPathSegment is one step of a field path: a map key, optionally followed by
+// the selection of a list item whose selectKey field is selectValue
+type fieldPathSegment struct {
+	field       string
+	selectKey   string
+	selectValue string
+}
+
+// parseFieldPath parses a path such as spec.template.spec.containers[name=app].resources
+func parseFieldPath(path string) ([]fieldPathSegment, error) {
+	var segments []fieldPathSegment
+	for _, part := range strings.Split(path, ".") {
+		segment := fieldPathSegment{field: part}
+		if i := strings.Index(part, "["); i != -1 {
+			if !strings.HasSuffix(part, "]") {
+				return nil, fmt.Errorf("invalid field path %q: unterminated list selector in %q", path, part)
+			}
+			kv := strings.SplitN(part[i+1:len(part)-1], "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, fmt.Errorf("invalid field path %q: list selector in %q must be [key=value]", path, part)
+			}
+			segment = fieldPathSegment{field: part[:i], selectKey: kv[0], selectValue: kv[1]}
+		}
+		if segment.field == "" {
+			return nil, fmt.Errorf("invalid field path %q: empty field name", path)
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// preserveIgnoredFields returns a copy of obj in which the fields listed in the IgnoreFieldsAnnotation
+// of the live object are replaced with their live values.  Fields that are not set on the live
+// object are removed.  obj is returned unchanged if the live object has no such annotation.
+func preserveIgnoredFields(obj *manifest.Object, live *unstructured.Unstructured) (*manifest.Object, error) {
+	annotation, ok := live.GetAnnotations()[IgnoreFieldsAnnotation]
+	if !ok || strings.TrimSpace(annotation) == "" {
+		return obj, nil
+	}
+
+	u := obj.UnstructuredObject().DeepCopy()
+	for _, path := range strings.Split(annotation, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		segments, err := parseFieldPath(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation on %s %s: %v", IgnoreFieldsAnnotation, obj.Kind, obj.Name, err)
+		}
+
+		value, found := lookupField(live.Object, segments)
+		if found {
+			setField(u.Object, segments, runtime.DeepCopyJSONValue(value))
+		} else {
+			removeField(u.Object, segments)
+		}
+	}
+
+	return manifest.NewObject(u)
+}
+
+// lookupField returns the value at segments in obj
+func lookupField(obj map[string]interface{}, segments []fieldPathSegment) (interface{}, bool) {
+	var current interface{} = obj
+	for _, segment := range segments {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = m[segment.field]
+		if !ok {
+			return nil, false
+		}
+		if segment.selectKey != "" {
+			list, ok := current.([]interface{})
+			if !ok {
+				return nil, false
+			}
+			i := selectListItem(list, segment)
+			if i == -1 {
+				return nil, false
+			}
+			current = list[i]
+		}
+	}
+	return current, true
+}
+
+// setField sets the value at segments in obj, creating any maps and list items that are missing
+func setField(obj map[string]interface{}, segments []fieldPathSegment, value interface{}) {
+	m := obj
+	for i, segment := range segments {
+		last := i == len(segments)-1
+
+		if segment.selectKey == "" {
+			if last {
+				m[segment.field] = value
+				return
+			}
+			next, ok := m[segment.field].(map[string]interface{})
+			if !ok {
+				next = map[string]interface{}{}
+				m[segment.field] = next
+			}
+			m = next
+			continue
+		}
+
+		list, _ := m[segment.field].([]interface{})
+		j := selectListItem(list, segment)
+		if last {
+			if j == -1 {
+				list = append(list, value)
+			} else {
+				list[j] = value
+			}
+			m[segment.field] = list
+			return
+		}
+		var item map[string]interface{}
+		if j == -1 {
+			item = map[string]interface{}{segment.selectKey: segment.selectValue}
+			list = append(list, item)
+			m[segment.field] = list
+		} else if item, _ = list[j].(map[string]interface{}); item == nil {
+			return
+		}
+		m = item
+	}
+}
+
+// removeField removes the value at segments from obj, if present
+func removeField(obj map[string]interface{}, segments []fieldPathSegment) {
+	m := obj
+	for i, segment := range segments {
+		last := i == len(segments)-1
+
+		if segment.selectKey == "" {
+			if last {
+				delete(m, segment.field)
+				return
+			}
+			next, ok := m[segment.field].(map[string]interface{})
+			if !ok {
+				return
+			}
+			m = next
+			continue
+		}
+
+		list, _ := m[segment.field].([]interface{})
+		j := selectListItem(list, segment)
+		if j == -1 {
+			return
+		}
+		if last {
+			m[segment.field] = append(list[:j:j], list[j+1:]...)
+			return
+		}
+		next, ok := list[j].(map[string]interface{})
+		if !ok {
+			return
+		}
+		m = next
+	}
+}
+
+// selectListItem returns the index of the list item selected by segment, or -1
+func selectListItem(list []interface{}, segment fieldPathSegment) int {
+	for i, item := range list {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if fmt.Sprintf("%v", m[segment.selectKey]) == segment.selectValue {
+			return i
+		}
+	}
+	return -1
+}
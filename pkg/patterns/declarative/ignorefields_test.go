@@ -0,0 +1,116 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+func Test_preserveIgnoredFields(t *testing.T) {
+	objects, err := manifest.ParseObjects(context.Background(), `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: frontend
+spec:
+  replicas: 1
+  paused: false
+  template:
+    spec:
+      containers:
+      - name: app
+        image: app:v2
+        resources:
+          requests:
+            cpu: 100m
+      - name: sidecar
+        image: sidecar:v2
+`)
+	if err != nil {
+		t.Fatalf("error parsing manifest: %v", err)
+	}
+
+	live := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata": map[string]interface{}{
+			"name": "frontend",
+			"annotations": map[string]interface{}{
+				IgnoreFieldsAnnotation: "spec.replicas, spec.paused, spec.template.spec.containers[name=app].resources",
+			},
+		},
+		"spec": map[string]interface{}{
+			"replicas": int64(5),
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []interface{}{
+						map[string]interface{}{
+							"name":  "app",
+							"image": "app:v1",
+							"resources": map[string]interface{}{
+								"requests": map[string]interface{}{"cpu": "2"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}}
+
+	obj, err := preserveIgnoredFields(objects.Items[0], live)
+	if err != nil {
+		t.Fatalf("error preserving ignored fields: %v", err)
+	}
+	u := obj.UnstructuredObject()
+
+	replicas, _, _ := unstructured.NestedInt64(u.Object, "spec", "replicas")
+	assert.Equal(t, int64(5), replicas)
+
+	_, found, _ := unstructured.NestedFieldNoCopy(u.Object, "spec", "paused")
+	assert.False(t, found, "fields not set on the live object are removed")
+
+	containers, _, _ := unstructured.NestedSlice(u.Object, "spec", "template", "spec", "containers")
+	assert.Equal(t, 2, len(containers))
+	app := containers[0].(map[string]interface{})
+	assert.Equal(t, "app:v2", app["image"], "other fields of the item are not preserved")
+	cpu, _, _ := unstructured.NestedString(app, "resources", "requests", "cpu")
+	assert.Equal(t, "2", cpu)
+
+	// the original object is not modified
+	replicas, _, _ = unstructured.NestedInt64(objects.Items[0].UnstructuredObject().Object, "spec", "replicas")
+	assert.Equal(t, int64(1), replicas)
+}
+
+func Test_parseFieldPath(t *testing.T) {
+	segments, err := parseFieldPath("spec.containers[name=x].resources")
+	assert.NoError(t, err)
+	assert.Equal(t, []fieldPathSegment{
+		{field: "spec"},
+		{field: "containers", selectKey: "name", selectValue: "x"},
+		{field: "resources"},
+	}, segments)
+
+	for _, invalid := range []string{"spec..replicas", "spec.containers[name]", "spec.containers[name=x", "[name=x]"} {
+		_, err := parseFieldPath(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
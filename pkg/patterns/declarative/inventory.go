@@ -0,0 +1,320 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/applier"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+const (
+	// InventoryOfLabel is set on inventory ConfigMaps to the name of their DeclarativeObject,
+	// shortened as by LabelValue
+	InventoryOfLabel = "addons.k8s.io/inventory-of"
+	// InventoryOfNameAnnotation is set on inventory ConfigMaps to the full name of their DeclarativeObject
+	InventoryOfNameAnnotation = "addons.k8s.io/inventory-of-name"
+	// InventoryOfKindLabel is set on inventory ConfigMaps to the lowercase kind of their DeclarativeObject
+	InventoryOfKindLabel = "addons.k8s.io/inventory-of-kind"
+
+	inventoryObjectsKey = "objects.json"
+)
+
+// inventoryRefs returns references to objects, as recorded in an inventory.  Namespace-scoped
+// objects without a namespace are applied in defaultNamespace, or the default namespace.
+// CustomResourceDefinitions are left out, so that they are never pruned along with all their objects.
+func (r *Reconciler) inventoryRefs(objects *manifest.Objects, defaultNamespace string) (map[ObjectRef]bool, error) {
+	refs, err := r.objectRefs(objects, defaultNamespace)
+	if err != nil {
+		return nil, err
+	}
+	for ref := range refs {
+		if ref.Group == "apiextensions.k8s.io" && ref.Kind == "CustomResourceDefinition" {
+			delete(refs, ref)
+		}
+	}
+	return refs, nil
+}
+
+// objectRefs returns references to objects.  Namespace-scoped objects without a namespace are
+// applied in defaultNamespace, or the default namespace.
+func (r *Reconciler) objectRefs(objects *manifest.Objects, defaultNamespace string) (map[ObjectRef]bool, error) {
+	refs := map[ObjectRef]bool{}
+	for _, obj := range objects.Items {
+		ref := ObjectRef{Group: obj.Group, Kind: obj.Kind, Namespace: obj.Namespace, Name: obj.Name}
+		namespaced, known, err := r.scopeOf(obj, objects)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get mapping for %v: %v", obj.GroupVersionKind(), err)
+		}
+		if known && !namespaced {
+			ref.Namespace = ""
+		} else if known && ref.Namespace == "" {
+			ref.Namespace = defaultNamespace
+			if ref.Namespace == "" {
+				ref.Namespace = metav1.NamespaceDefault
+			}
+		}
+		refs[ref] = true
+	}
+	return refs, nil
+}
+
+// reconcileInventory prunes the objects of the previous inventory of instance that are not in
+// applied, and records applied as the new inventory.  Objects that could not be pruned are kept in
+// the inventory, so that pruning them is retried.  If prune is false, nothing is pruned and the
+// objects of the previous inventory are all kept in it.
+func (r *Reconciler) reconcileInventory(ctx context.Context, instance DeclarativeObject, applied map[ObjectRef]bool, prune bool) error {
+	log := log.Log.WithValues("object", instance.GetNamespace()+"/"+instance.GetName())
+
+	previous, err := r.loadInventory(ctx, instance)
+	if err != nil {
+		return err
+	}
+
+	remaining := map[ObjectRef]bool{}
+	var pruneErr error
+	if prune {
+		var result *applier.ApplyResult
+		result, remaining, pruneErr = r.pruneInventory(ctx, instance, previous, applied)
+		if result != nil {
+			r.recordApplyEvents(instance, result)
+			log.WithValues("pruned", result.Count(applier.OperationPruned)).Info("pruned inventory")
+		}
+	} else {
+		for _, ref := range previous {
+			remaining[ref] = true
+		}
+	}
+
+	inventory := map[ObjectRef]bool{}
+	for ref := range applied {
+		inventory[ref] = true
+	}
+	for ref := range remaining {
+		inventory[ref] = true
+	}
+	if err := r.saveInventory(ctx, instance, inventory); err != nil {
+		return err
+	}
+	return pruneErr
+}
+
+// loadInventory returns the objects last applied for instance, or nil if nothing has been recorded
+func (r *Reconciler) loadInventory(ctx context.Context, instance DeclarativeObject) ([]ObjectRef, error) {
+	name, err := r.inventoryName(instance)
+	if err != nil {
+		return nil, err
+	}
+
+	cm := &corev1.ConfigMap{}
+	if err := r.mgr.GetAPIReader().Get(ctx, name, cm); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error getting inventory: %v", err)
+	}
+
+	// The inventory may only record owner kinds, see recordOwnerKinds
+	data, ok := cm.Data[inventoryObjectsKey]
+	if !ok {
+		return nil, nil
+	}
+	var refs []ObjectRef
+	if err := json.Unmarshal([]byte(data), &refs); err != nil {
+		return nil, fmt.Errorf("error parsing inventory: %v", err)
+	}
+	return refs, nil
+}
+
+// saveInventory records refs as the objects applied for instance, in a ConfigMap owned by instance
+func (r *Reconciler) saveInventory(ctx context.Context, instance DeclarativeObject, refs map[ObjectRef]bool) error {
+	var sorted []ObjectRef
+	for ref := range refs {
+		sorted = append(sorted, ref)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return fmt.Sprintf("%v", sorted[i]) < fmt.Sprintf("%v", sorted[j])
+	})
+	b, err := json.Marshal(sorted)
+	if err != nil {
+		return fmt.Errorf("error building inventory: %v", err)
+	}
+
+	return r.updateInventory(ctx, instance, inventoryObjectsKey, string(b))
+}
+
+// updateInventory sets key of the inventory ConfigMap of instance to value, creating the ConfigMap,
+// owned by instance, if it does not exist.  The other keys are left alone.
+func (r *Reconciler) updateInventory(ctx context.Context, instance DeclarativeObject, key, value string) error {
+	name, err := r.inventoryName(instance)
+	if err != nil {
+		return err
+	}
+	labels, err := r.inventoryLabels(instance)
+	if err != nil {
+		return err
+	}
+
+	cm := &corev1.ConfigMap{}
+	err = r.mgr.GetAPIReader().Get(ctx, name, cm)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error getting inventory: %v", err)
+	}
+	if apierrors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name.Name,
+				Namespace:   name.Namespace,
+				Labels:      labels,
+				Annotations: map[string]string{InventoryOfNameAnnotation: instance.GetName()},
+			},
+			Data: map[string]string{key: value},
+		}
+		if err := controllerutil.SetControllerReference(instance, cm, r.mgr.GetScheme()); err != nil {
+			return fmt.Errorf("error setting owner of inventory: %v", err)
+		}
+		if err := r.client.Create(ctx, cm); err != nil {
+			return fmt.Errorf("error creating inventory: %v", err)
+		}
+		return nil
+	}
+
+	if current, ok := cm.Data[key]; ok && current == value {
+		return nil
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[key] = value
+	if err := r.client.Update(ctx, cm); err != nil {
+		return fmt.Errorf("error updating inventory: %v", err)
+	}
+	return nil
+}
+
+// pruneInventory deletes the objects of the previous inventory that are not in keep.  Objects
+// that have the ignore annotation, or that are now managed by another DeclarativeObject, are
+// left alone.  The objects that could not be deleted are returned, so that they stay in the inventory.
+func (r *Reconciler) pruneInventory(ctx context.Context, instance DeclarativeObject, previous []ObjectRef, keep map[ObjectRef]bool) (*applier.ApplyResult, map[ObjectRef]bool, error) {
+	log := log.Log.WithValues("object", instance.GetNamespace()+"/"+instance.GetName())
+
+	instanceGVK, err := apiutil.GVKForObject(instance, r.mgr.GetScheme())
+	if err != nil {
+		return nil, nil, err
+	}
+	var labels map[string]string
+	if r.options.labelMaker != nil {
+		labels = r.options.labelMaker(ctx, instance)
+	}
+
+	result := &applier.ApplyResult{}
+	remaining := map[ObjectRef]bool{}
+	var errs []string
+	for _, ref := range previous {
+		if keep[ref] {
+			continue
+		}
+
+		mapping, err := r.restMapper.RESTMapping(schema.GroupKind{Group: ref.Group, Kind: ref.Kind})
+		if meta.IsNoMatchError(err) {
+			// The kind no longer exists, and neither do its objects
+			continue
+		}
+		if err != nil {
+			remaining[ref] = true
+			errs = append(errs, fmt.Sprintf("unable to get mapping for %s %s: %v", ref.Kind, ref.Name, err))
+			continue
+		}
+		var resource dynamic.ResourceInterface = r.dynamicClient.Resource(mapping.Resource)
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			resource = r.dynamicClient.Resource(mapping.Resource).Namespace(ref.Namespace)
+		}
+
+		live, err := resource.Get(ctx, ref.Name, metav1.GetOptions{})
+		if err != nil {
+			if !apierrors.IsNotFound(err) {
+				remaining[ref] = true
+				errs = append(errs, fmt.Sprintf("unable to get %s %s: %v", ref.Kind, ref.Name, err))
+			}
+			continue
+		}
+		if _, ok := live.GetAnnotations()["addons.k8s.io/ignore"]; ok {
+			continue
+		}
+		if ownershipOf(live, instance, instanceGVK, labels) == ownedByOther {
+			log.WithValues("kind", ref.Kind).WithValues("namespace", ref.Namespace).WithValues("name", ref.Name).Info("object is managed by another object, not pruning")
+			continue
+		}
+
+		log.WithValues("kind", ref.Kind).WithValues("namespace", ref.Namespace).WithValues("name", ref.Name).Info("pruning object")
+		uid := live.GetUID()
+		propagation := metav1.DeletePropagationBackground
+		err = resource.Delete(ctx, ref.Name, metav1.DeleteOptions{
+			Preconditions:     &metav1.Preconditions{UID: &uid},
+			PropagationPolicy: &propagation,
+		})
+		if err != nil && !apierrors.IsNotFound(err) && !apierrors.IsConflict(err) {
+			remaining[ref] = true
+			errs = append(errs, fmt.Sprintf("unable to delete %s %s: %v", ref.Kind, ref.Name, err))
+			result.Objects = append(result.Objects, applier.ObjectResult{Group: ref.Group, Kind: ref.Kind, Namespace: ref.Namespace, Name: ref.Name, Operation: applier.OperationFailed, Error: err})
+			continue
+		}
+		result.Objects = append(result.Objects, applier.ObjectResult{Group: ref.Group, Kind: ref.Kind, Namespace: ref.Namespace, Name: ref.Name, Operation: applier.OperationPruned})
+	}
+
+	if len(errs) != 0 {
+		return result, remaining, fmt.Errorf("error pruning objects: %s", strings.Join(errs, "; "))
+	}
+	return result, remaining, nil
+}
+
+func (r *Reconciler) inventoryName(instance DeclarativeObject) (types.NamespacedName, error) {
+	gvk, err := apiutil.GVKForObject(instance, r.mgr.GetScheme())
+	if err != nil {
+		return types.NamespacedName{}, err
+	}
+	return types.NamespacedName{
+		Namespace: instance.GetNamespace(),
+		Name:      fmt.Sprintf("%s-%s-inventory", strings.ToLower(gvk.Kind), instance.GetName()),
+	}, nil
+}
+
+func (r *Reconciler) inventoryLabels(instance DeclarativeObject) (map[string]string, error) {
+	gvk, err := apiutil.GVKForObject(instance, r.mgr.GetScheme())
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		InventoryOfLabel:     LabelValue(instance.GetName()),
+		InventoryOfKindLabel: strings.ToLower(gvk.Kind),
+	}, nil
+}
@@ -0,0 +1,299 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	clienttesting "k8s.io/client-go/testing"
+	recorder "k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+// fakeManager is a manager.Manager that only provides a client and a scheme
+type fakeManager struct {
+	manager.Manager
+	client client.Client
+	scheme *runtime.Scheme
+}
+
+func (m *fakeManager) GetClient() client.Client       { return m.client }
+func (m *fakeManager) GetAPIReader() client.Reader    { return m.client }
+func (m *fakeManager) GetScheme() *runtime.Scheme     { return m.scheme }
+func (m *fakeManager) GetRESTMapper() meta.RESTMapper { return nil }
+
+// newTestInstance returns a Guestbook to reconcile, in namespace ns
+func newTestInstance(ns, name string, uid types.UID) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion("addons.example.org/v1alpha1")
+	u.SetKind("Guestbook")
+	u.SetNamespace(ns)
+	u.SetName(name)
+	u.SetUID(uid)
+	return u
+}
+
+// newTestConfigMap returns a ConfigMap as read with a dynamic client
+func newTestConfigMap(ns, name string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion("v1")
+	u.SetKind("ConfigMap")
+	u.SetNamespace(ns)
+	u.SetName(name)
+	u.SetUID(types.UID(ns + "-" + name))
+	return u
+}
+
+// newTestReconciler returns a Reconciler on fake clients holding objects, and the fake dynamic client
+func newTestReconciler(t *testing.T, objects ...runtime.Object) (*Reconciler, *dynamicfake.FakeDynamicClient, client.Client) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, clientgoscheme.AddToScheme(scheme))
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+
+	restMapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{
+		{Version: "v1"}, {Group: "apps", Version: "v1"}, {Group: "rbac.authorization.k8s.io", Version: "v1"},
+	})
+	restMapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	restMapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, meta.RESTScopeNamespace)
+	restMapper.Add(schema.GroupVersionKind{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "ClusterRole"}, meta.RESTScopeRoot)
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Version: "v1", Resource: "configmaps"}:                                       "ConfigMapList",
+		{Group: "apps", Version: "v1", Resource: "deployments"}:                       "DeploymentList",
+		{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterroles"}: "ClusterRoleList",
+	}, objects...)
+
+	r := &Reconciler{
+		client:           c,
+		mgr:              &fakeManager{client: c, scheme: scheme},
+		dynamicClient:    dynamicClient,
+		restMapper:       restMapper,
+		recorder:         recorder.NewFakeRecorder(100),
+		events:           &eventLimiter{},
+		waveBackoff:      &waveBackoff{},
+		crdBackoff:       &waveBackoff{},
+		hookBackoff:      &waveBackoff{},
+		errorBackoff:     &waveBackoff{},
+		appliedManifests: &appliedManifests{},
+		targetClusters:   &targetClusters{},
+		ownerKinds:       &ownerKinds{},
+	}
+	return r, dynamicClient, c
+}
+
+func Test_inventoryRefs(t *testing.T) {
+	restMapper := meta.NewDefaultRESTMapper(nil)
+	restMapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	restMapper.Add(schema.GroupVersionKind{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "ClusterRole"}, meta.RESTScopeRoot)
+	r := &Reconciler{restMapper: restMapper}
+
+	objects, err := manifest.ParseObjects(context.Background(), `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: unqualified
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: qualified
+  namespace: other
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: role
+  namespace: ignored
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.org
+spec:
+  group: example.org
+  names:
+    kind: Widget
+  scope: Namespaced
+  versions:
+  - name: v1
+---
+apiVersion: example.org/v1
+kind: Widget
+metadata:
+  name: widget
+`)
+	assert.NoError(t, err)
+
+	refs, err := r.inventoryRefs(objects, "ns")
+	assert.NoError(t, err)
+	assert.Equal(t, map[ObjectRef]bool{
+		{Kind: "ConfigMap", Namespace: "ns", Name: "unqualified"}:               true,
+		{Kind: "ConfigMap", Namespace: "other", Name: "qualified"}:              true,
+		{Group: "rbac.authorization.k8s.io", Kind: "ClusterRole", Name: "role"}: true,
+		{Group: "example.org", Kind: "Widget", Namespace: "ns", Name: "widget"}: true,
+	}, refs)
+
+	refs, err = r.inventoryRefs(objects, "")
+	assert.NoError(t, err)
+	assert.True(t, refs[ObjectRef{Kind: "ConfigMap", Namespace: "default", Name: "unqualified"}])
+}
+
+func Test_reconcileInventory(t *testing.T) {
+	ctx := context.Background()
+	instance := newTestInstance("ns", "guestbook", "uid-1")
+
+	foreign := newTestConfigMap("ns", "foreign")
+	foreign.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: "addons.example.org/v1alpha1", Kind: "Guestbook", Name: "other", UID: "uid-2"}})
+	ignored := newTestConfigMap("ns", "ignored")
+	ignored.SetAnnotations(map[string]string{"addons.k8s.io/ignore": "true"})
+
+	r, dynamicClient, _ := newTestReconciler(t, newTestConfigMap("ns", "kept"), newTestConfigMap("ns", "removed"), foreign, ignored)
+	ref := func(name string) ObjectRef {
+		return ObjectRef{Kind: "ConfigMap", Namespace: "ns", Name: name}
+	}
+	configMaps := dynamicClient.Resource(schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}).Namespace("ns")
+
+	// The first inventory prunes nothing
+	assert.NoError(t, r.reconcileInventory(ctx, instance, map[ObjectRef]bool{
+		ref("kept"): true, ref("removed"): true, ref("foreign"): true, ref("ignored"): true,
+	}, true))
+
+	// Without pruning, objects leaving the inventory are kept in it
+	assert.NoError(t, r.reconcileInventory(ctx, instance, map[ObjectRef]bool{ref("kept"): true, ref("added"): true}, false))
+	inventory, err := r.loadInventory(ctx, instance)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []ObjectRef{ref("added"), ref("foreign"), ref("ignored"), ref("kept"), ref("removed")}, inventory)
+	_, err = configMaps.Get(ctx, "removed", metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	// Pruning deletes only the objects that are still ours
+	assert.NoError(t, r.reconcileInventory(ctx, instance, map[ObjectRef]bool{ref("kept"): true, ref("added"): true}, true))
+	inventory, err = r.loadInventory(ctx, instance)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []ObjectRef{ref("added"), ref("kept")}, inventory)
+
+	_, err = configMaps.Get(ctx, "removed", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	for _, name := range []string{"kept", "foreign", "ignored"} {
+		_, err = configMaps.Get(ctx, name, metav1.GetOptions{})
+		assert.NoError(t, err, name)
+	}
+}
+
+func Test_selectObjects(t *testing.T) {
+	ctx := context.Background()
+	instance := newTestInstance("ns", "guestbook", "uid-1")
+
+	foreign := newTestConfigMap("ns", "foreign")
+	foreign.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: "addons.example.org/v1alpha1", Kind: "Guestbook", Name: "other", UID: "uid-2"}})
+	ignored := newTestConfigMap("ns", "ignored")
+	ignored.SetAnnotations(map[string]string{"addons.k8s.io/ignore": "true"})
+	owned := newTestConfigMap("ns", "owned")
+	owned.SetLabels(map[string]string{"app": "guestbook"})
+
+	r, _, _ := newTestReconciler(t, newTestConfigMap("ns", "unowned"), foreign, ignored, owned)
+	r.options.adoptionPolicy = AdoptNever
+	r.options.labelMaker = func(context.Context, DeclarativeObject) map[string]string {
+		return map[string]string{"app": "guestbook"}
+	}
+
+	objects, err := manifest.ParseObjects(ctx, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: unowned
+  namespace: ns
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foreign
+  namespace: ns
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ignored
+  namespace: ns
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: owned
+  namespace: ns
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: created
+  namespace: ns
+`)
+	assert.NoError(t, err)
+	inventory, err := r.inventoryRefs(objects, "ns")
+	assert.NoError(t, err)
+
+	conflicts, err := r.selectObjects(ctx, instance, objects, inventory, "ns")
+	assert.NoError(t, err)
+	assert.Equal(t, []ObjectRef{{Kind: "ConfigMap", Namespace: "ns", Name: "foreign"}}, conflicts)
+
+	var names []string
+	for _, obj := range objects.Items {
+		names = append(names, obj.Name)
+	}
+	assert.Equal(t, []string{"owned", "created"}, names)
+	// Skipped objects are neither recorded nor pruned
+	assert.Equal(t, map[ObjectRef]bool{
+		{Kind: "ConfigMap", Namespace: "ns", Name: "owned"}:   true,
+		{Kind: "ConfigMap", Namespace: "ns", Name: "created"}: true,
+	}, inventory)
+}
+
+func Test_selectObjectsGetError(t *testing.T) {
+	ctx := context.Background()
+	instance := newTestInstance("ns", "guestbook", "uid-1")
+
+	r, dynamicClient, _ := newTestReconciler(t)
+	dynamicClient.PrependReactor("get", "configmaps", func(clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, "guestbook", nil)
+	})
+
+	objects, err := manifest.ParseObjects(ctx, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: guestbook
+`)
+	assert.NoError(t, err)
+
+	// Applying over an object that could not be read could overwrite another owner's object
+	_, err = r.selectObjects(ctx, instance, objects, nil, "ns")
+	assert.Error(t, err)
+}
@@ -27,6 +27,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
@@ -48,6 +49,7 @@ const (
 	ReconcileFailure = "reconcile_failure_count"
 
 	ManagedObjectsRecord = "managed_objects_record"
+	DriftedObjectsRecord = "drifted_objects_record"
 )
 
 var metricsRegisterOnce *sync.Once = &sync.Once{}
@@ -70,9 +72,15 @@ var (
 		Name:      ManagedObjectsRecord,
 		Help:      "Track the number of objects in manifest",
 	}, []string{"group_version_kind", "namespace", "name"})
+
+	driftedObjectsRecord = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: Declarative,
+		Name:      DriftedObjectsRecord,
+		Help:      "Track the number of objects that have drifted from the manifest",
+	}, []string{"group_version_kind", "namespace", "name"})
 )
 
-var metricsList = []prometheus.Collector{reconcileCount, reconcileFailure, managedObjectsRecord}
+var metricsList = []prometheus.Collector{reconcileCount, reconcileFailure, managedObjectsRecord, driftedObjectsRecord}
 
 func gvkString(gvk schema.GroupVersionKind) string {
 	if len(gvk.Group) == 0 && gvk.Version == "v1" {
@@ -166,6 +174,8 @@ type ObjectTracker struct {
 	mgr             manager.Manager
 	metricsDuration int
 	trackedGVK      map[schema.GroupVersionKind]*gvkTracker
+	// shard restricts the tracked objects to those applied by the shard, see WithSharding
+	shard *Shard
 }
 
 // GetMetricsDuration method returns current metricsDuration.
@@ -188,6 +198,13 @@ func (ot *ObjectTracker) SetMetricsDuration(metricsDuration int) {
 	ot.metricsDuration = metricsDuration
 }
 
+func (ot *ObjectTracker) setShard(shard *Shard) {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+
+	ot.shard = shard
+}
+
 func (ot *ObjectTracker) setMetricsDurationInternal(i int) {
 	ot.mu.Lock()
 	defer ot.mu.Unlock()
@@ -238,7 +255,7 @@ func (ot *ObjectTracker) addIfNotPresent(objects []*manifest.Object, defaultName
 			continue
 		}
 
-		ot.trackedGVK[gvk] = newGVKTracker(ot.mgr, object.UnstructuredObject(), namespaced)
+		ot.trackedGVK[gvk] = newGVKTracker(ot.mgr, object.UnstructuredObject(), namespaced, ot.shard)
 		ot.trackedGVK[gvk].insert(ns, name)
 
 		// addIfNotPresent is called at Reconcler.reconcileExists,
@@ -341,12 +358,18 @@ func (gvkt *gvkTracker) start(ctx context.Context) {
 	gvkt.src.Start(ctx, gvkt.eventHandler, dummyQueue{}, gvkt.predicate)
 }
 
-func newGVKTracker(mgr manager.Manager, obj *unstructured.Unstructured, namespaced bool) (gvkt *gvkTracker) {
+func newGVKTracker(mgr manager.Manager, obj *unstructured.Unstructured, namespaced bool, shard *Shard) (gvkt *gvkTracker) {
 	gvkt = &gvkTracker{}
 	gvkt.list = newItems()
 	gvkt.recorder = objectRecorderFor(obj.GroupVersionKind())
 	gvkt.src = source.NewKindWithCache(obj, mgr.GetCache())
 	gvkt.predicate = predicate.Funcs{}
+	if shard != nil {
+		labels := shard.Labels()
+		gvkt.predicate = predicate.NewPredicateFuncs(func(o client.Object) bool {
+			return o.GetLabels()[ShardLabel] == labels[ShardLabel]
+		})
+	}
 	gvkt.eventHandler = recordTrigger{gvkt.list, namespaced, gvkt.recorder}
 
 	return
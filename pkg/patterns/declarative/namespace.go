@@ -0,0 +1,186 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+var (
+	serviceAccountKind = schema.GroupKind{Kind: "ServiceAccount"}
+	serviceKind        = schema.GroupKind{Kind: "Service"}
+)
+
+// SetNamespaces returns an ObjectTransform that places the namespace-scoped objects that have no
+// namespace in the namespace of the DeclarativeObject, looking up the scope of each kind in
+// restMapper.  Cluster-scoped objects, and objects of kinds that restMapper does not know yet
+// (e.g. defined by a CustomResourceDefinition in the same manifest), are left alone.
+//
+// References that have no namespace are pointed at the namespace as well: the ServiceAccount
+// subjects of RoleBindings and ClusterRoleBindings, and the services of admission webhooks and
+// CustomResourceDefinition conversion webhooks.  References with a namespace are left alone, unless
+// they refer to an object that was placed in the namespace, in the "default" namespace it would
+// otherwise have been applied in.
+func SetNamespaces(restMapper meta.RESTMapper) ObjectTransform {
+	return func(ctx context.Context, o DeclarativeObject, objects *manifest.Objects) error {
+		log := log.Log
+
+		namespace := o.GetNamespace()
+		if namespace == "" {
+			return nil
+		}
+
+		// placed are the names of the objects placed in namespace, by kind
+		placed := map[schema.GroupKind]map[string]bool{}
+		for _, obj := range objects.Items {
+			if obj.Namespace != "" {
+				continue
+			}
+			gvk := obj.GroupVersionKind()
+			mapping, err := restMapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+			if meta.IsNoMatchError(err) {
+				log.WithValues("kind", obj.Kind).WithValues("name", obj.Name).V(1).Info("unknown kind, not setting namespace")
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("unable to get mapping for %v: %v", gvk, err)
+			}
+			if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+				continue
+			}
+
+			obj.SetNamespace(namespace)
+			if placed[obj.GroupKind()] == nil {
+				placed[obj.GroupKind()] = map[string]bool{}
+			}
+			placed[obj.GroupKind()][obj.Name] = true
+		}
+
+		for _, obj := range objects.Items {
+			var err error
+			switch obj.GroupKind() {
+			case schema.GroupKind{Group: "rbac.authorization.k8s.io", Kind: "RoleBinding"},
+				schema.GroupKind{Group: "rbac.authorization.k8s.io", Kind: "ClusterRoleBinding"}:
+				err = setSubjectNamespaces(obj, namespace, placed[serviceAccountKind])
+			case schema.GroupKind{Group: "admissionregistration.k8s.io", Kind: "ValidatingWebhookConfiguration"},
+				schema.GroupKind{Group: "admissionregistration.k8s.io", Kind: "MutatingWebhookConfiguration"}:
+				err = setWebhookNamespaces(obj, namespace, placed[serviceKind])
+			case schema.GroupKind{Group: "apiextensions.k8s.io", Kind: "CustomResourceDefinition"}:
+				err = setConversionWebhookNamespace(obj, namespace, placed[serviceKind])
+			}
+			if err != nil {
+				return fmt.Errorf("error setting namespace in %s %s: %v", obj.Kind, obj.Name, err)
+			}
+		}
+		return nil
+	}
+}
+
+// pointAtNamespace sets the namespace of the reference ref to namespace if it has no namespace,
+// or refers to one of placed where it was before being placed.  It reports whether ref was changed.
+func pointAtNamespace(ref map[string]interface{}, namespace string, placed map[string]bool) bool {
+	ns, _ := ref["namespace"].(string)
+	name, _ := ref["name"].(string)
+	// Objects are only placed when they have no namespace, so were applied in the default namespace
+	if ns != "" && !(ns == metav1.NamespaceDefault && placed[name]) {
+		return false
+	}
+	ref["namespace"] = namespace
+	return true
+}
+
+// setSubjectNamespaces points the ServiceAccount subjects of a RoleBinding or ClusterRoleBinding at namespace
+func setSubjectNamespaces(obj *manifest.Object, namespace string, placed map[string]bool) error {
+	subjects, found, err := unstructured.NestedSlice(obj.UnstructuredObject().Object, "subjects")
+	if err != nil || !found {
+		return err
+	}
+
+	changed := false
+	for _, s := range subjects {
+		subject, ok := s.(map[string]interface{})
+		if !ok || subject["kind"] != "ServiceAccount" {
+			continue
+		}
+		if pointAtNamespace(subject, namespace, placed) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return obj.SetNestedSlice(subjects, "subjects")
+}
+
+// setWebhookNamespaces points the services of the webhooks of a webhook configuration at namespace
+func setWebhookNamespaces(obj *manifest.Object, namespace string, placed map[string]bool) error {
+	webhooks, found, err := unstructured.NestedSlice(obj.UnstructuredObject().Object, "webhooks")
+	if err != nil || !found {
+		return err
+	}
+
+	changed := false
+	for _, w := range webhooks {
+		webhook, ok := w.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		service, found, err := unstructured.NestedMap(webhook, "clientConfig", "service")
+		if err != nil || !found {
+			continue
+		}
+		if pointAtNamespace(service, namespace, placed) {
+			if err := unstructured.SetNestedMap(webhook, service, "clientConfig", "service"); err != nil {
+				return err
+			}
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return obj.SetNestedSlice(webhooks, "webhooks")
+}
+
+// setConversionWebhookNamespace points the service of the conversion webhook of a
+// CustomResourceDefinition at namespace
+func setConversionWebhookNamespace(obj *manifest.Object, namespace string, placed map[string]bool) error {
+	// apiextensions.k8s.io/v1 and v1beta1 respectively
+	for _, fields := range [][]string{
+		{"spec", "conversion", "webhook", "clientConfig", "service"},
+		{"spec", "conversion", "webhookClientConfig", "service"},
+	} {
+		service, found, err := unstructured.NestedMap(obj.UnstructuredObject().Object, fields...)
+		if err != nil || !found {
+			continue
+		}
+		if pointAtNamespace(service, namespace, placed) {
+			if err := obj.SetNestedField(service, fields...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
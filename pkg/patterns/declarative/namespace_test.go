@@ -0,0 +1,135 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+func Test_SetNamespaces(t *testing.T) {
+	restMapper := meta.NewDefaultRESTMapper(nil)
+	restMapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ServiceAccount"}, meta.RESTScopeNamespace)
+	restMapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Service"}, meta.RESTScopeNamespace)
+	restMapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	restMapper.Add(schema.GroupVersionKind{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "ClusterRoleBinding"}, meta.RESTScopeRoot)
+	restMapper.Add(schema.GroupVersionKind{Group: "admissionregistration.k8s.io", Version: "v1", Kind: "ValidatingWebhookConfiguration"}, meta.RESTScopeRoot)
+
+	objects, err := manifest.ParseObjects(context.Background(), `
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: operator
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: webhook
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: elsewhere
+  namespace: other
+---
+apiVersion: example.org/v1
+kind: Widget
+metadata:
+  name: unknown
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: operator
+subjects:
+- kind: ServiceAccount
+  name: operator
+  namespace: default
+- kind: ServiceAccount
+  name: operator
+  namespace: system
+- kind: ServiceAccount
+  name: external
+  namespace: kube-system
+- kind: ServiceAccount
+  name: unqualified
+- kind: User
+  name: admin
+---
+apiVersion: admissionregistration.k8s.io/v1
+kind: ValidatingWebhookConfiguration
+metadata:
+  name: webhook
+webhooks:
+- name: validate.example.org
+  clientConfig:
+    service:
+      name: webhook
+      namespace: default
+- name: external.example.org
+  clientConfig:
+    service:
+      name: webhook
+      namespace: system
+`)
+	assert.NoError(t, err)
+
+	instance := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "addons", Name: "addon"}}
+	assert.NoError(t, SetNamespaces(restMapper)(context.Background(), instance, objects))
+
+	namespaces := map[string]string{}
+	for _, obj := range objects.Items {
+		assert.Equal(t, obj.Namespace, obj.UnstructuredObject().GetNamespace())
+		namespaces[obj.Kind+"/"+obj.Name] = obj.Namespace
+	}
+	assert.Equal(t, map[string]string{
+		"ServiceAccount/operator":                "addons",
+		"Service/webhook":                        "addons",
+		"ConfigMap/elsewhere":                    "other",
+		"Widget/unknown":                         "",
+		"ClusterRoleBinding/operator":            "",
+		"ValidatingWebhookConfiguration/webhook": "",
+	}, namespaces)
+
+	binding := objects.Items[4].UnstructuredObject().Object
+	subjects, _, _ := unstructured.NestedSlice(binding, "subjects")
+	var subjectNamespaces []interface{}
+	for _, s := range subjects {
+		subjectNamespaces = append(subjectNamespaces, s.(map[string]interface{})["namespace"])
+	}
+	// Explicit namespaces are kept, unless they are the one a placed object had
+	assert.Equal(t, []interface{}{"addons", "system", "kube-system", "addons", nil}, subjectNamespaces)
+
+	webhook := objects.Items[5].UnstructuredObject().Object
+	webhooks, _, _ := unstructured.NestedSlice(webhook, "webhooks")
+	service, _, _ := unstructured.NestedString(webhooks[0].(map[string]interface{}), "clientConfig", "service", "namespace")
+	assert.Equal(t, "addons", service)
+	service, _, _ = unstructured.NestedString(webhooks[1].(map[string]interface{}), "clientConfig", "service", "namespace")
+	assert.Equal(t, "system", service)
+
+	json, err := objects.Items[4].JSON()
+	assert.NoError(t, err)
+	assert.Contains(t, string(json), `"namespace":"addons"`)
+}
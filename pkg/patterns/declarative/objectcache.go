@@ -0,0 +1,143 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// objectCacheSyncTimeout is how long a read waits for the informer of a kind to sync, before
+// reading from the API server instead
+const objectCacheSyncTimeout = 10 * time.Second
+
+var _ manager.Runnable = &objectCache{}
+
+// objectCache serves live objects of selected kinds from shared informers, rather than
+// with a GET per object.  Informers are started the first time a kind is read, and
+// watch the kind in all namespaces.
+type objectCache struct {
+	restMapper meta.RESTMapper
+	kinds      map[schema.GroupKind]bool
+
+	mutex     sync.Mutex
+	factory   dynamicinformer.DynamicSharedInformerFactory
+	informers map[schema.GroupVersionResource]cache.SharedIndexInformer
+	stopCh    chan struct{}
+}
+
+func newObjectCache(client dynamic.Interface, restMapper meta.RESTMapper, kinds []schema.GroupKind) *objectCache {
+	c := &objectCache{
+		restMapper: restMapper,
+		kinds:      map[schema.GroupKind]bool{},
+		factory:    dynamicinformer.NewDynamicSharedInformerFactory(client, 0),
+		informers:  map[schema.GroupVersionResource]cache.SharedIndexInformer{},
+		stopCh:     make(chan struct{}),
+	}
+	for _, gk := range kinds {
+		c.kinds[gk] = true
+	}
+	return c
+}
+
+// Start stops the informers when ctx is done
+func (c *objectCache) Start(ctx context.Context) error {
+	<-ctx.Done()
+	close(c.stopCh)
+	return nil
+}
+
+// NeedLeaderElection is false, as every replica reads from the cache
+func (c *objectCache) NeedLeaderElection() bool {
+	return false
+}
+
+// get returns the live object from the cache.  The second return value is false if the kind
+// is not cached, its informer has not synced or the namespace of a namespaced object is not
+// given, in which case the object must be read from the API server instead.
+func (c *objectCache) get(ctx context.Context, gvk schema.GroupVersionKind, namespace, name string) (*unstructured.Unstructured, bool, error) {
+	if !c.kinds[gvk.GroupKind()] {
+		return nil, false, nil
+	}
+
+	mapping, err := c.restMapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return nil, true, err
+	}
+
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace && namespace == "" {
+		// The namespace the object would be applied in is not known here
+		return nil, false, nil
+	}
+
+	informer, synced := c.informerFor(ctx, mapping.Resource)
+	if !synced {
+		return nil, false, nil
+	}
+
+	key := name
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		key = namespace + "/" + name
+	}
+	item, exists, err := informer.GetIndexer().GetByKey(key)
+	if err != nil {
+		return nil, true, err
+	}
+	if !exists {
+		return nil, true, apierrors.NewNotFound(mapping.Resource.GroupResource(), name)
+	}
+	u, ok := item.(*unstructured.Unstructured)
+	if !ok {
+		return nil, true, fmt.Errorf("unexpected type %T in cache for %v", item, mapping.Resource)
+	}
+	return u.DeepCopy(), true, nil
+}
+
+// informerFor returns the informer for resource, starting it if needed, and whether it has synced
+func (c *objectCache) informerFor(ctx context.Context, resource schema.GroupVersionResource) (cache.SharedIndexInformer, bool) {
+	c.mutex.Lock()
+	informer, ok := c.informers[resource]
+	if !ok {
+		informer = c.factory.ForResource(resource).Informer()
+		c.informers[resource] = informer
+		c.factory.Start(c.stopCh)
+	}
+	c.mutex.Unlock()
+
+	if informer.HasSynced() {
+		return informer, true
+	}
+	ctx, cancel := context.WithTimeout(ctx, objectCacheSyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		log.Log.WithValues("resource", resource).Info("cache has not synced, reading from the API server")
+		return informer, false
+	}
+	return informer, true
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func Test_objectCache(t *testing.T) {
+	configMapGVK := schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+	secretGVK := schema.GroupVersionKind{Version: "v1", Kind: "Secret"}
+
+	restMapper := meta.NewDefaultRESTMapper(nil)
+	restMapper.Add(configMapGVK, meta.RESTScopeNamespace)
+	restMapper.Add(secretGVK, meta.RESTScopeNamespace)
+
+	cm := &unstructured.Unstructured{}
+	cm.SetGroupVersionKind(configMapGVK)
+	cm.SetNamespace("ns1")
+	cm.SetName("config")
+
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Version: "v1", Resource: "configmaps"}: "ConfigMapList",
+		{Version: "v1", Resource: "secrets"}:    "SecretList",
+	}, cm)
+
+	c := newObjectCache(client, restMapper, []schema.GroupKind{configMapGVK.GroupKind()})
+	defer close(c.stopCh)
+	ctx := context.Background()
+
+	live, cached, err := c.get(ctx, configMapGVK, "ns1", "config")
+	assert.NoError(t, err)
+	assert.True(t, cached)
+	assert.Equal(t, "config", live.GetName())
+
+	_, cached, err = c.get(ctx, configMapGVK, "ns2", "config")
+	assert.True(t, cached)
+	assert.True(t, apierrors.IsNotFound(err))
+
+	// The namespace a namespaced object is applied in must be known to look it up
+	_, cached, err = c.get(ctx, configMapGVK, "", "config")
+	assert.NoError(t, err)
+	assert.False(t, cached)
+
+	_, cached, err = c.get(ctx, secretGVK, "ns1", "secret")
+	assert.NoError(t, err)
+	assert.False(t, cached)
+}
@@ -18,8 +18,12 @@ package declarative
 
 import (
 	"context"
+	"time"
 
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/metrics"
 	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
 )
@@ -47,6 +51,26 @@ type reconcilerParams struct {
 	kustomize         bool
 	validate          bool
 	metrics           bool
+	serverSideApply   bool
+	forceConflicts    bool
+	fieldManager      string
+	planApproval      bool
+	applyWaves        bool
+	inventoryPrune    bool
+
+	finalizer            string
+	revisionHistoryLimit int
+	rollbackDeadline     time.Duration
+	driftInterval        time.Duration
+	driftMode            DriftMode
+	cachedKinds          []schema.GroupKind
+	tracerProvider       trace.TracerProvider
+	targetCluster        TargetClusterSelector
+	adoptionPolicy       AdoptionPolicy
+	pruneMaxPercent      int
+	pruneMaxCount        int
+	shard                *Shard
+	skipUnchangedResync  time.Duration
 
 	sink       Sink
 	ownerFn    OwnerSelector
@@ -73,6 +97,11 @@ type ObjectTransform = func(context.Context, DeclarativeObject, *manifest.Object
 // OwnerSelector selects a runtime.Object to be the owner of a given manifest.Object
 type OwnerSelector = func(context.Context, DeclarativeObject, manifest.Object, manifest.Objects) (DeclarativeObject, error)
 
+// TargetClusterSelector returns the Secret holding the kubeconfig of the cluster to deploy the objects
+// of a DeclarativeObject to, or nil to deploy them to the cluster of the DeclarativeObject.  If the
+// namespace of the Secret is empty, the namespace of the DeclarativeObject is used.
+type TargetClusterSelector = func(context.Context, DeclarativeObject) (*types.NamespacedName, error)
+
 // LabelMaker returns a fixed set of labels for a given DeclarativeObject
 type LabelMaker = func(context.Context, DeclarativeObject) map[string]string
 
@@ -173,6 +202,177 @@ func WithApplyValidation() reconcilerOption {
 	}
 }
 
+// WithServerSideApply applies objects with server-side apply, using the manager's
+// rest.Config rather than kubectl. Fields are owned by the field manager set with
+// WithFieldManager, named after the kind of the DeclarativeObject by default. If
+// forceConflicts is true, fields managed by other controllers are taken over instead
+// of failing the apply.
+func WithServerSideApply(forceConflicts bool) reconcilerOption {
+	return func(p reconcilerParams) reconcilerParams {
+		p.serverSideApply = true
+		p.forceConflicts = forceConflicts
+		return p
+	}
+}
+
+// WithFieldManager sets the field manager that owns the fields applied with
+// WithServerSideApply.  It defaults to the lowercased kind of the DeclarativeObject
+// followed by "-controller", e.g. "guestbook-controller".
+func WithFieldManager(name string) reconcilerOption {
+	return func(p reconcilerParams) reconcilerParams {
+		p.fieldManager = name
+		return p
+	}
+}
+
+// WithFinalizer adds the named finalizer to each DeclarativeObject.  When the DeclarativeObject
+// is deleted, the deployed objects are deleted in the reverse of DefaultObjectOrder, and
+// the finalizer is only removed once they are all gone.  This cleans up objects that
+// owner references cannot, such as cluster-scoped objects or objects in other namespaces.
+func WithFinalizer(finalizer string) reconcilerOption {
+	return func(p reconcilerParams) reconcilerParams {
+		p.finalizer = finalizer
+		return p
+	}
+}
+
+// WithPlanApproval stops changes from being applied until they have been approved.  The changes
+// an apply would make are recorded as a Plan in the PlanAnnotation of the DeclarativeObject, and
+// are only applied once ApprovedPlanAnnotation is set to the hash of that plan.
+func WithPlanApproval() reconcilerOption {
+	return func(p reconcilerParams) reconcilerParams {
+		p.planApproval = true
+		return p
+	}
+}
+
+// WithInventoryPrune deletes the objects that are no longer in the manifest.  The objects applied
+// for each DeclarativeObject are recorded in an inventory ConfigMap owned by it, and only the objects
+// that leave the inventory are deleted, so unlike WithApplyPrune the manager only needs permissions
+// for the kinds in the manifest.  Requires a namespaced DeclarativeObject.
+func WithInventoryPrune() reconcilerOption {
+	return func(p reconcilerParams) reconcilerParams {
+		p.inventoryPrune = true
+		return p
+	}
+}
+
+// WithPruneThreshold refuses to prune, with WithApplyPrune or WithInventoryPrune, when more than
+// maxPercent of the objects of a DeclarativeObject, or more than maxCount objects, would be
+// deleted, e.g. because a loader returned an empty or truncated manifest.  A limit of 0 is not
+// checked.  The prune goes ahead once the AllowPruneAnnotation is set to the reported hash.
+func WithPruneThreshold(maxPercent, maxCount int) reconcilerOption {
+	return func(p reconcilerParams) reconcilerParams {
+		p.pruneMaxPercent = maxPercent
+		p.pruneMaxCount = maxCount
+		return p
+	}
+}
+
+// WithApplyWaves applies objects in waves, ordered by the ApplyWaveAnnotation of each object.
+// The next wave is only applied once every object of the previous wave has a kstatus of Current;
+// until then the DeclarativeObject is requeued with an increasing delay.
+func WithApplyWaves() reconcilerOption {
+	return func(p reconcilerParams) reconcilerParams {
+		p.applyWaves = true
+		return p
+	}
+}
+
+// WithRevisionHistory stores each applied manifest as a numbered revision in a Secret owned by
+// the DeclarativeObject, keeping at most limit revisions.  Setting spec.rollbackTo on the
+// DeclarativeObject to the number of a revision applies that revision instead of the manifest.
+func WithRevisionHistory(limit int) reconcilerOption {
+	return func(p reconcilerParams) reconcilerParams {
+		p.revisionHistoryLimit = limit
+		return p
+	}
+}
+
+// WithAutoRollback applies the latest healthy revision instead of the manifest when a new revision
+// fails to apply, or when its objects have a kstatus of Failed or are not all Current within
+// deadline, until the generation of the DeclarativeObject changes.  A revision is healthy once all
+// of its objects have been Current.  Requires WithRevisionHistory.
+func WithAutoRollback(deadline time.Duration) reconcilerOption {
+	return func(p reconcilerParams) reconcilerParams {
+		p.rollbackDeadline = deadline
+		return p
+	}
+}
+
+// WithDriftDetection compares the live objects with the manifest every interval, and reports the
+// objects that have drifted from it in an Event, the drifted_objects_record metric and through the
+// optional Drifted interface of the Status.  With DriftAutoCorrect every DeclarativeObject is also
+// reconciled every interval, which corrects the drift; with DriftReportOnly drift is only reported.
+func WithDriftDetection(interval time.Duration, mode DriftMode) reconcilerOption {
+	return func(p reconcilerParams) reconcilerParams {
+		p.driftInterval = interval
+		p.driftMode = mode
+		return p
+	}
+}
+
+// WithObjectCache reads live objects of the given kinds from shared informers, rather than with a
+// GET for every object on every reconcile.  Each kind is watched in all namespaces from the first
+// time it is read, so the manager needs list and watch permissions for it.  Objects of other kinds
+// are still read from the API server.
+func WithObjectCache(kinds ...schema.GroupKind) reconcilerOption {
+	return func(p reconcilerParams) reconcilerParams {
+		p.cachedKinds = append(p.cachedKinds, kinds...)
+		return p
+	}
+}
+
+// WithTracerProvider traces each reconcile with the given TracerProvider, which determines where
+// the traces are exported to.  By default reconciles are traced with the global TracerProvider.
+func WithTracerProvider(tp trace.TracerProvider) reconcilerOption {
+	return func(p reconcilerParams) reconcilerParams {
+		p.tracerProvider = tp
+		return p
+	}
+}
+
+// WithTargetCluster deploys the objects of each DeclarativeObject to the cluster selected by
+// selector, while the DeclarativeObject and its status stay in the local cluster.  Objects in a
+// remote cluster have no owner references, so it must be used with WithFinalizer to delete them.
+func WithTargetCluster(selector TargetClusterSelector) reconcilerOption {
+	return func(p reconcilerParams) reconcilerParams {
+		p.targetCluster = selector
+		return p
+	}
+}
+
+// WithAdoptionPolicy selects which existing objects in the manifest of a DeclarativeObject are
+// applied.  Objects managed by another DeclarativeObject, going by their owner references and the
+// labels of the LabelMaker, are reported as conflicts, and are not applied unless the policy is
+// AdoptAll.  The default is AdoptUnowned.
+func WithAdoptionPolicy(policy AdoptionPolicy) reconcilerOption {
+	return func(p reconcilerParams) reconcilerParams {
+		p.adoptionPolicy = policy
+		return p
+	}
+}
+
+// WithSharding reconciles only the DeclarativeObjects of shard, so that the DeclarativeObjects
+// of a kind can be spread across replicas of an operator.  Each replica should also filter its
+// watch on DeclarativeObjects with Shard.Predicate and hold the lease of Shard.LeaderElectionID.
+func WithSharding(shard Shard) reconcilerOption {
+	return func(p reconcilerParams) reconcilerParams {
+		p.shard = &shard
+		return p
+	}
+}
+
+// WithSkipUnchanged skips applying the manifest of a DeclarativeObject when neither the manifest
+// nor the generation of the DeclarativeObject have changed since it was last applied, and none of
+// the objects watched by WatchAll have changed.  The manifest is applied at least every resync.
+func WithSkipUnchanged(resync time.Duration) reconcilerOption {
+	return func(p reconcilerParams) reconcilerParams {
+		p.skipUnchangedResync = resync
+		return p
+	}
+}
+
 // WithReconcileMetrics enables metrics of declarative reconciler.
 // If metricsDuration is positive, metrics will be removed from
 // Prometheus registry when metricsDuration times reconciliation
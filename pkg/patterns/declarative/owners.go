@@ -0,0 +1,463 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+const (
+	// OwnerAnnotation records the owner of an object that cannot have an owner reference to it,
+	// as <gvk>/<namespace>/<name>, e.g. because the object is cluster-scoped and the owner is not
+	OwnerAnnotation = "addons.k8s.io/owner"
+	// OwnerUIDLabel is the UID of the owner recorded in OwnerAnnotation
+	OwnerUIDLabel = "addons.k8s.io/owner-uid"
+)
+
+// ownerString formats an owner for the OwnerAnnotation
+func ownerString(gvk schema.GroupVersionKind, namespace, name string) string {
+	return gvkString(gvk) + "/" + namespace + "/" + name
+}
+
+// scopeOf reports whether obj is namespace-scoped.  Kinds that the RESTMapper does not know yet
+// are looked up in the CustomResourceDefinitions in objects.  known is false if the scope is not found.
+func (r *Reconciler) scopeOf(obj *manifest.Object, objects *manifest.Objects) (namespaced bool, known bool, err error) {
+	gvk := obj.GroupVersionKind()
+	mapping, err := r.restMapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err == nil {
+		return mapping.Scope.Name() == meta.RESTScopeNameNamespace, true, nil
+	}
+	if !meta.IsNoMatchError(err) {
+		return false, false, err
+	}
+
+	for _, crd := range objects.Items {
+		if !isCRD(crd) {
+			continue
+		}
+		for _, kind := range crdKinds(crd) {
+			if kind.GroupKind() == gvk.GroupKind() {
+				scope, _, _ := unstructured.NestedString(crd.UnstructuredObject().Object, "spec", "scope")
+				return scope == "Namespaced", true, nil
+			}
+		}
+	}
+	return false, false, nil
+}
+
+// canOwn reports whether owner may be set as the owner reference of obj.  Owner references
+// can only refer to an owner in the same namespace, or to a cluster-scoped owner; otherwise the
+// garbage collector deletes the object.  defaultNamespace is the namespace obj is applied in if
+// it has none.  If ok is false, reason says why.
+func (r *Reconciler) canOwn(owner DeclarativeObject, ownerGVK schema.GroupVersionKind, obj *manifest.Object, objects *manifest.Objects, defaultNamespace string) (ok bool, reason string, err error) {
+	mapping, err := r.restMapper.RESTMapping(ownerGVK.GroupKind(), ownerGVK.Version)
+	if err != nil {
+		return false, "", fmt.Errorf("unable to get mapping for owner %v: %v", ownerGVK, err)
+	}
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		return true, "", nil
+	}
+
+	namespaced, known, err := r.scopeOf(obj, objects)
+	if err != nil {
+		return false, "", fmt.Errorf("unable to get mapping for %v: %v", obj.GroupVersionKind(), err)
+	}
+	if !known {
+		return false, "the scope of the kind is unknown", nil
+	}
+	if !namespaced {
+		return false, "the object is cluster-scoped but the owner is not", nil
+	}
+
+	ns := obj.Namespace
+	if ns == "" {
+		ns = defaultNamespace
+	}
+	if ns != owner.GetNamespace() {
+		return false, fmt.Sprintf("the object is in namespace %q but the owner is in %q", ns, owner.GetNamespace()), nil
+	}
+	return true, "", nil
+}
+
+// setOwnerAnnotation records owner on obj with the OwnerAnnotation and OwnerUIDLabel, instead of
+// an owner reference
+func setOwnerAnnotation(obj *manifest.Object, owner DeclarativeObject, ownerGVK schema.GroupVersionKind) error {
+	annotations, _, err := unstructured.NestedStringMap(obj.UnstructuredObject().Object, "metadata", "annotations")
+	if err != nil {
+		return err
+	}
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[OwnerAnnotation] = ownerString(ownerGVK, owner.GetNamespace(), owner.GetName())
+	if err := obj.SetNestedStringMap(annotations, "metadata", "annotations"); err != nil {
+		return err
+	}
+	obj.AddLabels(map[string]string{OwnerUIDLabel: string(owner.GetUID())})
+	return nil
+}
+
+// ownerKindsKey is the key of the inventory ConfigMap that records the kinds of the objects given
+// the OwnerAnnotation, see recordOwnerKinds
+const ownerKindsKey = "owner-kinds.json"
+
+// ownerKinds are the kinds of the objects that have been given the OwnerAnnotation, so that only
+// those kinds are listed to find the objects of deleted owners
+type ownerKinds struct {
+	mutex sync.Mutex
+	kinds map[schema.GroupKind]bool
+}
+
+// add records kinds
+func (k *ownerKinds) add(kinds []schema.GroupKind) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if k.kinds == nil {
+		k.kinds = map[schema.GroupKind]bool{}
+	}
+	for _, kind := range kinds {
+		k.kinds[kind] = true
+	}
+}
+
+// list returns the recorded kinds, sorted
+func (k *ownerKinds) list() []schema.GroupKind {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	var kinds []schema.GroupKind
+	for kind := range k.kinds {
+		kinds = append(kinds, kind)
+	}
+	sortKinds(kinds)
+	return kinds
+}
+
+func sortKinds(kinds []schema.GroupKind) {
+	sort.Slice(kinds, func(i, j int) bool {
+		return kinds[i].String() < kinds[j].String()
+	})
+}
+
+// annotatedKinds returns the kinds of the objects that have the OwnerAnnotation
+func annotatedKinds(objects *manifest.Objects) []schema.GroupKind {
+	seen := map[schema.GroupKind]bool{}
+	var kinds []schema.GroupKind
+	for _, obj := range objects.Items {
+		if _, ok := obj.UnstructuredObject().GetAnnotations()[OwnerAnnotation]; !ok {
+			continue
+		}
+		kind := obj.GroupKind()
+		if !seen[kind] {
+			seen[kind] = true
+			kinds = append(kinds, kind)
+		}
+	}
+	sortKinds(kinds)
+	return kinds
+}
+
+// parseOwnerKinds parses the kinds recorded under the ownerKindsKey of an inventory
+func parseOwnerKinds(data map[string]string) ([]schema.GroupKind, error) {
+	s, ok := data[ownerKindsKey]
+	if !ok {
+		return nil, nil
+	}
+	var names []string
+	if err := json.Unmarshal([]byte(s), &names); err != nil {
+		return nil, fmt.Errorf("error parsing owner kinds: %v", err)
+	}
+	var kinds []schema.GroupKind
+	for _, name := range names {
+		kinds = append(kinds, schema.ParseGroupKind(name))
+	}
+	return kinds, nil
+}
+
+// recordOwnerKinds records kinds, the kinds of the objects of instance given the OwnerAnnotation, in
+// its inventory.  The inventory is owned by instance, so it may be gone by the time instance is
+// found to be deleted; the kinds are also kept in memory, and the inventories of the other
+// DeclarativeObjects are read when the operator starts, see collectOrphans.  Kinds recorded before
+// are kept, as their objects may not have been deleted.
+func (r *Reconciler) recordOwnerKinds(ctx context.Context, instance DeclarativeObject, kinds []schema.GroupKind) error {
+	if len(kinds) == 0 {
+		return nil
+	}
+	r.ownerKinds.add(kinds)
+
+	name, err := r.inventoryName(instance)
+	if err != nil {
+		return err
+	}
+	cm := &corev1.ConfigMap{}
+	if err := r.mgr.GetAPIReader().Get(ctx, name, cm); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error getting inventory: %v", err)
+	}
+	recorded, err := parseOwnerKinds(cm.Data)
+	if err != nil {
+		return err
+	}
+
+	merged := map[schema.GroupKind]bool{}
+	for _, kind := range recorded {
+		merged[kind] = true
+	}
+	for _, kind := range kinds {
+		merged[kind] = true
+	}
+	if len(merged) == len(recorded) {
+		return nil
+	}
+	var names []string
+	for kind := range merged {
+		names = append(names, kind.String())
+	}
+	sort.Strings(names)
+	b, err := json.Marshal(names)
+	if err != nil {
+		return fmt.Errorf("error building owner kinds: %v", err)
+	}
+	return r.updateInventory(ctx, instance, ownerKindsKey, string(b))
+}
+
+// loadOwnerKinds returns the kinds recorded in the inventory of the DeclarativeObject name, or nil if
+// there is no inventory
+func (r *Reconciler) loadOwnerKinds(ctx context.Context, name types.NamespacedName) ([]schema.GroupKind, error) {
+	instance := r.prototype.DeepCopyObject().(DeclarativeObject)
+	instance.SetNamespace(name.Namespace)
+	instance.SetName(name.Name)
+	inventoryName, err := r.inventoryName(instance)
+	if err != nil {
+		return nil, err
+	}
+
+	cm := &corev1.ConfigMap{}
+	if err := r.mgr.GetAPIReader().Get(ctx, inventoryName, cm); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error getting inventory: %v", err)
+	}
+	return parseOwnerKinds(cm.Data)
+}
+
+// listOwnerKinds returns the kinds recorded in the inventories of every DeclarativeObject of the
+// reconciled kind
+func (r *Reconciler) listOwnerKinds(ctx context.Context) ([]schema.GroupKind, error) {
+	gvk, err := apiutil.GVKForObject(r.prototype, r.mgr.GetScheme())
+	if err != nil {
+		return nil, err
+	}
+
+	inventories := &corev1.ConfigMapList{}
+	if err := r.mgr.GetAPIReader().List(ctx, inventories, client.MatchingLabels{InventoryOfKindLabel: strings.ToLower(gvk.Kind)}); err != nil {
+		return nil, fmt.Errorf("error listing inventories: %v", err)
+	}
+	var kinds []schema.GroupKind
+	for _, cm := range inventories.Items {
+		recorded, err := parseOwnerKinds(cm.Data)
+		if err != nil {
+			return nil, fmt.Errorf("inventory %s/%s: %v", cm.Namespace, cm.Name, err)
+		}
+		kinds = append(kinds, recorded...)
+	}
+	return kinds, nil
+}
+
+// annotatedObject is an object that records its owner with the OwnerAnnotation
+type annotatedObject struct {
+	resource schema.GroupVersionResource
+	object   unstructured.Unstructured
+}
+
+// listAnnotated lists the objects of kinds that record their owner with the OwnerAnnotation, from
+// the cluster, so that objects are found even if they were applied before a restart.  Kinds that
+// no longer exist, or that the manager may not list, are skipped; kinds that cannot be listed for
+// other reasons are reported in the error, along with the objects that could be.
+func (r *Reconciler) listAnnotated(ctx context.Context, kinds []schema.GroupKind) ([]annotatedObject, error) {
+	log := log.Log
+
+	var objects []annotatedObject
+	var errs []error
+	for _, kind := range kinds {
+		mapping, err := r.restMapper.RESTMapping(kind)
+		if err != nil {
+			if !meta.IsNoMatchError(err) {
+				errs = append(errs, fmt.Errorf("unable to get mapping for %v: %v", kind, err))
+			}
+			continue
+		}
+		list, err := r.dynamicClient.Resource(mapping.Resource).List(ctx, metav1.ListOptions{LabelSelector: OwnerUIDLabel})
+		if err != nil {
+			if apierrors.IsForbidden(err) {
+				log.WithValues("kind", kind.String()).Info("not allowed to list objects with owner annotations, skipping kind")
+			} else if !apierrors.IsNotFound(err) && !apierrors.IsMethodNotSupported(err) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		for _, item := range list.Items {
+			if _, ok := item.GetAnnotations()[OwnerAnnotation]; ok {
+				objects = append(objects, annotatedObject{resource: mapping.Resource, object: item})
+			}
+		}
+	}
+
+	if len(errs) != 0 {
+		return objects, fmt.Errorf("error listing objects with owner annotations: %v", errs)
+	}
+	return objects, nil
+}
+
+// deleteAnnotated deletes the objects that recorded owner as their owner with the OwnerAnnotation.
+// Objects that have been recreated in the meantime are left alone.
+func (r *Reconciler) deleteAnnotated(ctx context.Context, objects []annotatedObject, owner string) []error {
+	log := log.Log.WithValues("owner", owner)
+
+	var errs []error
+	for _, obj := range objects {
+		if obj.object.GetAnnotations()[OwnerAnnotation] != owner {
+			continue
+		}
+		log.WithValues("kind", obj.object.GetKind()).WithValues("namespace", obj.object.GetNamespace()).WithValues("name", obj.object.GetName()).Info("deleting object of deleted owner")
+		uid := obj.object.GetUID()
+		err := r.dynamicClient.Resource(obj.resource).Namespace(obj.object.GetNamespace()).Delete(ctx, obj.object.GetName(),
+			metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &uid}})
+		if err != nil && !apierrors.IsNotFound(err) && !apierrors.IsConflict(err) {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// deleteOwned deletes the objects that recorded the DeclarativeObject name as their owner with the
+// OwnerAnnotation, now that it is gone.  Objects that have since been given another owner are left
+// alone.  Only the kinds recorded by recordOwnerKinds are listed, so nothing is listed if no object
+// was ever given the OwnerAnnotation.
+func (r *Reconciler) deleteOwned(ctx context.Context, name types.NamespacedName) error {
+	log := log.Log
+	if r.options.ownerFn == nil {
+		return nil
+	}
+
+	gvk, err := apiutil.GVKForObject(r.prototype, r.mgr.GetScheme())
+	if err != nil {
+		return err
+	}
+
+	// The inventory is deleted along with the DeclarativeObject, but may still be there
+	recorded, err := r.loadOwnerKinds(ctx, name)
+	if err != nil {
+		log.WithValues("object", name.String()).Error(err, "reading owner kinds from inventory")
+	}
+	r.ownerKinds.add(recorded)
+	kinds := r.ownerKinds.list()
+	if len(kinds) == 0 {
+		return nil
+	}
+
+	objects, err := r.listAnnotated(ctx, kinds)
+	var errs []error
+	if err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, r.deleteAnnotated(ctx, objects, ownerString(gvk, name.Namespace, name.Name))...)
+	if len(errs) != 0 {
+		return fmt.Errorf("error deleting objects of %s: %v", name, errs)
+	}
+	return nil
+}
+
+// collectOrphans deletes the objects whose owners recorded with the OwnerAnnotation were deleted
+// while the operator was not running, so that no delete event was seen for them.  It runs once
+// when the manager starts, listing the kinds recorded in the inventories of the remaining
+// DeclarativeObjects.
+func (r *Reconciler) collectOrphans(ctx context.Context) error {
+	log := log.Log
+
+	gvk, err := apiutil.GVKForObject(r.prototype, r.mgr.GetScheme())
+	if err != nil {
+		return err
+	}
+	prefix := gvkString(gvk) + "/"
+
+	recorded, err := r.listOwnerKinds(ctx)
+	if err != nil {
+		// Not fatal: the objects of owners deleted from now on are still deleted
+		log.Error(err, "reading owner kinds from inventories")
+	}
+	r.ownerKinds.add(recorded)
+	kinds := r.ownerKinds.list()
+	if len(kinds) == 0 {
+		return nil
+	}
+
+	objects, err := r.listAnnotated(ctx, kinds)
+	if err != nil {
+		log.Error(err, "listing objects of deleted owners")
+	}
+
+	owners := map[types.NamespacedName]bool{}
+	for _, obj := range objects {
+		owner := obj.object.GetAnnotations()[OwnerAnnotation]
+		if !strings.HasPrefix(owner, prefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(owner, prefix), "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		owners[types.NamespacedName{Namespace: parts[0], Name: parts[1]}] = true
+	}
+
+	for name := range owners {
+		if !r.owns(&metav1.ObjectMeta{Namespace: name.Namespace, Name: name.Name}) {
+			continue
+		}
+		instance := r.prototype.DeepCopyObject().(DeclarativeObject)
+		err := r.mgr.GetAPIReader().Get(ctx, name, instance)
+		if err == nil {
+			continue
+		}
+		if !apierrors.IsNotFound(err) {
+			log.WithValues("owner", name.String()).Error(err, "checking owner of annotated objects")
+			continue
+		}
+		if errs := r.deleteAnnotated(ctx, objects, ownerString(gvk, name.Namespace, name.Name)); len(errs) != 0 {
+			log.WithValues("owner", name.String()).Error(fmt.Errorf("%v", errs), "deleting objects of deleted owner")
+		}
+	}
+	return nil
+}
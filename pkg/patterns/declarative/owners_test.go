@@ -0,0 +1,252 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	clienttesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+func Test_canOwn(t *testing.T) {
+	ownerGVK := schema.GroupVersionKind{Group: "addons.example.org", Version: "v1", Kind: "Addon"}
+	clusterOwnerGVK := schema.GroupVersionKind{Group: "addons.example.org", Version: "v1", Kind: "ClusterAddon"}
+
+	restMapper := meta.NewDefaultRESTMapper(nil)
+	restMapper.Add(ownerGVK, meta.RESTScopeNamespace)
+	restMapper.Add(clusterOwnerGVK, meta.RESTScopeRoot)
+	restMapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	restMapper.Add(schema.GroupVersionKind{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "ClusterRole"}, meta.RESTScopeRoot)
+	r := &Reconciler{restMapper: restMapper}
+
+	objects, err := manifest.ParseObjects(context.Background(), `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: same
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other
+  namespace: other
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: role
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.org
+spec:
+  group: example.org
+  names:
+    kind: Widget
+  scope: Cluster
+  versions:
+  - name: v1
+---
+apiVersion: example.org/v1
+kind: Widget
+metadata:
+  name: widget
+---
+apiVersion: example.org/v1
+kind: Gadget
+metadata:
+  name: gadget
+`)
+	assert.NoError(t, err)
+
+	owner := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "addon"}}
+	var owned []bool
+	var reasons []string
+	for _, obj := range objects.Items {
+		if isCRD(obj) {
+			continue
+		}
+		ok, reason, err := r.canOwn(owner, ownerGVK, obj, objects, "ns")
+		assert.NoError(t, err)
+		owned = append(owned, ok)
+		reasons = append(reasons, reason)
+
+		ok, _, err = r.canOwn(owner, clusterOwnerGVK, obj, objects, "ns")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+	assert.Equal(t, []bool{true, false, false, false, false}, owned)
+	assert.Equal(t, []string{
+		"",
+		`the object is in namespace "other" but the owner is in "ns"`,
+		"the object is cluster-scoped but the owner is not",
+		"the object is cluster-scoped but the owner is not",
+		"the scope of the kind is unknown",
+	}, reasons)
+}
+
+func Test_setOwnerAnnotation(t *testing.T) {
+	objects, err := manifest.ParseObjects(context.Background(), `
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: role
+  annotations:
+    existing: value
+`)
+	assert.NoError(t, err)
+	obj := objects.Items[0]
+
+	owner := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "addon", UID: types.UID("1234")}}
+	ownerGVK := schema.GroupVersionKind{Group: "addons.example.org", Version: "v1", Kind: "Addon"}
+	assert.NoError(t, setOwnerAnnotation(obj, owner, ownerGVK))
+
+	assert.Equal(t, map[string]string{
+		"existing":      "value",
+		OwnerAnnotation: "addons.example.org/v1/Addon/ns/addon",
+	}, obj.UnstructuredObject().GetAnnotations())
+	assert.Equal(t, "1234", obj.UnstructuredObject().GetLabels()[OwnerUIDLabel])
+}
+
+// newTestClusterRole returns a ClusterRole recording owner with the OwnerAnnotation
+func newTestClusterRole(name, owner string, ownerUID types.UID) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion("rbac.authorization.k8s.io/v1")
+	u.SetKind("ClusterRole")
+	u.SetName(name)
+	u.SetUID(types.UID(name))
+	u.SetAnnotations(map[string]string{OwnerAnnotation: owner})
+	u.SetLabels(map[string]string{OwnerUIDLabel: string(ownerUID)})
+	return u
+}
+
+// clusterRoleKind is the kind of the objects of newTestClusterRole
+var clusterRoleKind = schema.GroupKind{Group: "rbac.authorization.k8s.io", Kind: "ClusterRole"}
+
+func Test_recordOwnerKinds(t *testing.T) {
+	ctx := context.Background()
+	r, _, c := newTestReconciler(t)
+	r.prototype = newTestInstance("", "", "")
+	instance := newTestInstance("ns", "guestbook", "uid-1")
+	assert.NoError(t, c.Create(ctx, instance))
+	configMapKind := schema.GroupKind{Kind: "ConfigMap"}
+
+	// Nothing is recorded without annotated objects
+	assert.NoError(t, r.recordOwnerKinds(ctx, instance, nil))
+	cm := &corev1.ConfigMap{}
+	assert.True(t, apierrors.IsNotFound(c.Get(ctx, client.ObjectKey{Namespace: "ns", Name: "guestbook-guestbook-inventory"}, cm)))
+
+	assert.NoError(t, r.recordOwnerKinds(ctx, instance, []schema.GroupKind{clusterRoleKind}))
+	assert.NoError(t, r.saveInventory(ctx, instance, map[ObjectRef]bool{{Kind: "ConfigMap", Namespace: "ns", Name: "config"}: true}))
+	// Kinds recorded before are kept
+	assert.NoError(t, r.recordOwnerKinds(ctx, instance, []schema.GroupKind{configMapKind}))
+
+	kinds, err := r.loadOwnerKinds(ctx, types.NamespacedName{Namespace: "ns", Name: "guestbook"})
+	assert.NoError(t, err)
+	assert.Equal(t, []schema.GroupKind{clusterRoleKind, configMapKind}, kinds)
+	assert.Equal(t, []schema.GroupKind{clusterRoleKind, configMapKind}, r.ownerKinds.list())
+	refs, err := r.loadInventory(ctx, instance)
+	assert.NoError(t, err)
+	assert.Equal(t, []ObjectRef{{Kind: "ConfigMap", Namespace: "ns", Name: "config"}}, refs)
+}
+
+func Test_deleteOwned(t *testing.T) {
+	ctx := context.Background()
+	clusterRoles := schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterroles"}
+
+	// The objects were applied before a restart, so only the cluster knows about them
+	r, dynamicClient, c := newTestReconciler(t,
+		newTestClusterRole("mine", "addons.example.org/v1alpha1/Guestbook/ns/guestbook", "1"),
+		newTestClusterRole("other", "addons.example.org/v1alpha1/Guestbook/ns/other", "2"),
+	)
+	r.prototype = newTestInstance("", "", "")
+	r.options.ownerFn = SourceAsOwner
+
+	// Nothing is listed unless some object was given the OwnerAnnotation
+	assert.NoError(t, r.deleteOwned(ctx, types.NamespacedName{Namespace: "ns", Name: "guestbook"}))
+	assert.Empty(t, dynamicClient.Actions())
+
+	// The kinds are recorded in the inventory, which has not been garbage collected yet
+	instance := newTestInstance("ns", "guestbook", "1")
+	assert.NoError(t, c.Create(ctx, instance))
+	assert.NoError(t, r.recordOwnerKinds(ctx, instance, []schema.GroupKind{clusterRoleKind}))
+	r.ownerKinds = &ownerKinds{}
+
+	assert.NoError(t, r.deleteOwned(ctx, types.NamespacedName{Namespace: "ns", Name: "guestbook"}))
+
+	_, err := dynamicClient.Resource(clusterRoles).Get(ctx, "mine", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	_, err = dynamicClient.Resource(clusterRoles).Get(ctx, "other", metav1.GetOptions{})
+	assert.NoError(t, err)
+}
+
+func Test_deleteOwnedForbidden(t *testing.T) {
+	ctx := context.Background()
+	r, dynamicClient, _ := newTestReconciler(t,
+		newTestClusterRole("mine", "addons.example.org/v1alpha1/Guestbook/ns/guestbook", "1"),
+	)
+	r.prototype = newTestInstance("", "", "")
+	r.options.ownerFn = SourceAsOwner
+	r.ownerKinds.add([]schema.GroupKind{clusterRoleKind, {Group: "example.org", Kind: "Unknown"}})
+	dynamicClient.PrependReactor("list", "clusterroles", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Group: "rbac.authorization.k8s.io", Resource: "clusterroles"}, "", errors.New("not allowed"))
+	})
+
+	// Kinds that may not be listed, or no longer exist, have no objects to delete
+	assert.NoError(t, r.deleteOwned(ctx, types.NamespacedName{Namespace: "ns", Name: "guestbook"}))
+}
+
+func Test_collectOrphans(t *testing.T) {
+	ctx := context.Background()
+	clusterRoles := schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterroles"}
+
+	r, dynamicClient, c := newTestReconciler(t,
+		newTestClusterRole("orphan", "addons.example.org/v1alpha1/Guestbook/ns/deleted", "1"),
+		newTestClusterRole("owned", "addons.example.org/v1alpha1/Guestbook/ns/guestbook", "2"),
+	)
+	r.prototype = newTestInstance("", "", "")
+	instance := newTestInstance("ns", "guestbook", "2")
+	assert.NoError(t, c.Create(ctx, instance))
+
+	// Nothing is listed unless some object was given the OwnerAnnotation
+	assert.NoError(t, r.collectOrphans(ctx))
+	assert.Empty(t, dynamicClient.Actions())
+
+	// The kinds are read from the inventories of the remaining instances after a restart
+	assert.NoError(t, r.recordOwnerKinds(ctx, instance, []schema.GroupKind{clusterRoleKind}))
+	r.ownerKinds = &ownerKinds{}
+	assert.NoError(t, r.collectOrphans(ctx))
+
+	_, err := dynamicClient.Resource(clusterRoles).Get(ctx, "orphan", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	_, err = dynamicClient.Resource(clusterRoles).Get(ctx, "owned", metav1.GetOptions{})
+	assert.NoError(t, err)
+}
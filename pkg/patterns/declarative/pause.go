@@ -0,0 +1,45 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// PausedAnnotation suspends reconciliation of a DeclarativeObject when set to "true"
+const PausedAnnotation = "addons.k8s.io/paused"
+
+// IsPaused reports whether reconciliation of instance has been suspended, either by
+// PausedAnnotation or by a spec.paused field set to true.
+func IsPaused(instance DeclarativeObject) (bool, error) {
+	if instance.GetAnnotations()[PausedAnnotation] == "true" {
+		return true, nil
+	}
+
+	u, err := asUnstructured(instance)
+	if err != nil {
+		return false, err
+	}
+
+	paused, _, err := unstructured.NestedBool(u.Object, "spec", "paused")
+	if err != nil {
+		return false, fmt.Errorf("unable to read spec.paused: %v", err)
+	}
+	return paused, nil
+}
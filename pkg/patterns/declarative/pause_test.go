@@ -0,0 +1,98 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsPaused(t *testing.T) {
+	tests := []struct {
+		name   string
+		object map[string]interface{}
+		want   bool
+	}{
+		{
+			name: "not paused",
+			object: map[string]interface{}{
+				"metadata": map[string]interface{}{"name": "guestbook"},
+				"spec":     map[string]interface{}{"channel": "stable"},
+			},
+			want: false,
+		},
+		{
+			name: "paused by annotation",
+			object: map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"name":        "guestbook",
+					"annotations": map[string]interface{}{PausedAnnotation: "true"},
+				},
+			},
+			want: true,
+		},
+		{
+			name: "paused by spec",
+			object: map[string]interface{}{
+				"metadata": map[string]interface{}{"name": "guestbook"},
+				"spec":     map[string]interface{}{"paused": true},
+			},
+			want: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paused, err := IsPaused(&unstructured.Unstructured{Object: tt.object})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, paused)
+		})
+	}
+}
+
+// pausedRecorder is a Paused that records what it is told
+type pausedRecorder struct {
+	paused []bool
+}
+
+func (p *pausedRecorder) Paused(_ context.Context, _ DeclarativeObject, paused bool) error {
+	p.paused = append(p.paused, paused)
+	return nil
+}
+
+func Test_reconcileInstancePaused(t *testing.T) {
+	ctx := context.Background()
+	r, _, _ := newTestReconciler(t)
+	status := &pausedRecorder{}
+	r.options.status = &StatusBuilder{PausedImpl: status}
+
+	instance := newTestInstance("ns", "guestbook", "uid-1")
+	instance.SetAnnotations(map[string]string{PausedAnnotation: "true"})
+	result, err := r.reconcileInstance(ctx, types.NamespacedName{Namespace: "ns", Name: "guestbook"}, instance)
+	assert.NoError(t, err)
+	assert.Equal(t, reconcile.Result{}, result)
+
+	// The skipped reconcile is reported in the status and an Event
+	assert.Equal(t, []bool{true}, status.paused)
+	assert.Equal(t, "Normal Paused Reconciliation is paused by the addons.k8s.io/paused annotation or spec.paused", nextEvent(r))
+}
@@ -1,58 +1,347 @@
 package applier
 
 import (
+	"bytes"
 	"context"
-	"os"
-	"strings"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
 
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
 	"k8s.io/cli-runtime/pkg/printers"
 	"k8s.io/cli-runtime/pkg/resource"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 	"k8s.io/kubectl/pkg/cmd/apply"
-	cmdDelete "k8s.io/kubectl/pkg/cmd/delete"
 	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
 )
 
+// DirectApplier applies manifests in-process using the kubectl apply library code,
+// so it behaves like ExecKubectl without needing a kubectl binary.
 type DirectApplier struct {
-	a apply.ApplyOptions
+	config     *rest.Config
+	restMapper meta.RESTMapper
 }
 
+// NewDirectApplier creates a DirectApplier that talks to the cluster configured
+// by the kubeconfig in the environment, in the same way kubectl would.
+//
+// Deprecated: use NewDirectApplierForConfig to target a specific cluster.
 func NewDirectApplier() *DirectApplier {
 	return &DirectApplier{}
 }
 
-func (d *DirectApplier) Apply(ctx context.Context,
-	namespace string,
-	manifest string,
-	validate bool,
-	extraArgs ...string,
-) error {
+// NewDirectApplierForConfig creates a DirectApplier that talks to the cluster described by config.
+// If restMapper is nil, one is built from discovery on every Apply.
+func NewDirectApplierForConfig(config *rest.Config, restMapper meta.RESTMapper) *DirectApplier {
+	return &DirectApplier{config: config, restMapper: restMapper}
+}
+
+var _ Applier = &DirectApplier{}
+
+// Apply runs kubectl apply in-process with the provided objects, recording the operation
+// kubectl performs on each object, or the error applying it.  Requests to the API server are
+// cancelled when ctx is done.
+func (d *DirectApplier) Apply(ctx context.Context, objects *manifest.Objects, options ApplyOptions) (*ApplyResult, error) {
+	log := log.Log
+
+	result := &ApplyResult{}
+
+	// kubectl output is logged rather than written to the output of the operator
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
 	ioStreams := genericclioptions.IOStreams{
-		In:     os.Stdin,
-		Out:    os.Stdout,
-		ErrOut: os.Stderr,
+		In:     &bytes.Buffer{},
+		Out:    &stdout,
+		ErrOut: &stderr,
 	}
-	restClient := genericclioptions.NewConfigFlags(true).WithDeprecatedPasswordFlag()
-	ioReader := strings.NewReader(manifest)
 
-	b := resource.NewBuilder(restClient)
-	res := b.Unstructured().Stream(ioReader, "manifestString").Do()
-	infos, err := res.Infos()
+	if err := d.apply(ctx, objects, options, ioStreams, result); err != nil {
+		log.WithValues("stdout", stdout.String()).WithValues("stderr", stderr.String()).Error(err, "error from applying manifest")
+		return result, err
+	}
+
+	log.WithValues("stdout", stdout.String()).WithValues("stderr", stderr.String()).V(2).Info("applied manifest")
+	return result, nil
+}
+
+// apply applies objects one at a time, so that each error is recorded against the object it
+// is about.  Errors that are not about an object are recorded as such.
+func (d *DirectApplier) apply(ctx context.Context, objects *manifest.Objects, options ApplyOptions, ioStreams genericclioptions.IOStreams, result *ApplyResult) error {
+	applyOpts, f, err := d.applyOptions(ctx, options, ioStreams, result)
 	if err != nil {
+		result.fail(err)
+		return err
+	}
+
+	var errs []error
+	var infos []*resource.Info
+	for _, obj := range objects.Items {
+		objInfos, err := objectInfos(f, applyOpts, obj)
+		if err != nil {
+			result.record(obj.Group, obj.Kind, obj.Namespace, obj.Name, OperationFailed, err)
+			errs = append(errs, err)
+			continue
+		}
+		infos = append(infos, objInfos...)
+	}
+
+	// Pruning, like printing lists, is done once every object is applied
+	postProcess := applyOpts.PostProcessorFn
+	applyOpts.PostProcessorFn = nil
+	for _, info := range infos {
+		applyOpts.SetObjects([]*resource.Info{info})
+		if err := applyOpts.Run(); err != nil {
+			gvk := info.Object.GetObjectKind().GroupVersionKind()
+			result.record(gvk.Group, gvk.Kind, info.Namespace, info.Name, OperationFailed, err)
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) != 0 {
+		// As with kubectl, nothing is pruned unless every object is applied
+		return utilerrors.NewAggregate(errs)
+	}
+	if len(infos) == 0 {
+		// Nor is everything pruned when there is nothing to apply
+		err := fmt.Errorf("no objects passed to apply")
+		result.fail(err)
 		return err
 	}
 
-	applyOpts := apply.NewApplyOptions(ioStreams)
-	applyOpts.Namespace = namespace
 	applyOpts.SetObjects(infos)
+	if postProcess != nil {
+		if err := postProcess(); err != nil {
+			result.fail(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// applyOptions returns the kubectl apply options for options, and the factory they use.  Each
+// operation printed by kubectl is recorded in result.
+func (d *DirectApplier) applyOptions(ctx context.Context, options ApplyOptions, ioStreams genericclioptions.IOStreams, result *ApplyResult) (*apply.ApplyOptions, cmdutil.Factory, error) {
+	config := d.config
+	if config == nil {
+		c, err := genericclioptions.NewConfigFlags(true).ToRESTConfig()
+		if err != nil {
+			return nil, nil, fmt.Errorf("error loading kubeconfig: %v", err)
+		}
+		config = c
+	}
+	config = rest.CopyConfig(config)
+	config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return &contextRoundTripper{ctx: ctx, rt: rt}
+	})
+
+	restClientGetter := &staticRESTClientGetter{
+		config:     config,
+		restMapper: d.restMapper,
+		namespace:  options.Namespace,
+	}
+	f := cmdutil.NewFactory(restClientGetter)
+
+	applyOpts := apply.NewApplyOptions(ioStreams)
+	cmd := newApplyCommand(applyOpts)
+
+	// The objects are set directly, but apply insists on a filename
+	args := []string{"--validate=" + strconv.FormatBool(options.Validate)}
+	args = append(args, kubectlArgs(options)...)
+	args = append(args, "-f", "-")
+	if err := cmd.ParseFlags(args); err != nil {
+		return nil, nil, fmt.Errorf("error parsing apply arguments %v: %v", args, err)
+	}
+
+	if err := applyOpts.Complete(f, cmd); err != nil {
+		return nil, nil, fmt.Errorf("error configuring apply: %v", err)
+	}
+
+	// Record each operation as kubectl prints it
+	toPrinter := applyOpts.ToPrinter
 	applyOpts.ToPrinter = func(operation string) (printers.ResourcePrinter, error) {
-		applyOpts.PrintFlags.NamePrintFlags.Operation = operation
-		cmdutil.PrintFlagsWithDryRunStrategy(applyOpts.PrintFlags, applyOpts.DryRunStrategy)
-		return applyOpts.PrintFlags.ToPrinter()
+		printer, err := toPrinter(operation)
+		if err != nil {
+			return nil, err
+		}
+		return printers.ResourcePrinterFunc(func(obj runtime.Object, w io.Writer) error {
+			if op, ok := kubectlOperation(operation); ok {
+				if accessor, err := meta.Accessor(obj); err == nil {
+					gvk := obj.GetObjectKind().GroupVersionKind()
+					result.record(gvk.Group, gvk.Kind, accessor.GetNamespace(), accessor.GetName(), op, nil)
+				}
+			}
+			return printer.PrintObj(obj, w)
+		}), nil
+	}
+	return applyOpts, f, nil
+}
+
+// objectInfos returns the resource.Infos kubectl apply builds for obj, validating it and placing
+// it in the namespace of applyOpts.  It returns none if obj does not match the selector.
+func objectInfos(f cmdutil.Factory, applyOpts *apply.ApplyOptions, obj *manifest.Object) ([]*resource.Info, error) {
+	j, err := obj.JSON()
+	if err != nil {
+		return nil, fmt.Errorf("error building json for %s %s: %v", obj.Kind, obj.Name, err)
+	}
+
+	b := f.NewBuilder().
+		Unstructured().
+		Schema(applyOpts.Validator).
+		ContinueOnError().
+		NamespaceParam(applyOpts.Namespace).DefaultNamespace().
+		Stream(bytes.NewReader(j), "manifestString").
+		Flatten()
+	if applyOpts.EnforceNamespace {
+		b = b.RequireNamespace()
+	}
+	if applyOpts.Selector != "" {
+		b = b.LabelSelectorParam(applyOpts.Selector)
+	}
+	return b.Do().Infos()
+}
+
+// newApplyCommand binds the flags of kubectl apply to applyOpts, mirroring apply.NewCmdApply
+func newApplyCommand(o *apply.ApplyOptions) *cobra.Command {
+	cmd := &cobra.Command{Use: "apply"}
+
+	o.DeleteFlags.AddFlags(cmd)
+	o.RecordFlags.AddFlags(cmd)
+	o.PrintFlags.AddFlags(cmd)
+
+	cmd.Flags().BoolVar(&o.Overwrite, "overwrite", o.Overwrite, "")
+	cmd.Flags().BoolVar(&o.Prune, "prune", o.Prune, "")
+	cmdutil.AddValidateFlags(cmd)
+	cmd.Flags().StringVarP(&o.Selector, "selector", "l", o.Selector, "")
+	cmd.Flags().BoolVar(&o.All, "all", o.All, "")
+	cmd.Flags().StringArrayVar(&o.PruneWhitelist, "prune-whitelist", o.PruneWhitelist, "")
+	cmd.Flags().BoolVar(&o.OpenAPIPatch, "openapi-patch", o.OpenAPIPatch, "")
+	cmdutil.AddDryRunFlag(cmd)
+	cmdutil.AddServerSideApplyFlags(cmd)
+	cmdutil.AddFieldManagerFlagVar(cmd, &o.FieldManager, apply.FieldManagerClientSideApply)
+
+	return cmd
+}
+
+// contextRoundTripper cancels every request when ctx is done, so that an apply can be
+// cancelled.  Requests are still cancelled when their own context is done.
+type contextRoundTripper struct {
+	ctx context.Context
+	rt  http.RoundTripper
+}
+
+func (c *contextRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-c.ctx.Done():
+			cancel()
+		case <-done:
+		}
+	}()
+	// The body is read after RoundTrip returns, so the request is only released when it is closed
+	release := func() {
+		close(done)
+		cancel()
+	}
+
+	resp, err := c.rt.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releasingBody calls release once the body of a response is closed
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+var _ genericclioptions.RESTClientGetter = &staticRESTClientGetter{}
+
+// staticRESTClientGetter is a RESTClientGetter for a fixed rest.Config, rather than
+// one loaded from kubeconfig files and command line flags
+type staticRESTClientGetter struct {
+	config     *rest.Config
+	restMapper meta.RESTMapper
+	namespace  string
+}
+
+func (s *staticRESTClientGetter) ToRESTConfig() (*rest.Config, error) {
+	return s.config, nil
+}
+
+func (s *staticRESTClientGetter) ToDiscoveryClient() (discovery.CachedDiscoveryInterface, error) {
+	d, err := discovery.NewDiscoveryClientForConfig(s.config)
+	if err != nil {
+		return nil, err
+	}
+	return memory.NewMemCacheClient(d), nil
+}
+
+func (s *staticRESTClientGetter) ToRESTMapper() (meta.RESTMapper, error) {
+	if s.restMapper != nil {
+		return s.restMapper, nil
+	}
+	d, err := s.ToDiscoveryClient()
+	if err != nil {
+		return nil, err
 	}
-	applyOpts.DeleteOptions = &cmdDelete.DeleteOptions{
-		IOStreams: ioStreams,
+	return restmapper.NewDeferredDiscoveryRESTMapper(d), nil
+}
+
+func (s *staticRESTClientGetter) ToRawKubeConfigLoader() clientcmd.ClientConfig {
+	return &namespaceClientConfig{
+		inner:     clientcmd.NewDefaultClientConfig(*clientcmdapi.NewConfig(), &clientcmd.ConfigOverrides{}),
+		namespace: s.namespace,
 	}
+}
+
+// namespaceClientConfig is only consulted for the namespace; an explicit namespace
+// is enforced in the same way as kubectl apply -n
+type namespaceClientConfig struct {
+	inner     clientcmd.ClientConfig
+	namespace string
+}
+
+func (c *namespaceClientConfig) RawConfig() (clientcmdapi.Config, error) {
+	return c.inner.RawConfig()
+}
 
-	return applyOpts.Run()
+func (c *namespaceClientConfig) ClientConfig() (*rest.Config, error) {
+	return c.inner.ClientConfig()
+}
+
+func (c *namespaceClientConfig) ConfigAccess() clientcmd.ConfigAccess {
+	return c.inner.ConfigAccess()
+}
+
+func (c *namespaceClientConfig) Namespace() (string, bool, error) {
+	if c.namespace == "" {
+		return metav1.NamespaceDefault, false, nil
+	}
+	return c.namespace, true, nil
 }
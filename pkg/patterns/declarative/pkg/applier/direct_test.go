@@ -0,0 +1,241 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package applier
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/rest"
+	"k8s.io/kubectl/pkg/cmd/apply"
+)
+
+// fakeCreateServer is an API server on which no objects exist yet, so kubectl apply creates them.
+// The creation of objects named forbidden is refused.
+type fakeCreateServer struct {
+	mutex    sync.Mutex
+	requests []string
+}
+
+func (s *fakeCreateServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	s.requests = append(s.requests, req.Method+" "+req.URL.Path)
+	s.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"kind":       "Status",
+			"apiVersion": "v1",
+			"status":     "Failure",
+			"reason":     "NotFound",
+			"code":       http.StatusNotFound,
+		})
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	if strings.Contains(string(body), `"name":"forbidden"`) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"kind":       "Status",
+			"apiVersion": "v1",
+			"status":     "Failure",
+			"reason":     "Forbidden",
+			"code":       http.StatusForbidden,
+		})
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(body)
+}
+
+func TestDirectApplierNamespace(t *testing.T) {
+	ctx := context.Background()
+	s := &fakeCreateServer{}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{{Version: "v1"}})
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	d := NewDirectApplierForConfig(&rest.Config{Host: server.URL}, mapper)
+
+	// As with kubectl apply -n, objects without a namespace are created in the namespace given
+	result, err := d.Apply(ctx, parseTestObjects(t, `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"defaulted"}}`), ApplyOptions{Namespace: "ns"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []ObjectResult{{Kind: "ConfigMap", Namespace: "ns", Name: "defaulted", Operation: OperationCreated}}
+	if !reflect.DeepEqual(result.Objects, want) {
+		t.Errorf("unexpected result %+v, want %+v", result.Objects, want)
+	}
+	if !containsString(s.requests, "POST /api/v1/namespaces/ns/configmaps") {
+		t.Errorf("expected the object to be created in namespace ns, got requests %v", s.requests)
+	}
+
+	// and objects in another namespace are refused
+	result, err = d.Apply(ctx, parseTestObjects(t, configMapManifest("config", "other", "value")), ApplyOptions{Namespace: "ns"})
+	if err == nil {
+		t.Fatalf("expected an error for an object in another namespace")
+	}
+	if len(result.Objects) != 1 || result.Objects[0].Operation != OperationFailed {
+		t.Errorf("expected the object to fail, got %+v", result.Objects)
+	}
+}
+
+func TestDirectApplierFailures(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewServer(&fakeCreateServer{})
+	defer server.Close()
+
+	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{{Version: "v1"}})
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	d := NewDirectApplierForConfig(&rest.Config{Host: server.URL}, mapper)
+
+	objects := parseTestObjects(t, configMapManifest("created", "ns", "value")+"\n---\n"+
+		configMapManifest("forbidden", "ns", "value")+"\n---\n"+
+		configMapManifest("other", "other", "value"))
+	result, err := d.Apply(ctx, objects, ApplyOptions{Namespace: "ns"})
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	// Each failure is recorded against the object it is about
+	operations := map[string]Operation{}
+	for _, o := range result.Objects {
+		operations[o.Name] = o.Operation
+		if o.Operation == OperationFailed && o.Error == nil {
+			t.Errorf("expected the error of %s", o.Name)
+		}
+	}
+	want := map[string]Operation{"created": OperationCreated, "forbidden": OperationFailed, "other": OperationFailed}
+	if !reflect.DeepEqual(operations, want) {
+		t.Errorf("unexpected operations %v, want %v", operations, want)
+	}
+}
+
+func TestDirectApplierFlags(t *testing.T) {
+	tests := []struct {
+		name       string
+		options    ApplyOptions
+		wantPrune  bool
+		selector   string
+		wantForce  string
+		wantDryRun string
+	}{
+		{name: "validate", options: ApplyOptions{Validate: true}, wantForce: "false", wantDryRun: "none"},
+		{name: "prune", options: ApplyOptions{PruneSelector: "app=test"}, wantPrune: true, selector: "app=test", wantForce: "false", wantDryRun: "none"},
+		{name: "force", options: ApplyOptions{Force: true}, wantForce: "true", wantDryRun: "none"},
+		{name: "dry run", options: ApplyOptions{DryRun: true}, wantForce: "false", wantDryRun: "server"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := apply.NewApplyOptions(genericclioptions.NewTestIOStreamsDiscard())
+			cmd := newApplyCommand(o)
+			// The same flags as are passed to kubectl by ExecKubectl
+			args := append([]string{"--validate=" + strconv.FormatBool(tt.options.Validate)}, kubectlArgs(tt.options)...)
+			if err := cmd.ParseFlags(args); err != nil {
+				t.Fatalf("error parsing %v: %v", args, err)
+			}
+
+			if validate := cmd.Flag("validate").Value.String(); validate != strconv.FormatBool(tt.options.Validate) {
+				t.Errorf("got validate %s, want %v", validate, tt.options.Validate)
+			}
+			if o.Prune != tt.wantPrune || o.Selector != tt.selector {
+				t.Errorf("got prune %v with selector %q, want %v with %q", o.Prune, o.Selector, tt.wantPrune, tt.selector)
+			}
+			if force := cmd.Flag("force").Value.String(); force != tt.wantForce {
+				t.Errorf("got force %s, want %s", force, tt.wantForce)
+			}
+			if dryRun := cmd.Flag("dry-run").Value.String(); dryRun != tt.wantDryRun {
+				t.Errorf("got dry run %s, want %s", dryRun, tt.wantDryRun)
+			}
+		})
+	}
+}
+
+func TestContextRoundTripper(t *testing.T) {
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/block" {
+			select {
+			case <-block:
+			case <-req.Context().Done():
+			}
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	defer close(block)
+
+	get := func(applyCtx, requestCtx context.Context, path string) (string, error) {
+		client := &http.Client{Transport: &contextRoundTripper{ctx: applyCtx, rt: http.DefaultTransport}}
+		req, err := http.NewRequestWithContext(requestCtx, http.MethodGet, server.URL+path, nil)
+		if err != nil {
+			return "", err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	// The body can be read after RoundTrip returns
+	body, err := get(context.Background(), context.Background(), "/")
+	if err != nil || body != "ok" {
+		t.Errorf("got %q, %v; want ok", body, err)
+	}
+
+	// Requests are cancelled when the apply is
+	applyCtx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := get(applyCtx, context.Background(), "/block"); err == nil {
+		t.Errorf("expected the request to be cancelled with the apply")
+	}
+
+	// and when their own context times out
+	requestCtx, cancelRequest := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelRequest()
+	if _, err := get(context.Background(), requestCtx, "/block"); err == nil {
+		t.Errorf("expected the request to time out")
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
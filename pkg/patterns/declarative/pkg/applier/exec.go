@@ -19,12 +19,15 @@ package applier
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"os/exec"
 	"strconv"
 	"strings"
 
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
 )
 
 // New creates a Client that runs kubectl avaliable on the path with default authentication
@@ -48,27 +51,35 @@ func (console) Run(c *exec.Cmd) error {
 	return c.Run()
 }
 
-// Apply runs the kubectl apply with the provided manifest argument
-func (c *ExecKubectl) Apply(ctx context.Context, namespace string, manifest string, validate bool,
-	extraArgs ...string) error {
+var _ Applier = &ExecKubectl{}
+
+// Apply runs kubectl apply with the provided objects, recording the operation kubectl reports for each object
+func (c *ExecKubectl) Apply(ctx context.Context, objects *manifest.Objects, options ApplyOptions) (*ApplyResult, error) {
 	log := log.Log
 
 	log.Info("applying manifest")
 
+	result := &ApplyResult{}
+
+	manifestStr, err := objects.JSONManifest()
+	if err != nil {
+		return result, fmt.Errorf("error creating manifest: %v", err)
+	}
+
 	args := []string{"apply"}
-	if namespace != "" {
-		args = append(args, "-n", namespace)
+	if options.Namespace != "" {
+		args = append(args, "-n", options.Namespace)
 	}
 
 	// Not doing --validate avoids downloading the OpenAPI
 	// which can save a lot work & memory
-	args = append(args, "--validate="+strconv.FormatBool(validate))
+	args = append(args, "--validate="+strconv.FormatBool(options.Validate))
 
-	args = append(args, extraArgs...)
+	args = append(args, kubectlArgs(options)...)
 	args = append(args, "-f", "-")
 
-	cmd := exec.Command("kubectl", args...)
-	cmd.Stdin = strings.NewReader(manifest)
+	cmd := exec.CommandContext(ctx, "kubectl", args...)
+	cmd.Stdin = strings.NewReader(manifestStr)
 
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
@@ -77,14 +88,99 @@ func (c *ExecKubectl) Apply(ctx context.Context, namespace string, manifest stri
 
 	log.WithValues("command", "kubectl").WithValues("args", args).Info("executing kubectl")
 
-	err := c.cmdSite.Run(cmd)
+	err = c.cmdSite.Run(cmd)
+	parseApplyOutput(objects, stdout.String(), result)
 	if err != nil {
 		log.WithValues("stdout", stdout.String()).WithValues("stderr", stderr.String()).Error(err, "error from running kubectl apply")
-		log.Info(fmt.Sprintf("manifest:\n%v", manifest))
-		return fmt.Errorf("error from running kubectl apply: %v", err)
+		log.Info(fmt.Sprintf("manifest:\n%v", manifestStr))
+		err = fmt.Errorf("error from running kubectl apply: %v", err)
+		// kubectl does not say which objects its errors are about
+		result.fail(kubectlErrors(stderr.String(), err))
+		return result, err
 	}
 
 	log.WithValues("stdout", stdout.String()).WithValues("stderr", stderr.String()).V(2).Info("ran kubectl apply")
 
-	return nil
+	return result, nil
+}
+
+// kubectlArgs returns the kubectl apply flags for options, other than namespace and validation
+func kubectlArgs(options ApplyOptions) []string {
+	var args []string
+	if options.Force {
+		args = append(args, "--force")
+	}
+	if options.PruneSelector != "" {
+		args = append(args, "--prune", "--selector", options.PruneSelector)
+	}
+	if options.DryRun {
+		args = append(args, "--dry-run=server")
+	}
+	return args
+}
+
+// kubectlErrors returns the errors kubectl printed to stderr, one per line, or err if it printed
+// none.  Other lines, such as warnings, are skipped.
+func kubectlErrors(stderr string, err error) error {
+	var errs []error
+	for _, line := range strings.Split(stderr, "\n") {
+		if line = strings.TrimSpace(line); strings.HasPrefix(strings.ToLower(line), "error") {
+			errs = append(errs, errors.New(line))
+		}
+	}
+	if len(errs) == 0 {
+		return err
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// parseApplyOutput records the operations from kubectl's default output, which
+// has lines of the form "deployment.apps/frontend configured"
+func parseApplyOutput(objects *manifest.Objects, out string, result *ApplyResult) {
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		op, ok := kubectlOperation(fields[1])
+		if !ok {
+			continue
+		}
+
+		slash := strings.Index(fields[0], "/")
+		if slash == -1 {
+			continue
+		}
+		resource, name := fields[0][:slash], fields[0][slash+1:]
+		kind, group := resource, ""
+		if dot := strings.Index(resource, "."); dot != -1 {
+			kind, group = resource[:dot], resource[dot+1:]
+		}
+
+		namespace := ""
+		for _, o := range objects.Items {
+			if o.Group == group && strings.EqualFold(o.Kind, kind) && o.Name == name {
+				kind = o.Kind
+				namespace = o.Namespace
+				break
+			}
+		}
+		result.record(group, kind, namespace, name, op, nil)
+	}
+}
+
+// kubectlOperation maps the operation printed by kubectl apply to an Operation
+func kubectlOperation(s string) (Operation, bool) {
+	switch s {
+	case "created":
+		return OperationCreated, true
+	case "configured", "serverside-applied":
+		return OperationConfigured, true
+	case "unchanged":
+		return OperationUnchanged, true
+	case "pruned":
+		return OperationPruned, true
+	default:
+		return "", false
+	}
 }
@@ -21,50 +21,63 @@ import (
 	"errors"
 	"testing"
 
+	"io"
 	"io/ioutil"
 	"reflect"
 
 	"os/exec"
+
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
 )
 
 // collector is a commandSite implementation that stubs cmd.Run() calls for tests
 type collector struct {
-	Error error
-	Cmds  []*exec.Cmd
+	Error  error
+	Stdout string
+	Cmds   []*exec.Cmd
 }
 
 func (s *collector) Run(c *exec.Cmd) error {
 	s.Cmds = append(s.Cmds, c)
+	if c.Stdout != nil {
+		io.WriteString(c.Stdout, s.Stdout)
+	}
 	return s.Error
 }
 
 func TestKubectlApply(t *testing.T) {
+	ctx := context.Background()
+
+	manifestStr := `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"frontend","namespace":"kube-system"}}`
+	objects, err := manifest.ParseObjects(ctx, manifestStr)
+	if err != nil {
+		t.Fatalf("error parsing manifest: %v", err)
+	}
+	expectStdin, err := objects.JSONManifest()
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+
 	tests := []struct {
-		name       string
-		namespace  string
-		manifest   string
-		validate   bool
-		args       []string
-		err        error
-		expectArgs []string
+		name          string
+		options       ApplyOptions
+		stdout        string
+		err           error
+		expectArgs    []string
+		expectResults []ObjectResult
 	}{
 		{
 			name:       "manifest",
-			namespace:  "",
-			manifest:   "foo",
 			expectArgs: []string{"kubectl", "apply", "--validate=false", "-f", "-"},
 		},
 		{
 			name:       "manifest with apply",
-			namespace:  "kube-system",
-			manifest:   "heynow",
+			options:    ApplyOptions{Namespace: "kube-system"},
 			expectArgs: []string{"kubectl", "apply", "-n", "kube-system", "--validate=false", "-f", "-"},
 		},
 		{
 			name:       "manifest with validate",
-			namespace:  "",
-			manifest:   "foo",
-			validate:   true,
+			options:    ApplyOptions{Validate: true},
 			expectArgs: []string{"kubectl", "apply", "--validate=true", "-f", "-"},
 		},
 		{
@@ -74,18 +87,30 @@ func TestKubectlApply(t *testing.T) {
 		},
 		{
 			name:       "manifest with prune",
-			namespace:  "kube-system",
-			manifest:   "heynow",
-			args:       []string{"--prune=true", "--prune-whitelist=hello-world"},
-			expectArgs: []string{"kubectl", "apply", "-n", "kube-system", "--validate=false", "--prune=true", "--prune-whitelist=hello-world", "-f", "-"},
+			options:    ApplyOptions{Namespace: "kube-system", PruneSelector: "app=hello-world", Force: true},
+			expectArgs: []string{"kubectl", "apply", "-n", "kube-system", "--validate=false", "--force", "--prune", "--selector", "app=hello-world", "-f", "-"},
+		},
+		{
+			name:       "manifest with dry run",
+			options:    ApplyOptions{DryRun: true},
+			expectArgs: []string{"kubectl", "apply", "--validate=false", "--dry-run=server", "-f", "-"},
+		},
+		{
+			name:       "operations are recorded",
+			stdout:     "deployment.apps/frontend configured\nconfigmap/old-config pruned\n",
+			expectArgs: []string{"kubectl", "apply", "--validate=false", "-f", "-"},
+			expectResults: []ObjectResult{
+				{Group: "apps", Kind: "Deployment", Namespace: "kube-system", Name: "frontend", Operation: OperationConfigured},
+				{Group: "", Kind: "configmap", Name: "old-config", Operation: OperationPruned},
+			},
 		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			cs := collector{Error: test.err}
+			cs := collector{Error: test.err, Stdout: test.stdout}
 			kubectl := &ExecKubectl{cmdSite: &cs}
-			err := kubectl.Apply(context.Background(), test.namespace, test.manifest, test.validate, test.args...)
+			result, err := kubectl.Apply(ctx, objects, test.options)
 
 			if test.err != nil && err == nil {
 				t.Error("expected error to occur")
@@ -103,8 +128,17 @@ func TestKubectlApply(t *testing.T) {
 			}
 
 			stdinBytes, err := ioutil.ReadAll(cmd.Stdin)
-			if stdin := string(stdinBytes); stdin != test.manifest {
-				t.Errorf("manifest mismatch, expected: %v, got: %v", test.manifest, stdin)
+			if stdin := string(stdinBytes); stdin != expectStdin {
+				t.Errorf("manifest mismatch, expected: %v, got: %v", expectStdin, stdin)
+			}
+
+			if test.err != nil {
+				// kubectl does not say which objects failed
+				if failed := result.Filter(OperationFailed); len(failed) != 1 || failed[0].Name != "" {
+					t.Errorf("expected a single failure of the apply, got: %v", result.Objects)
+				}
+			} else if !reflect.DeepEqual(result.Objects, test.expectResults) {
+				t.Errorf("result mismatch, expected: %v, got: %v", test.expectResults, result.Objects)
 			}
 		})
 	}
@@ -0,0 +1,207 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package applier
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+// ServerSideApplier applies objects with server-side apply, talking to the API server
+// through a REST client rather than shelling out to kubectl.
+type ServerSideApplier struct {
+	client       rest.Interface
+	restMapper   meta.RESTMapper
+	fieldManager string
+
+	// mutex guards applied and previous
+	mutex sync.Mutex
+	// applied is the resourceVersion returned by the last apply of each object, so that an
+	// apply that returns the same resourceVersion is known to have changed nothing.  Once it
+	// holds maxAppliedVersions objects it replaces previous, so that the objects that are no
+	// longer applied, e.g. because they were deleted, are eventually forgotten.
+	applied  map[objectKey]string
+	previous map[objectKey]string
+}
+
+// maxAppliedVersions bounds the number of resourceVersions kept in each generation of
+// ServerSideApplier.applied.  An object that is forgotten is reported as configured.
+const maxAppliedVersions = 4096
+
+// objectKey identifies an object applied by the ServerSideApplier
+type objectKey struct {
+	resource  schema.GroupVersionResource
+	namespace string
+	name      string
+}
+
+var _ Applier = &ServerSideApplier{}
+
+// NewServerSideApplier creates a ServerSideApplier for the cluster described by config.
+// Fields written by the applier are owned by fieldManager.
+func NewServerSideApplier(config *rest.Config, restMapper meta.RESTMapper, fieldManager string) (*ServerSideApplier, error) {
+	// As with the dynamic client, requests give their whole path
+	restConfig := dynamic.ConfigFor(config)
+	restConfig.GroupVersion = &schema.GroupVersion{}
+	client, err := rest.RESTClientFor(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error building REST client: %v", err)
+	}
+
+	return &ServerSideApplier{
+		client:       client,
+		restMapper:   restMapper,
+		fieldManager: fieldManager,
+		applied:      make(map[objectKey]string),
+	}, nil
+}
+
+// Apply server-side applies each object in turn.  Validation is always performed by the
+// API server.  If options.Force is set, ownership of fields that conflict with another
+// manager is taken over instead of failing.  Pruning is not supported.
+//
+// Objects are reported as created when the API server creates them.  An existing object is
+// reported as unchanged when its resourceVersion is the one returned by the last apply of the
+// applier, so the first apply of an existing object by an applier reports it as configured.
+func (a *ServerSideApplier) Apply(ctx context.Context, objects *manifest.Objects, options ApplyOptions) (*ApplyResult, error) {
+	result := &ApplyResult{}
+	if options.PruneSelector != "" {
+		err := fmt.Errorf("pruning is not supported with server-side apply")
+		result.fail(err)
+		return result, err
+	}
+
+	var errs []error
+	for _, obj := range objects.Items {
+		ns, op, err := a.applyObject(ctx, obj, options)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		result.record(obj.Group, obj.Kind, ns, obj.Name, op, err)
+	}
+	return result, utilerrors.NewAggregate(errs)
+}
+
+func (a *ServerSideApplier) applyObject(ctx context.Context, obj *manifest.Object, options ApplyOptions) (string, Operation, error) {
+	log := log.Log
+
+	ns := obj.UnstructuredObject().GetNamespace()
+	gvk := obj.GroupVersionKind()
+	mapping, err := a.restMapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return ns, OperationFailed, fmt.Errorf("unable to get mapping for %v: %v", gvk, err)
+	}
+
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		if ns == "" {
+			ns = options.Namespace
+		}
+		if options.Namespace != "" && ns != options.Namespace {
+			return ns, OperationFailed, fmt.Errorf("the namespace of %s %s (%q) does not match the namespace %q", gvk.Kind, obj.Name, ns, options.Namespace)
+		}
+	} else {
+		ns = ""
+	}
+
+	j, err := obj.JSON()
+	if err != nil {
+		return ns, OperationFailed, fmt.Errorf("error building json for %s %s: %v", gvk.Kind, obj.Name, err)
+	}
+
+	force := options.Force
+	patchOptions := metav1.PatchOptions{
+		FieldManager: a.fieldManager,
+		Force:        &force,
+	}
+	if options.DryRun {
+		patchOptions.DryRun = []string{metav1.DryRunAll}
+	}
+
+	log.WithValues("kind", gvk.Kind).WithValues("namespace", ns).WithValues("name", obj.Name).V(2).Info("server-side applying object")
+	var statusCode int
+	body, err := a.client.Patch(types.ApplyPatchType).
+		AbsPath(resourcePath(mapping.Resource, ns, obj.Name)...).
+		VersionedParams(&patchOptions, metav1.ParameterCodec).
+		Body(j).
+		Do(ctx).
+		StatusCode(&statusCode).
+		Raw()
+	if err != nil {
+		return ns, OperationFailed, fmt.Errorf("error applying %s %s/%s: %w", gvk.Kind, ns, obj.Name, err)
+	}
+	applied := &unstructured.Unstructured{}
+	if err := applied.UnmarshalJSON(body); err != nil {
+		return ns, OperationFailed, fmt.Errorf("error decoding applied %s %s/%s: %v", gvk.Kind, ns, obj.Name, err)
+	}
+
+	key := objectKey{resource: mapping.Resource, namespace: ns, name: obj.Name}
+	previousVersion := a.record(key, applied.GetResourceVersion(), !options.DryRun)
+	switch {
+	case statusCode == http.StatusCreated:
+		return ns, OperationCreated, nil
+	case previousVersion != "" && previousVersion == applied.GetResourceVersion():
+		return ns, OperationUnchanged, nil
+	default:
+		return ns, OperationConfigured, nil
+	}
+}
+
+// record returns the resourceVersion returned by the last apply of key, recording
+// resourceVersion as the new one if save is set
+func (a *ServerSideApplier) record(key objectKey, resourceVersion string, save bool) string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	previous, ok := a.applied[key]
+	if !ok {
+		previous = a.previous[key]
+	}
+	if save {
+		if len(a.applied) >= maxAppliedVersions {
+			a.previous = a.applied
+			a.applied = make(map[objectKey]string)
+		}
+		a.applied[key] = resourceVersion
+	}
+	return previous
+}
+
+// resourcePath returns the segments of the API path of the named object of resource
+func resourcePath(resource schema.GroupVersionResource, namespace, name string) []string {
+	segments := []string{"/api"}
+	if resource.Group != "" {
+		segments = []string{"/apis", resource.Group}
+	}
+	segments = append(segments, resource.Version)
+	if namespace != "" {
+		segments = append(segments, "namespaces", namespace)
+	}
+	return append(segments, resource.Resource, name)
+}
@@ -0,0 +1,272 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package applier
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+// fakeApplyServer is an API server for ConfigMaps that implements just enough of server-side
+// apply to tell creates, updates and no-op applies apart
+type fakeApplyServer struct {
+	mutex sync.Mutex
+	// objects are the applied ConfigMaps, by path
+	objects map[string]map[string]interface{}
+	version int
+	// managers are the field managers of objects, by path
+	managers map[string]string
+	// requests are the query strings of the requests, in order
+	requests []string
+}
+
+func (s *fakeApplyServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.requests = append(s.requests, req.Method+" "+req.URL.Path+"?"+req.URL.RawQuery)
+	if req.Method != http.MethodPatch || req.Header.Get("Content-Type") != "application/apply-patch+yaml" {
+		http.Error(w, "unexpected request", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(req.Body)
+	applied := map[string]interface{}{}
+	if err := json.Unmarshal(body, &applied); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	manager := req.URL.Query().Get("fieldManager")
+	live, found := s.objects[req.URL.Path]
+	if !found {
+		s.version++
+		setResourceVersion(applied, s.version)
+		s.objects[req.URL.Path] = applied
+		s.managers[req.URL.Path] = manager
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(applied)
+		return
+	}
+
+	if reflect.DeepEqual(live["data"], applied["data"]) {
+		json.NewEncoder(w).Encode(live)
+		return
+	}
+	if s.managers[req.URL.Path] != manager && req.URL.Query().Get("force") != "true" {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"kind":       "Status",
+			"apiVersion": "v1",
+			"status":     "Failure",
+			"reason":     "Conflict",
+			"code":       http.StatusConflict,
+			"message":    fmt.Sprintf("Apply failed with 1 conflict: conflict with %q", s.managers[req.URL.Path]),
+		})
+		return
+	}
+	s.version++
+	setResourceVersion(applied, s.version)
+	s.objects[req.URL.Path] = applied
+	s.managers[req.URL.Path] = manager
+	json.NewEncoder(w).Encode(applied)
+}
+
+func setResourceVersion(obj map[string]interface{}, version int) {
+	obj["metadata"].(map[string]interface{})["resourceVersion"] = strconv.Itoa(version)
+}
+
+func newTestServerSideApplier(t *testing.T, fieldManager string) (*ServerSideApplier, *fakeApplyServer) {
+	s := &fakeApplyServer{objects: map[string]map[string]interface{}{}, managers: map[string]string{}}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+
+	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{{Version: "v1"}})
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, meta.RESTScopeRoot)
+
+	a, err := NewServerSideApplier(&rest.Config{Host: server.URL}, mapper, fieldManager)
+	if err != nil {
+		t.Fatalf("error creating applier: %v", err)
+	}
+	return a, s
+}
+
+func parseTestObjects(t *testing.T, s string) *manifest.Objects {
+	objects, err := manifest.ParseObjects(context.Background(), s)
+	if err != nil {
+		t.Fatalf("error parsing manifest: %v", err)
+	}
+	return objects
+}
+
+func configMapManifest(name, namespace, value string) string {
+	return fmt.Sprintf(`{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":%q,"namespace":%q},"data":{"key":%q}}`, name, namespace, value)
+}
+
+func TestServerSideApplierOperations(t *testing.T) {
+	ctx := context.Background()
+	a, s := newTestServerSideApplier(t, "test-manager")
+
+	tests := []struct {
+		name  string
+		value string
+		want  Operation
+	}{
+		{name: "create", value: "one", want: OperationCreated},
+		{name: "no change", value: "one", want: OperationUnchanged},
+		{name: "change", value: "two", want: OperationConfigured},
+		{name: "no change after change", value: "two", want: OperationUnchanged},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := a.Apply(ctx, parseTestObjects(t, configMapManifest("config", "ns", tt.value)), ApplyOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			want := []ObjectResult{{Kind: "ConfigMap", Namespace: "ns", Name: "config", Operation: tt.want}}
+			if !reflect.DeepEqual(result.Objects, want) {
+				t.Errorf("unexpected result %+v, want %+v", result.Objects, want)
+			}
+		})
+	}
+
+	// Each object is applied with a single request, with the field manager of the applier
+	for _, r := range s.requests {
+		if want := "PATCH /api/v1/namespaces/ns/configmaps/config?fieldManager=test-manager&force=false"; r != want {
+			t.Errorf("unexpected request %q, want %q", r, want)
+		}
+	}
+	if len(s.requests) != len(tests) {
+		t.Errorf("got %d requests, want %d", len(s.requests), len(tests))
+	}
+}
+
+func TestServerSideApplierConflicts(t *testing.T) {
+	ctx := context.Background()
+	other, _ := newTestServerSideApplier(t, "other-manager")
+	a, s := newTestServerSideApplier(t, "test-manager")
+	// Both appliers talk to the same server
+	a.client = other.client
+
+	if _, err := other.Apply(ctx, parseTestObjects(t, configMapManifest("config", "ns", "one")), ApplyOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	result, err := a.Apply(ctx, parseTestObjects(t, configMapManifest("config", "ns", "two")), ApplyOptions{})
+	if err == nil {
+		t.Fatalf("expected a conflict")
+	}
+	if len(result.Objects) != 1 || result.Objects[0].Operation != OperationFailed || !apierrors.IsConflict(result.Objects[0].Error) {
+		t.Errorf("expected the object to fail with a conflict, got %+v", result.Objects)
+	}
+
+	result, err = a.Apply(ctx, parseTestObjects(t, configMapManifest("config", "ns", "two")), ApplyOptions{Force: true})
+	if err != nil {
+		t.Fatalf("unexpected error forcing conflicts: %v", err)
+	}
+	if len(result.Objects) != 1 || result.Objects[0].Operation != OperationConfigured {
+		t.Errorf("expected the object to be configured, got %+v", result.Objects)
+	}
+	if len(s.requests) != 0 {
+		t.Errorf("unexpected requests to the unused server: %v", s.requests)
+	}
+}
+
+func TestServerSideApplierNamespaces(t *testing.T) {
+	ctx := context.Background()
+	a, s := newTestServerSideApplier(t, "test-manager")
+
+	objects := parseTestObjects(t, `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"defaulted"},"data":{"key":"value"}}
+---
+{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"cluster-scoped","namespace":"ignored"}}`)
+	result, err := a.Apply(ctx, objects, ApplyOptions{Namespace: "ns", DryRun: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []ObjectResult{
+		{Kind: "ConfigMap", Namespace: "ns", Name: "defaulted", Operation: OperationCreated},
+		{Kind: "Namespace", Name: "cluster-scoped", Operation: OperationCreated},
+	}
+	if !reflect.DeepEqual(result.Objects, want) {
+		t.Errorf("unexpected result %+v, want %+v", result.Objects, want)
+	}
+	wantRequests := []string{
+		"PATCH /api/v1/namespaces/ns/configmaps/defaulted?dryRun=All&fieldManager=test-manager&force=false",
+		"PATCH /api/v1/namespaces/cluster-scoped?dryRun=All&fieldManager=test-manager&force=false",
+	}
+	if !reflect.DeepEqual(s.requests, wantRequests) {
+		t.Errorf("unexpected requests %v, want %v", s.requests, wantRequests)
+	}
+
+	// Objects in another namespace than the one given are refused
+	result, err = a.Apply(ctx, parseTestObjects(t, configMapManifest("config", "other", "value")), ApplyOptions{Namespace: "ns"})
+	if err == nil {
+		t.Fatalf("expected an error for an object in another namespace")
+	}
+	if len(result.Objects) != 1 || result.Objects[0].Operation != OperationFailed {
+		t.Errorf("expected the object to fail, got %+v", result.Objects)
+	}
+
+	// Pruning is not supported
+	if _, err := a.Apply(ctx, objects, ApplyOptions{PruneSelector: "app=test"}); err == nil {
+		t.Errorf("expected an error pruning")
+	}
+}
+
+func TestServerSideApplierForgetsVersions(t *testing.T) {
+	a := &ServerSideApplier{applied: make(map[objectKey]string)}
+	key := func(i int) objectKey {
+		return objectKey{namespace: "ns", name: fmt.Sprintf("config-%d", i)}
+	}
+
+	a.record(key(0), "1", true)
+	for i := 1; i < maxAppliedVersions; i++ {
+		a.record(key(i), "1", true)
+	}
+	// The versions of the previous generation are still known
+	a.record(key(maxAppliedVersions), "1", true)
+	if got := a.record(key(0), "2", true); got != "1" {
+		t.Errorf("got version %q of the previous generation, want %q", got, "1")
+	}
+
+	// Objects that are not applied again are forgotten after two generations
+	for i := 1; i < 2*maxAppliedVersions; i++ {
+		a.record(key(maxAppliedVersions+i), "1", true)
+	}
+	if got := a.record(key(1), "2", false); got != "" {
+		t.Errorf("got version %q of a forgotten object, want none", got)
+	}
+	if len(a.applied) > maxAppliedVersions || len(a.previous) > maxAppliedVersions {
+		t.Errorf("kept %d and %d versions, want at most %d", len(a.applied), len(a.previous), maxAppliedVersions)
+	}
+}
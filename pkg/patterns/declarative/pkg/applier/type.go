@@ -2,8 +2,97 @@ package applier
 
 import (
 	"context"
+
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
 )
 
+// Applier applies a set of objects to a cluster
 type Applier interface {
-	Applyx(ctx context.Context, namespace string, manifest string, validate bool, extraArgs ...string) error
+	// Apply applies objects as configured by options, returning what happened to each object.
+	// A non-nil ApplyResult is returned even when an error occurs, so that partial progress can be reported.
+	Apply(ctx context.Context, objects *manifest.Objects, options ApplyOptions) (*ApplyResult, error)
+}
+
+// ApplyOptions configures a single Apply
+type ApplyOptions struct {
+	// Namespace is used for namespace-scoped objects that do not specify a namespace.
+	// Objects in other namespaces are rejected, as with kubectl apply -n.
+	Namespace string
+
+	// PruneSelector is a label selector; if set, objects matching it that are not part
+	// of the applied objects are deleted.
+	PruneSelector string
+
+	// Validate enables schema validation of the objects before they are applied
+	Validate bool
+
+	// Force resolves conflicts by force.  With client-side apply objects that cannot be
+	// patched are deleted and re-created; with server-side apply ownership of conflicting
+	// fields is taken from other field managers.
+	Force bool
+
+	// DryRun sends the requests to the API server without persisting any changes
+	DryRun bool
+}
+
+// Operation is the outcome of applying a single object
+type Operation string
+
+const (
+	OperationCreated    Operation = "created"
+	OperationConfigured Operation = "configured"
+	OperationUnchanged  Operation = "unchanged"
+	OperationPruned     Operation = "pruned"
+	OperationFailed     Operation = "failed"
+)
+
+// ObjectResult records the outcome of applying a single object
+type ObjectResult struct {
+	Group     string
+	Kind      string
+	Namespace string
+	Name      string
+
+	Operation Operation
+	// Error is set when Operation is OperationFailed.  Kind and Name are empty for a failure
+	// that is not tied to an object.
+	Error error
+}
+
+// ApplyResult records the outcome of an Apply for each object
+type ApplyResult struct {
+	Objects []ObjectResult
+}
+
+// Filter returns the results with the given operation
+func (r *ApplyResult) Filter(op Operation) []ObjectResult {
+	var out []ObjectResult
+	for _, o := range r.Objects {
+		if o.Operation == op {
+			out = append(out, o)
+		}
+	}
+	return out
+}
+
+// Count returns the number of results with the given operation
+func (r *ApplyResult) Count(op Operation) int {
+	return len(r.Filter(op))
+}
+
+func (r *ApplyResult) record(group, kind, namespace, name string, op Operation, err error) {
+	r.Objects = append(r.Objects, ObjectResult{
+		Group:     group,
+		Kind:      kind,
+		Namespace: namespace,
+		Name:      name,
+		Operation: op,
+		Error:     err,
+	})
+}
+
+// fail records err as a failure that is not tied to any object, such as an apply that could
+// not be started.  The objects the appliers could tie a failure to are recorded on their own.
+func (r *ApplyResult) fail(err error) {
+	r.Objects = append(r.Objects, ObjectResult{Operation: OperationFailed, Error: err})
 }
@@ -0,0 +1,40 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package applier
+
+import (
+	"errors"
+	"testing"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+func TestKubectlErrors(t *testing.T) {
+	stderr := `Warning: resource configmaps/config is missing the kubectl.kubernetes.io/last-applied-configuration annotation
+Error from server (Forbidden): error when creating "STDIN": configmaps "forbidden" is forbidden
+error: error validating "STDIN": ConfigMap "invalid" is invalid
+`
+	err := kubectlErrors(stderr, errors.New("exit status 1"))
+	agg, ok := err.(utilerrors.Aggregate)
+	if !ok || len(agg.Errors()) != 2 {
+		t.Fatalf("expected the two errors kubectl printed, got %v", err)
+	}
+
+	if err := kubectlErrors("", errors.New("exit status 1")); err.Error() != "exit status 1" {
+		t.Errorf("expected the error of kubectl without output, got %v", err)
+	}
+}
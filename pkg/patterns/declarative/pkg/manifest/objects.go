@@ -178,6 +178,14 @@ func (o *Object) NestedStringMap(fields ...string) (map[string]string, bool, err
 	return unstructured.NestedStringMap(o.object.Object, fields...)
 }
 
+// SetNamespace sets the namespace of the object
+func (o *Object) SetNamespace(namespace string) {
+	o.object.SetNamespace(namespace)
+	o.Namespace = namespace
+	// Invalidate cached json
+	o.json = nil
+}
+
 func (o *Object) SetNestedField(value interface{}, fields ...string) error {
 	if o.object.Object == nil {
 		o.object.Object = make(map[string]interface{})
@@ -37,22 +37,39 @@ import (
 const WatchDelay = 30 * time.Second
 
 func NewDynamicWatch(config rest.Config) (*dynamicWatch, chan event.GenericEvent, error) {
-	dw := &dynamicWatch{events: make(chan event.GenericEvent)}
+	dw, err := newDynamicWatch(config, make(chan event.GenericEvent))
+	if err != nil {
+		return nil, nil, err
+	}
+	return dw, dw.events, nil
+}
+
+// ForConfig returns a dynamicWatch on the cluster of config, that raises events on the same
+// channel as dw.  Its watches run until it is stopped.
+func (dw *dynamicWatch) ForConfig(config rest.Config) (*dynamicWatch, error) {
+	return newDynamicWatch(config, dw.events)
+}
 
+func newDynamicWatch(config rest.Config, events chan event.GenericEvent) (*dynamicWatch, error) {
 	restMapper, err := apiutil.NewDiscoveryRESTMapper(&config)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	client, err := dynamic.NewForConfig(&config)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	dw.restMapper = restMapper
-	dw.config = config
-	dw.client = client
-	return dw, dw.events, nil
+	ctx, cancel := context.WithCancel(context.Background())
+	return &dynamicWatch{
+		config:     config,
+		client:     client,
+		restMapper: restMapper,
+		events:     events,
+		ctx:        ctx,
+		cancel:     cancel,
+	}, nil
 }
 
 type dynamicWatch struct {
@@ -60,6 +77,15 @@ type dynamicWatch struct {
 	client     dynamic.Interface
 	restMapper meta.RESTMapper
 	events     chan event.GenericEvent
+
+	// ctx is cancelled to stop all watches
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Stop stops all watches
+func (dw *dynamicWatch) Stop() {
+	dw.cancel()
 }
 
 func (dw *dynamicWatch) newDynamicClient(gvk schema.GroupVersionKind) (dynamic.ResourceInterface, error) {
@@ -81,7 +107,11 @@ func (dw *dynamicWatch) Add(trigger schema.GroupVersionKind, options metav1.List
 		for {
 			dw.watchUntilClosed(client, trigger, options, target)
 
-			time.Sleep(WatchDelay)
+			select {
+			case <-dw.ctx.Done():
+				return
+			case <-time.After(WatchDelay):
+			}
 		}
 	}()
 
@@ -105,7 +135,7 @@ type clientObject struct {
 func (dw *dynamicWatch) watchUntilClosed(client dynamic.ResourceInterface, trigger schema.GroupVersionKind, options metav1.ListOptions, target metav1.ObjectMeta) {
 	log := log.Log
 
-	events, err := client.Watch(context.TODO(), options)
+	events, err := client.Watch(dw.ctx, options)
 
 	if err != nil {
 		log.WithValues("kind", trigger.String()).WithValues("namespace", target.Namespace).WithValues("labels", options.LabelSelector).Error(err, "adding watch to dynamic client")
@@ -0,0 +1,336 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+const (
+	// PlanAnnotation holds the JSON encoded Plan awaiting approval on the DeclarativeObject
+	PlanAnnotation = "addons.k8s.io/plan"
+	// PlanHashAnnotation holds the hash of the Plan awaiting approval on the DeclarativeObject
+	PlanHashAnnotation = "addons.k8s.io/plan-hash"
+	// ApprovedPlanAnnotation is set by a user to the hash of the plan they approve
+	ApprovedPlanAnnotation = "addons.k8s.io/approved-plan"
+)
+
+// Plan describes the changes an apply would make to the cluster
+type Plan struct {
+	// Hash identifies the desired state the plan was computed for
+	Hash string `json:"hash"`
+
+	Added   []ObjectRef `json:"added,omitempty"`
+	Changed []ObjectRef `json:"changed,omitempty"`
+	Pruned  []ObjectRef `json:"pruned,omitempty"`
+}
+
+// ObjectRef identifies an object in a Plan
+type ObjectRef struct {
+	Group     string `json:"group,omitempty"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+}
+
+// IsEmpty returns true if applying the plan would not change anything
+func (p *Plan) IsEmpty() bool {
+	return len(p.Added) == 0 && len(p.Changed) == 0 && len(p.Pruned) == 0
+}
+
+// buildPlan diffs objects against the live cluster.  Pruned objects are only computed when
+// WithApplyPrune is set, and only for the kinds that are present in objects, or when
+// WithInventoryPrune is set, from the inventory.
+func (r *Reconciler) buildPlan(ctx context.Context, instance DeclarativeObject, objects *manifest.Objects, defaultNamespace string) (*Plan, error) {
+	plan := &Plan{}
+
+	desired := map[ObjectRef]bool{}
+	for _, obj := range objects.Items {
+		ref := ObjectRef{Group: obj.Group, Kind: obj.Kind, Namespace: obj.Namespace, Name: obj.Name}
+		live, err := r.getLiveObject(ctx, obj, defaultNamespace)
+		if meta.IsNoMatchError(err) {
+			// The kind is defined by a CustomResourceDefinition that is not yet applied
+			plan.Added = append(plan.Added, ref)
+			desired[ref] = true
+			continue
+		}
+		if err != nil {
+			if !apierrors.IsNotFound(err) {
+				return nil, fmt.Errorf("unable to get %s %s: %v", obj.Kind, obj.Name, err)
+			}
+			plan.Added = append(plan.Added, ref)
+		} else {
+			ref.Namespace = live.GetNamespace()
+			if _, ok := live.GetAnnotations()["addons.k8s.io/ignore"]; ok {
+				// Will not be applied, but must not be pruned either
+				desired[ref] = true
+				continue
+			}
+			// Ignored fields take their live values, so they never count as changed
+			compared, err := preserveIgnoredFields(obj, live)
+			if err != nil {
+				return nil, err
+			}
+			if !isObjectSubset(compared.UnstructuredObject().Object, live.Object) {
+				plan.Changed = append(plan.Changed, ref)
+			}
+		}
+		desired[ref] = true
+	}
+
+	if r.options.prune {
+		pruned, err := r.listPrunable(ctx, instance, uniqueGroupVersionKind(objects), desired, defaultNamespace)
+		if err != nil {
+			return nil, err
+		}
+		plan.Pruned = append(plan.Pruned, pruned...)
+	}
+
+	if r.options.inventoryPrune {
+		previous, err := r.loadInventory(ctx, instance)
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range previous {
+			if !desired[ref] && !desiredWithoutNamespace(desired, ref) {
+				plan.Pruned = append(plan.Pruned, ref)
+			}
+		}
+	}
+
+	hash, err := planHash(objects, plan.Pruned)
+	if err != nil {
+		return nil, err
+	}
+	plan.Hash = hash
+	return plan, nil
+}
+
+// listPrunable lists the objects of the given kinds that have the labels of the LabelMaker, as
+// kubectl apply --prune does, but are not desired.  As with kubectl, namespaced kinds are only
+// listed in the namespaces of the desired objects (and defaultNamespace), so that the objects of
+// a DeclarativeObject with the same name in another namespace are not pruned.  Kinds that the
+// RESTMapper cannot resolve have no objects yet and are skipped, and objects recording another
+// owner with the OwnerAnnotation are left alone.
+func (r *Reconciler) listPrunable(ctx context.Context, instance DeclarativeObject, gvks []schema.GroupVersionKind, desired map[ObjectRef]bool, defaultNamespace string) ([]ObjectRef, error) {
+	ownerGVK, err := apiutil.GVKForObject(instance, r.mgr.GetScheme())
+	if err != nil {
+		return nil, err
+	}
+	owner := ownerString(ownerGVK, instance.GetNamespace(), instance.GetName())
+
+	namespaces := map[string]bool{}
+	if defaultNamespace != "" {
+		namespaces[defaultNamespace] = true
+	}
+	for ref := range desired {
+		if ref.Namespace != "" {
+			namespaces[ref.Namespace] = true
+		}
+	}
+
+	var pruned []ObjectRef
+	selector := labels.SelectorFromSet(r.options.labelMaker(ctx, instance)).String()
+	for _, gvk := range gvks {
+		mapping, err := r.restMapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if meta.IsNoMatchError(err) {
+			// No objects of the kind can exist yet
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to get mapping for %v: %v", gvk, err)
+		}
+
+		var items []unstructured.Unstructured
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			for ns := range namespaces {
+				list, err := r.dynamicClient.Resource(mapping.Resource).Namespace(ns).List(ctx, metav1.ListOptions{LabelSelector: selector})
+				if err != nil {
+					return nil, fmt.Errorf("unable to list %v in namespace %s: %v", gvk, ns, err)
+				}
+				items = append(items, list.Items...)
+			}
+		} else {
+			list, err := r.dynamicClient.Resource(mapping.Resource).List(ctx, metav1.ListOptions{LabelSelector: selector})
+			if err != nil {
+				return nil, fmt.Errorf("unable to list %v: %v", gvk, err)
+			}
+			items = list.Items
+		}
+
+		for _, item := range items {
+			if o, ok := item.GetAnnotations()[OwnerAnnotation]; ok && o != owner {
+				continue
+			}
+			ref := ObjectRef{Group: gvk.Group, Kind: gvk.Kind, Name: item.GetName()}
+			if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+				ref.Namespace = item.GetNamespace()
+			}
+			if !desired[ref] && !desiredWithoutNamespace(desired, ref) {
+				pruned = append(pruned, ref)
+			}
+		}
+	}
+	return pruned, nil
+}
+
+// desiredWithoutNamespace handles desired objects that did not exist yet, and so were
+// recorded without the namespace they would be created in
+func desiredWithoutNamespace(desired map[ObjectRef]bool, ref ObjectRef) bool {
+	ref.Namespace = ""
+	return desired[ref]
+}
+
+// planHash hashes the desired objects and the objects to prune, so that an approval
+// only covers exactly the state that was reviewed
+func planHash(objects *manifest.Objects, pruned []ObjectRef) (string, error) {
+	m, err := objects.JSONManifest()
+	if err != nil {
+		return "", fmt.Errorf("error creating manifest: %v", err)
+	}
+
+	sorted := append([]ObjectRef(nil), pruned...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return fmt.Sprintf("%v", sorted[i]) < fmt.Sprintf("%v", sorted[j])
+	})
+	p, err := json.Marshal(sorted)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write([]byte(m))
+	h.Write(p)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// reconcilePlan decides whether the objects may be applied.  If the plan has changes that have
+// not been approved, the plan is recorded on the DeclarativeObject and false is returned.
+func (r *Reconciler) reconcilePlan(ctx context.Context, instance DeclarativeObject, objects *manifest.Objects, defaultNamespace string) (bool, error) {
+	plan, err := r.buildPlan(ctx, instance, objects, defaultNamespace)
+	if err != nil {
+		return false, err
+	}
+
+	annotations := instance.GetAnnotations()
+	if plan.IsEmpty() || annotations[ApprovedPlanAnnotation] == plan.Hash {
+		if _, found := annotations[PlanAnnotation]; found {
+			delete(annotations, PlanAnnotation)
+			delete(annotations, PlanHashAnnotation)
+			instance.SetAnnotations(annotations)
+			if err := r.client.Update(ctx, instance); err != nil {
+				return false, fmt.Errorf("error clearing plan: %v", err)
+			}
+		}
+		return true, nil
+	}
+
+	if annotations[PlanHashAnnotation] == plan.Hash {
+		// Already recorded, still waiting for approval
+		return false, nil
+	}
+
+	b, err := json.Marshal(plan)
+	if err != nil {
+		return false, fmt.Errorf("error encoding plan: %v", err)
+	}
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[PlanAnnotation] = string(b)
+	annotations[PlanHashAnnotation] = plan.Hash
+	instance.SetAnnotations(annotations)
+	if err := r.client.Update(ctx, instance); err != nil {
+		return false, fmt.Errorf("error recording plan: %v", err)
+	}
+
+	r.recorder.Eventf(instance, "Normal", "PlanPending",
+		"%d objects to add, %d to change, %d to prune; set annotation %s=%s to apply",
+		len(plan.Added), len(plan.Changed), len(plan.Pruned), ApprovedPlanAnnotation, plan.Hash)
+	return false, nil
+}
+
+// isObjectSubset returns true if every field set in the desired object has the same value in
+// the live object, as isSubset.  The status of the object is set by its controllers so is not
+// compared, but fields named status elsewhere in the object, e.g. in a spec, are.
+func isObjectSubset(desired, live map[string]interface{}) bool {
+	for k, v := range desired {
+		if k == "status" {
+			continue
+		}
+		if !isSubset(map[string]interface{}{k: v}, live) {
+			return false
+		}
+	}
+	return true
+}
+
+// isSubset returns true if every field set in desired has the same value in live.  Fields
+// that are defaulted or set by the server therefore do not count as changes.
+func isSubset(desired, live interface{}) bool {
+	switch d := desired.(type) {
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, v := range d {
+			lv, found := l[k]
+			if !found {
+				if v == nil {
+					continue
+				}
+				return false
+			}
+			if !isSubset(v, lv) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok || len(l) != len(d) {
+			return false
+		}
+		for i := range d {
+			if !isSubset(d[i], l[i]) {
+				return false
+			}
+		}
+		return true
+	case int64, float64:
+		// json numbers may be decoded as either
+		return fmt.Sprintf("%v", d) == fmt.Sprintf("%v", live)
+	default:
+		return reflect.DeepEqual(desired, live)
+	}
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+func Test_isObjectSubset(t *testing.T) {
+	live := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"name":            "frontend",
+			"resourceVersion": "123",
+		},
+		"spec": map[string]interface{}{
+			"replicas": int64(3),
+			"ports": []interface{}{
+				map[string]interface{}{"port": int64(80), "protocol": "TCP"},
+			},
+		},
+		"status": map[string]interface{}{
+			"readyReplicas": int64(3),
+		},
+	}
+	live["spec"].(map[string]interface{})["template"] = map[string]interface{}{
+		"status": map[string]interface{}{"phase": "Running"},
+	}
+
+	tests := []struct {
+		name    string
+		desired map[string]interface{}
+		want    bool
+	}{
+		{
+			name: "fields set by the server are ignored",
+			desired: map[string]interface{}{
+				"metadata": map[string]interface{}{"name": "frontend"},
+				"spec": map[string]interface{}{
+					"replicas": float64(3),
+					"ports": []interface{}{
+						map[string]interface{}{"port": int64(80)},
+					},
+				},
+			},
+			want: true,
+		},
+		{
+			name: "status is ignored",
+			desired: map[string]interface{}{
+				"status": map[string]interface{}{"readyReplicas": int64(1)},
+			},
+			want: true,
+		},
+		{
+			name: "status of the spec is compared",
+			desired: map[string]interface{}{
+				"spec": map[string]interface{}{
+					"template": map[string]interface{}{
+						"status": map[string]interface{}{"phase": "Pending"},
+					},
+				},
+			},
+			want: false,
+		},
+		{
+			name: "unchanged status of the spec",
+			desired: map[string]interface{}{
+				"spec": map[string]interface{}{
+					"template": map[string]interface{}{
+						"status": map[string]interface{}{"phase": "Running"},
+					},
+				},
+			},
+			want: true,
+		},
+		{
+			name: "changed scalar",
+			desired: map[string]interface{}{
+				"spec": map[string]interface{}{"replicas": int64(2)},
+			},
+			want: false,
+		},
+		{
+			name: "missing field",
+			desired: map[string]interface{}{
+				"spec": map[string]interface{}{"paused": true},
+			},
+			want: false,
+		},
+		{
+			name: "list length differs",
+			desired: map[string]interface{}{
+				"spec": map[string]interface{}{
+					"ports": []interface{}{
+						map[string]interface{}{"port": int64(80)},
+						map[string]interface{}{"port": int64(443)},
+					},
+				},
+			},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isObjectSubset(tt.desired, live))
+		})
+	}
+}
+
+func Test_buildPlanIgnoredFields(t *testing.T) {
+	ctx := context.Background()
+	instance := newTestInstance("ns", "guestbook", "uid-1")
+
+	scaled := &unstructured.Unstructured{}
+	scaled.SetAPIVersion("apps/v1")
+	scaled.SetKind("Deployment")
+	scaled.SetNamespace("ns")
+	scaled.SetName("frontend")
+	scaled.SetAnnotations(map[string]string{IgnoreFieldsAnnotation: "spec.replicas"})
+	assert.NoError(t, unstructured.SetNestedField(scaled.Object, int64(5), "spec", "replicas"))
+	assert.NoError(t, unstructured.SetNestedField(scaled.Object, "frontend", "spec", "serviceName"))
+
+	r, _, _ := newTestReconciler(t, scaled)
+	objectsWith := func(serviceName string) *manifest.Objects {
+		objects, err := manifest.ParseObjects(ctx, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: frontend
+spec:
+  replicas: 1
+  serviceName: `+serviceName)
+		assert.NoError(t, err)
+		return objects
+	}
+
+	// A user-managed field with another live value is not a change
+	plan, err := r.buildPlan(ctx, instance, objectsWith("frontend"), "ns")
+	assert.NoError(t, err)
+	assert.True(t, plan.IsEmpty(), "%+v", plan)
+
+	plan, err = r.buildPlan(ctx, instance, objectsWith("backend"), "ns")
+	assert.NoError(t, err)
+	assert.Equal(t, []ObjectRef{{Group: "apps", Kind: "Deployment", Namespace: "ns", Name: "frontend"}}, plan.Changed)
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+// AllowPruneAnnotation is set by a user on the DeclarativeObject to the hash reported when a
+// prune exceeds the WithPruneThreshold limits, to allow that prune
+const AllowPruneAnnotation = "addons.k8s.io/allow-prune"
+
+// kubectlPruneKinds are the kinds that kubectl apply --prune deletes when no --prune-whitelist is given
+var kubectlPruneKinds = []schema.GroupVersionKind{
+	{Version: "v1", Kind: "ConfigMap"},
+	{Version: "v1", Kind: "Endpoints"},
+	{Version: "v1", Kind: "Namespace"},
+	{Version: "v1", Kind: "PersistentVolumeClaim"},
+	{Version: "v1", Kind: "PersistentVolume"},
+	{Version: "v1", Kind: "Pod"},
+	{Version: "v1", Kind: "ReplicationController"},
+	{Version: "v1", Kind: "Secret"},
+	{Version: "v1", Kind: "Service"},
+	{Group: "batch", Version: "v1", Kind: "Job"},
+	{Group: "batch", Version: "v1beta1", Kind: "CronJob"},
+	{Group: "networking.k8s.io", Version: "v1", Kind: "Ingress"},
+	{Group: "apps", Version: "v1", Kind: "DaemonSet"},
+	{Group: "apps", Version: "v1", Kind: "Deployment"},
+	{Group: "apps", Version: "v1", Kind: "ReplicaSet"},
+	{Group: "apps", Version: "v1", Kind: "StatefulSet"},
+}
+
+// exceedsPruneThreshold reports whether pruning pruned objects while keeping kept objects goes
+// beyond maxPercent of the objects, or beyond maxCount objects.  A limit of 0 is not checked.
+func exceedsPruneThreshold(pruned, kept, maxPercent, maxCount int) bool {
+	if pruned == 0 {
+		return false
+	}
+	if maxCount > 0 && pruned > maxCount {
+		return true
+	}
+	if maxPercent > 0 && pruned*100 > maxPercent*(pruned+kept) {
+		return true
+	}
+	return false
+}
+
+// pruneCandidates returns the objects that the next prune would delete, and the number of
+// objects it would keep.  inventory is the new inventory, with WithInventoryPrune.  With
+// WithApplyPrune these are the objects of kubectlPruneKinds that have the labels of the
+// LabelMaker in the namespaces of the objects, whatever the kinds in the manifest, as that is
+// what kubectl prunes.
+func (r *Reconciler) pruneCandidates(ctx context.Context, instance DeclarativeObject, objects *manifest.Objects, inventory map[ObjectRef]bool, defaultNamespace string) ([]ObjectRef, int, error) {
+	if r.options.inventoryPrune {
+		previous, err := r.loadInventory(ctx, instance)
+		if err != nil {
+			return nil, 0, err
+		}
+		var pruned []ObjectRef
+		for _, ref := range previous {
+			if !inventory[ref] {
+				pruned = append(pruned, ref)
+			}
+		}
+		return pruned, len(inventory), nil
+	}
+
+	desired, err := r.inventoryRefs(objects, defaultNamespace)
+	if err != nil {
+		return nil, 0, err
+	}
+	pruned, err := r.listPrunable(ctx, instance, kubectlPruneKinds, desired, defaultNamespace)
+	if err != nil {
+		return nil, 0, err
+	}
+	return pruned, len(desired), nil
+}
+
+// checkPruneThreshold reports whether the objects may be pruned.  If the prune would exceed the
+// WithPruneThreshold limits, and has not been allowed with the AllowPruneAnnotation, it is blocked
+// and reported in a PruneBlocked event and through the optional PruneBlocked interface of the Status.
+func (r *Reconciler) checkPruneThreshold(ctx context.Context, instance DeclarativeObject, objects *manifest.Objects, inventory map[ObjectRef]bool, defaultNamespace string) (bool, error) {
+	log := log.Log.WithValues("object", instance.GetNamespace()+"/"+instance.GetName())
+
+	pruned, kept, err := r.pruneCandidates(ctx, instance, objects, inventory, defaultNamespace)
+	if err != nil {
+		return false, err
+	}
+
+	var blocked []ObjectRef
+	hash := ""
+	if exceedsPruneThreshold(len(pruned), kept, r.options.pruneMaxPercent, r.options.pruneMaxCount) {
+		if hash, err = pruneHash(pruned); err != nil {
+			return false, err
+		}
+		if instance.GetAnnotations()[AllowPruneAnnotation] != hash {
+			blocked = pruned
+		}
+	}
+
+	if len(blocked) != 0 {
+		var names []string
+		for _, ref := range blocked {
+			names = append(names, ref.Kind+" "+ref.Name)
+		}
+		log.WithValues("pruned", len(blocked)).WithValues("kept", kept).Info("prune exceeds threshold, not pruning")
+		r.recordEvent(instance, "Warning", "PruneBlocked", fmt.Sprintf("refusing to prune %d objects and keep only %d: %s; set annotation %s=%s to prune them",
+			len(blocked), kept, summarizeNames(names), AllowPruneAnnotation, hash))
+	}
+
+	if r.options.status != nil {
+		if p, ok := r.options.status.(PruneBlocked); ok {
+			if err := p.PruneBlocked(ctx, instance, blocked, hash); err != nil {
+				log.Error(err, "failed to report blocked prune")
+			}
+		}
+	}
+	return len(blocked) == 0, nil
+}
+
+// pruneHash identifies a set of objects to prune, so that allowing a prune does not carry over
+// to a different one
+func pruneHash(pruned []ObjectRef) (string, error) {
+	sorted := append([]ObjectRef(nil), pruned...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return fmt.Sprintf("%v", sorted[i]) < fmt.Sprintf("%v", sorted[j])
+	})
+	b, err := json.Marshal(sorted)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
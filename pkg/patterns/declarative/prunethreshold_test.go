@@ -0,0 +1,99 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func Test_exceedsPruneThreshold(t *testing.T) {
+	tests := []struct {
+		name       string
+		pruned     int
+		kept       int
+		maxPercent int
+		maxCount   int
+		want       bool
+	}{
+		{name: "nothing to prune", pruned: 0, kept: 0, maxPercent: 10, maxCount: 1, want: false},
+		{name: "within percentage", pruned: 1, kept: 9, maxPercent: 10, want: false},
+		{name: "above percentage", pruned: 2, kept: 9, maxPercent: 10, want: true},
+		{name: "empty manifest", pruned: 5, kept: 0, maxPercent: 50, want: true},
+		{name: "within count", pruned: 3, kept: 0, maxCount: 3, want: false},
+		{name: "above count", pruned: 4, kept: 100, maxCount: 3, want: true},
+		{name: "no limits", pruned: 10, kept: 0, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, exceedsPruneThreshold(tt.pruned, tt.kept, tt.maxPercent, tt.maxCount))
+		})
+	}
+}
+
+func Test_pruneHash(t *testing.T) {
+	a := ObjectRef{Kind: "ConfigMap", Namespace: "ns", Name: "a"}
+	b := ObjectRef{Group: "apps", Kind: "Deployment", Namespace: "ns", Name: "b"}
+
+	ab, err := pruneHash([]ObjectRef{a, b})
+	assert.NoError(t, err)
+	ba, err := pruneHash([]ObjectRef{b, a})
+	assert.NoError(t, err)
+	assert.Equal(t, ab, ba)
+
+	onlyA, err := pruneHash([]ObjectRef{a})
+	assert.NoError(t, err)
+	assert.NotEqual(t, ab, onlyA)
+}
+
+func Test_listPrunable(t *testing.T) {
+	labeled := func(u *unstructured.Unstructured) *unstructured.Unstructured {
+		labels := u.GetLabels()
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels["addons.example.org/guestbook"] = "guestbook"
+		u.SetLabels(labels)
+		return u
+	}
+
+	r, _, _ := newTestReconciler(t,
+		labeled(newTestConfigMap("ns1", "desired")),
+		labeled(newTestConfigMap("ns1", "stale")),
+		// Applied by the Guestbook with the same name in another namespace
+		labeled(newTestConfigMap("ns2", "stale")),
+		labeled(newTestClusterRole("stale", "addons.example.org/v1alpha1/Guestbook/ns1/guestbook", "1")),
+		labeled(newTestClusterRole("other", "addons.example.org/v1alpha1/Guestbook/ns2/guestbook", "2")),
+	)
+	r.options.labelMaker = func(context.Context, DeclarativeObject) map[string]string {
+		return map[string]string{"addons.example.org/guestbook": "guestbook"}
+	}
+
+	desired := map[ObjectRef]bool{{Kind: "ConfigMap", Namespace: "ns1", Name: "desired"}: true}
+	gvks := append([]schema.GroupVersionKind{{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "ClusterRole"}}, kubectlPruneKinds...)
+	pruned, err := r.listPrunable(context.Background(), newTestInstance("ns1", "guestbook", "1"), gvks, desired, "ns1")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []ObjectRef{
+		{Group: "rbac.authorization.k8s.io", Kind: "ClusterRole", Name: "stale"},
+		{Kind: "ConfigMap", Namespace: "ns1", Name: "stale"},
+	}, pruned)
+}
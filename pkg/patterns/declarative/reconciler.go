@@ -21,14 +21,17 @@ import (
 	"errors"
 	"fmt"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"k8s.io/apimachinery/pkg/api/meta"
 
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 
+	"go.opentelemetry.io/otel/trace"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/dynamic"
@@ -51,7 +54,7 @@ type Reconciler struct {
 	prototype DeclarativeObject
 	client    client.Client
 	config    *rest.Config
-	kubectl   kubectlClient
+	applier   applier.Applier
 
 	metrics reconcileMetrics
 	mgr     manager.Manager
@@ -62,10 +65,21 @@ type Reconciler struct {
 
 	restMapper meta.RESTMapper
 	options    reconcilerParams
-}
 
-type kubectlClient interface {
-	Apply(ctx context.Context, namespace string, manifest string, validate bool, args ...string) error
+	// waveBackoff, crdBackoff and hookBackoff delay the checks of apply waves, CustomResourceDefinitions
+	// and hooks respectively, so that waiting for one does not lengthen the wait for the others
+	waveBackoff      *waveBackoff
+	crdBackoff       *waveBackoff
+	hookBackoff      *waveBackoff
+	errorBackoff     *waveBackoff
+	appliedManifests *appliedManifests
+	objectCache      *objectCache
+	events           *eventLimiter
+	targetClusters   *targetClusters
+	ownerKinds       *ownerKinds
+
+	// target is the remote cluster that this Reconciler deploys objects to, see WithTargetCluster
+	target *targetCluster
 }
 
 type DeclarativeObject interface {
@@ -74,11 +88,12 @@ type DeclarativeObject interface {
 }
 
 // For mocking
-var kubectl = applier.NewDirectApplier()
+var newApplier = func(config *rest.Config, restMapper meta.RESTMapper) applier.Applier {
+	return applier.NewDirectApplierForConfig(config, restMapper)
+}
 
 func (r *Reconciler) Init(mgr manager.Manager, prototype DeclarativeObject, opts ...reconcilerOption) error {
 	r.prototype = prototype
-	r.kubectl = kubectl
 
 	// TODO: Can we derive the name from prototype?
 	controllerName := "addon-controller"
@@ -87,6 +102,14 @@ func (r *Reconciler) Init(mgr manager.Manager, prototype DeclarativeObject, opts
 	r.client = mgr.GetClient()
 	r.config = mgr.GetConfig()
 	r.mgr = mgr
+	r.waveBackoff = &waveBackoff{}
+	r.crdBackoff = &waveBackoff{}
+	r.hookBackoff = &waveBackoff{}
+	r.errorBackoff = &waveBackoff{}
+	r.appliedManifests = &appliedManifests{}
+	r.events = &eventLimiter{}
+	r.targetClusters = &targetClusters{}
+	r.ownerKinds = &ownerKinds{}
 	globalObjectTracker.mgr = mgr
 
 	d, err := dynamic.NewForConfig(r.config)
@@ -95,7 +118,9 @@ func (r *Reconciler) Init(mgr manager.Manager, prototype DeclarativeObject, opts
 	}
 	r.dynamicClient = d
 
-	r.restMapper = mgr.GetRESTMapper()
+	// Wrapped so that it can be refreshed once CustomResourceDefinitions we apply are established
+	r.restMapper = newResettableRESTMapper(mgr.GetRESTMapper(), r.config)
+	r.applier = newApplier(r.config, r.restMapper)
 
 	if err = r.applyOptions(opts...); err != nil {
 		return err
@@ -105,7 +130,56 @@ func (r *Reconciler) Init(mgr manager.Manager, prototype DeclarativeObject, opts
 		return err
 	}
 
+	if len(r.options.cachedKinds) != 0 {
+		r.objectCache = newObjectCache(r.dynamicClient, r.restMapper, r.options.cachedKinds)
+		if err := mgr.Add(r.objectCache); err != nil {
+			return err
+		}
+	}
+
+	if r.options.revisionHistoryLimit > 0 {
+		if err := r.requireNamespaced("WithRevisionHistory"); err != nil {
+			return err
+		}
+	}
+
+	if r.options.inventoryPrune {
+		if err := r.requireNamespaced("WithInventoryPrune"); err != nil {
+			return err
+		}
+	}
+
+	if r.options.serverSideApply {
+		if r.options.fieldManager == "" {
+			gvk, err := apiutil.GVKForObject(prototype, r.mgr.GetScheme())
+			if err != nil {
+				return err
+			}
+			r.options.fieldManager = strings.ToLower(gvk.Kind) + "-controller"
+		}
+		if r.applier, err = r.newApplierFor(r.config, r.restMapper); err != nil {
+			return err
+		}
+	}
+
+	if r.options.driftMode == DriftReportOnly {
+		if err := mgr.Add(&driftDetector{r: r, interval: r.options.driftInterval}); err != nil {
+			return err
+		}
+	}
+
+	// Objects that record their owner with the OwnerAnnotation are not garbage collected, so those
+	// of owners deleted while the operator was not running are deleted once it starts
+	if r.options.ownerFn != nil {
+		if err := mgr.Add(manager.RunnableFunc(r.collectOrphans)); err != nil {
+			return err
+		}
+	}
+
 	if r.CollectMetrics() {
+		if r.options.shard != nil {
+			globalObjectTracker.setShard(r.options.shard)
+		}
 		if gvk, err := apiutil.GVKForObject(prototype, r.mgr.GetScheme()); err != nil {
 			return err
 		} else {
@@ -121,47 +195,107 @@ func (r *Reconciler) Reconcile(ctx context.Context, request reconcile.Request) (
 	log := log.Log
 	defer r.collectMetrics(request, result, err)
 
+	ctx, span := r.startSpan(ctx, "Reconcile", NamespaceAttribute.String(request.Namespace), NameAttribute.String(request.Name))
+	defer func() { endSpan(span, err) }()
+	if gvk, err := apiutil.GVKForObject(r.prototype, r.mgr.GetScheme()); err == nil {
+		span.SetAttributes(GVKAttribute.String(gvkString(gvk)))
+	}
+
 	// Fetch the object
 	instance := r.prototype.DeepCopyObject().(DeclarativeObject)
 	if err = r.client.Get(ctx, request.NamespacedName, instance); err != nil {
 		if apierrors.IsNotFound(err) {
-			// Object not found, return.  Created objects are automatically garbage collected.
+			// Object not found, return.  Created objects are automatically garbage collected,
+			// apart from those that could not have an owner reference.
 			// For additional cleanup logic use finalizers.
+			if err := r.deleteOwned(ctx, request.NamespacedName); err != nil {
+				log.Error(err, "deleting objects of deleted owner")
+				return reconcile.Result{}, err
+			}
+			r.forgetDrift(request.NamespacedName)
+			r.targetClusters.forget(request.NamespacedName)
 			return reconcile.Result{}, nil
 		}
 		// Error reading the object - requeue the request.
 		log.Error(err, "error reading object")
 		return reconcile.Result{}, err
 	}
+	if !r.owns(instance) {
+		// Reconciled by another shard, e.g. the shard label changed since the event was queued
+		log.WithValues("object", request.NamespacedName.String()).V(1).Info("object is in another shard, skipping")
+		return reconcile.Result{}, nil
+	}
+
+	ctx, target, err := r.forTargetCluster(ctx, instance)
+	if err != nil {
+		log.Error(err, "connecting to target cluster")
+		return reconcile.Result{}, err
+	}
+	result, err = target.reconcileInstance(ctx, request.NamespacedName, instance)
+	return target.handleError(ctx, request.NamespacedName, instance, result, err)
+}
+
+// reconcileInstance reconciles instance, which has been read from the cluster
+func (r *Reconciler) reconcileInstance(ctx context.Context, name types.NamespacedName, instance DeclarativeObject) (reconcile.Result, error) {
+	log := log.Log
+
+	if r.options.finalizer != "" {
+		if instance.GetDeletionTimestamp() != nil {
+			return r.reconcileDelete(ctx, name, instance)
+		}
+		if err := r.reconcileFinalizer(ctx, instance); err != nil {
+			log.Error(err, "adding finalizer")
+			return reconcile.Result{}, err
+		}
+	}
+
+	paused, err := IsPaused(instance)
+	if err != nil {
+		log.Error(err, "checking if paused")
+		return reconcile.Result{}, err
+	}
+	if r.options.status != nil {
+		if pausedStatus, ok := r.options.status.(Paused); ok {
+			if err := pausedStatus.Paused(ctx, instance, paused); err != nil {
+				log.Error(err, "failed to report paused status")
+			}
+		}
+	}
+	if paused {
+		r.recordEvent(instance, "Normal", "Paused", "Reconciliation is paused by the "+PausedAnnotation+" annotation or spec.paused")
+		log.WithValues("object", name.String()).Info("reconciliation is paused, skipping")
+		return reconcile.Result{}, nil
+	}
 
 	if r.options.status != nil {
-		if err := r.options.status.Preflight(ctx, instance); err != nil {
+		preflightCtx, preflightSpan := r.startSpan(ctx, "preflight")
+		err := r.options.status.Preflight(preflightCtx, instance)
+		endSpan(preflightSpan, err)
+		if err != nil {
 			log.Error(err, "preflight check failed, not reconciling")
-			return reconcile.Result{}, err
+			return reconcile.Result{}, classified(err, func(err error) ReconcileError {
+				return &StatusError{Err: err, Retryable: true}
+			})
 		}
 	}
 
-	return r.reconcileExists(ctx, request.NamespacedName, instance)
+	return r.reconcileExists(ctx, name, instance)
 }
 
 func (r *Reconciler) reconcileExists(ctx context.Context, name types.NamespacedName, instance DeclarativeObject) (reconcile.Result, error) {
 	log := log.Log
 	log.WithValues("object", name.String()).Info("reconciling")
 
-	var fs filesys.FileSystem
-	if r.IsKustomizeOptionUsed() {
-		fs = filesys.MakeFsInMemory()
-	}
-
-	objects, err := r.BuildDeploymentObjectsWithFs(ctx, name, instance, fs)
+	desired, err := r.buildDesired(ctx, name, instance)
 	if err != nil {
-		log.Error(err, "building deployment objects")
-		return reconcile.Result{}, fmt.Errorf("error building deployment objects: %v", err)
+		return reconcile.Result{}, err
 	}
-	log.WithValues("objects", fmt.Sprintf("%d", len(objects.Items))).Info("built deployment objects")
+	objects, hooks, desiredHash, rollbackTo := desired.objects, desired.hooks, desired.hash, desired.rollbackTo
 
 	if r.options.status != nil {
-		isValidVersion, err := r.options.status.VersionCheck(ctx, instance, objects)
+		versionCtx, versionSpan := r.startSpan(ctx, "versionCheck")
+		isValidVersion, err := r.options.status.VersionCheck(versionCtx, instance, objects)
+		endSpan(versionSpan, err)
 		if err != nil {
 			if !isValidVersion {
 				// r.client isn't exported so can't be updated in version check function
@@ -173,75 +307,97 @@ func (r *Reconciler) reconcileExists(ctx context.Context, name types.NamespacedN
 				return reconcile.Result{}, nil
 			}
 			log.Error(err, "Version check failed, trying to reconcile")
-			return reconcile.Result{}, err
+			return reconcile.Result{}, classified(err, func(err error) ReconcileError {
+				return &StatusError{Err: err, Retryable: true}
+			})
 		}
 	}
 
 	defer func() {
 		if r.options.status != nil {
-			if err := r.options.status.Reconciled(ctx, instance, objects); err != nil {
+			statusCtx, statusSpan := r.startSpan(ctx, "status", ObjectsAttribute.Int(len(objects.Items)))
+			err := r.options.status.Reconciled(statusCtx, instance, objects)
+			endSpan(statusSpan, err)
+			if err != nil {
 				log.Error(err, "failed to reconcile status")
 			}
 		}
 	}()
 
-	objects, err = parseListKind(objects)
+	// Recorded before applying, so that the objects are found once instance is deleted
+	if err := r.recordOwnerKinds(ctx, instance, annotatedKinds(objects)); err != nil {
+		log.Error(err, "recording owner kinds")
+		return reconcile.Result{}, err
+	}
 
-	if err != nil {
-		log.Error(err, "Parsing list kind")
-		return reconcile.Result{}, fmt.Errorf("error parsing list kind: %v", err)
+	if r.options.skipUnchangedResync > 0 {
+		if resync, unchanged := r.unchanged(name, instance, desiredHash); unchanged {
+			log.WithValues("object", name.String()).WithValues("resync", resync.String()).Info("manifest is unchanged, skipping apply")
+			return reconcile.Result{RequeueAfter: resync}, nil
+		}
 	}
 
-	err = r.injectOwnerRef(ctx, instance, objects)
-	if err != nil {
-		return reconcile.Result{}, err
+	applyOptions := applier.ApplyOptions{
+		Validate: r.options.validate,
+		Force:    true,
+	}
+	if r.options.serverSideApply {
+		applyOptions.Force = r.options.forceConflicts
 	}
 
-	var newItems []*manifest.Object
-	for _, obj := range objects.Items {
+	if r.options.prune {
+		applyOptions.PruneSelector = labels.SelectorFromSet(r.options.labelMaker(ctx, instance)).String()
+	}
+
+	ns := ""
+	if !r.options.preserveNamespace {
+		ns = name.Namespace
+	}
 
-		unstruct, err := GetObjectFromCluster(obj, r)
-		if err != nil && !apierrors.IsNotFound(errors.Unwrap(err)) {
-			log.WithValues("name", obj.Name).Error(err, "Unable to get resource")
+	if r.options.planApproval {
+		approved, err := r.reconcilePlan(ctx, instance, objects, ns)
+		if err != nil {
+			log.Error(err, "building plan")
+			return reconcile.Result{}, fmt.Errorf("error building plan: %v", err)
 		}
-		if unstruct != nil {
-			annotations := unstruct.GetAnnotations()
-			if _, ok := annotations["addons.k8s.io/ignore"]; ok {
-				log.WithValues("kind", obj.Kind).WithValues("name", obj.Name).Info("Found ignore annotation on object, " +
-					"skipping object")
-				continue
-			}
+		if !approved {
+			log.WithValues("object", name.String()).Info("plan is waiting for approval, not applying")
+			return reconcile.Result{}, nil
 		}
-		newItems = append(newItems, obj)
 	}
-	objects.Items = newItems
-
-	var manifestStr string
 
-	m, err := objects.JSONManifest()
-	if err != nil {
-		log.Error(err, "creating final manifest")
-		return reconcile.Result{}, fmt.Errorf("error creating manifest: %v", err)
+	var inventory map[ObjectRef]bool
+	if r.options.inventoryPrune {
+		if inventory, err = r.inventoryRefs(objects, ns); err != nil {
+			log.Error(err, "building inventory")
+			return reconcile.Result{}, err
+		}
 	}
-	manifestStr = m
 
-	extraArgs := []string{"--force"}
-
-	if r.options.prune {
-		var labels []string
-		for k, v := range r.options.labelMaker(ctx, instance) {
-			labels = append(labels, fmt.Sprintf("%s=%s", k, v))
-		}
+	// Revisions record the manifest, not the live values of ignored fields, so that a rollback
+	// does not restore stale values and changes to those fields do not make new revisions
+	manifestObjects := &manifest.Objects{Items: append([]*manifest.Object(nil), objects.Items...)}
 
-		extraArgs = append(extraArgs, "--prune", "--selector", strings.Join(labels, ","))
+	conflicts, err := r.selectObjects(ctx, instance, objects, inventory, ns)
+	if err != nil {
+		return reconcile.Result{}, err
 	}
+	r.reportConflicts(ctx, instance, conflicts)
 
-	ns := ""
-	if !r.options.preserveNamespace {
-		ns = name.Namespace
+	established, err := r.reconcileCRDs(ctx, instance, objects, applyOptions)
+	if err != nil {
+		log.Error(err, "reconciling CustomResourceDefinitions")
+		return reconcile.Result{}, err
+	}
+	if !established {
+		delay := r.crdBackoff.next(name)
+		log.WithValues("delay", delay.String()).Info("CustomResourceDefinitions are not established, requeueing")
+		return reconcile.Result{RequeueAfter: delay}, nil
 	}
+	r.crdBackoff.reset(name)
 
-	if r.CollectMetrics() {
+	// The ObjectTracker watches the local cluster
+	if r.CollectMetrics() && r.target == nil {
 		if errs := globalObjectTracker.addIfNotPresent(objects.Items, ns); errs != nil {
 			for _, err := range errs.Errors() {
 				if errors.Is(err, noRESTMapperErr{}) {
@@ -256,9 +412,163 @@ func (r *Reconciler) reconcileExists(ctx context.Context, name types.NamespacedN
 		}
 	}
 
-	if err := r.kubectl.Apply(ctx, ns, manifestStr, r.options.validate, extraArgs...); err != nil {
-		log.Error(err, "applying manifest")
-		return reconcile.Result{}, fmt.Errorf("error applying manifest: %v", err)
+	if r.options.driftMode == DriftAutoCorrect {
+		drifted, err := r.detectDrift(ctx, name, instance, objects, desiredHash, ns)
+		if err != nil {
+			log.Error(err, "detecting drift")
+		} else {
+			r.reportDrift(ctx, instance, drifted)
+		}
+	}
+
+	prune := true
+	if (r.options.prune || r.options.inventoryPrune) && (r.options.pruneMaxPercent > 0 || r.options.pruneMaxCount > 0) {
+		prune, err = r.checkPruneThreshold(ctx, instance, objects, inventory, ns)
+		if err != nil {
+			log.Error(err, "checking prune threshold")
+			return reconcile.Result{}, fmt.Errorf("error checking prune threshold: %v", err)
+		}
+		if !prune {
+			applyOptions.PruneSelector = ""
+		}
+	}
+
+	applyOptions.Namespace = ns
+
+	// The applied hash is only recorded once there are hooks, unchanged manifests are skipped or
+	// drift is detected, so that other manifests are applied without writing to the DeclarativeObject
+	_, recorded := instance.GetAnnotations()[AppliedHashAnnotation]
+	recordHash := len(hooks) != 0 || recorded || r.options.skipUnchangedResync > 0 || r.options.driftMode != ""
+	preHooks, postHooks := hookPhasesFor(instance, desiredHash)
+	if recordHash && preHooks != "" {
+		done, err := r.runHooks(ctx, instance, hooks, preHooks, desiredHash, ns, applyOptions)
+		if err != nil {
+			log.Error(err, "running hooks")
+			return reconcile.Result{}, fmt.Errorf("error running %s hooks: %v", preHooks, err)
+		}
+		if !done {
+			delay := r.hookBackoff.next(name)
+			log.WithValues("phase", preHooks).WithValues("delay", delay.String()).Info("hooks have not completed, requeueing")
+			return reconcile.Result{RequeueAfter: delay}, nil
+		}
+		r.hookBackoff.reset(name)
+	}
+
+	waves := []applyWave{{objects: objects, added: objects.Items}}
+	if r.options.applyWaves {
+		waves, err = buildWaves(objects)
+		if err != nil {
+			log.Error(err, "building apply waves")
+			return reconcile.Result{}, fmt.Errorf("error building apply waves: %v", err)
+		}
+	}
+
+	for i, wave := range waves {
+		last := i == len(waves)-1
+
+		waveOptions := applyOptions
+		if !last {
+			// Prune only once the whole manifest is applied
+			waveOptions.PruneSelector = ""
+		}
+
+		applyCtx, applySpan := r.startSpan(ctx, "apply", WaveAttribute.Int(wave.wave), ObjectsAttribute.Int(len(wave.objects.Items)))
+		result, err := r.applier.Apply(applyCtx, wave.objects, waveOptions)
+		endSpan(applySpan, err)
+		r.recordApplyEvents(instance, result)
+		if err != nil {
+			for _, failed := range result.Filter(applier.OperationFailed) {
+				log.WithValues("kind", failed.Kind).WithValues("namespace", failed.Namespace).WithValues("name", failed.Name).Error(failed.Error, "applying object")
+			}
+			log.WithValues("wave", wave.wave).Error(err, "applying manifest")
+			if r.options.rollbackDeadline > 0 && rollbackTo == 0 {
+				if _, hash, hashErr := manifestHash(manifestObjects); hashErr == nil {
+					if rollbackErr := r.rollback(ctx, instance, hash, fmt.Sprintf("apply failed: %v", err)); rollbackErr != nil {
+						log.Error(rollbackErr, "rolling back")
+					}
+				}
+			}
+			return reconcile.Result{}, applyError(result, err)
+		}
+		log.WithValues("wave", wave.wave).
+			WithValues("created", result.Count(applier.OperationCreated)).
+			WithValues("configured", result.Count(applier.OperationConfigured)).
+			WithValues("unchanged", result.Count(applier.OperationUnchanged)).
+			WithValues("pruned", result.Count(applier.OperationPruned)).
+			Info("applied manifest")
+
+		if last {
+			if r.options.inventoryPrune {
+				if err := r.reconcileInventory(ctx, instance, inventory, prune); err != nil {
+					log.Error(err, "pruning inventory")
+					return reconcile.Result{}, err
+				}
+			}
+			break
+		}
+
+		ready, err := r.waveReady(ctx, wave, ns)
+		if err != nil {
+			log.WithValues("wave", wave.wave).Error(err, "checking apply wave")
+			return reconcile.Result{}, fmt.Errorf("error checking apply wave %d: %v", wave.wave, err)
+		}
+		if !ready {
+			delay := r.waveBackoff.next(name)
+			log.WithValues("wave", wave.wave).WithValues("delay", delay.String()).Info("apply wave is not ready, requeueing")
+			return reconcile.Result{RequeueAfter: delay}, nil
+		}
+	}
+	if recordHash && postHooks != "" {
+		done, err := r.runHooks(ctx, instance, hooks, postHooks, desiredHash, ns, applyOptions)
+		if err != nil {
+			log.Error(err, "running hooks")
+			return reconcile.Result{}, fmt.Errorf("error running %s hooks: %v", postHooks, err)
+		}
+		if !done {
+			delay := r.hookBackoff.next(name)
+			log.WithValues("phase", postHooks).WithValues("delay", delay.String()).Info("hooks have not completed, requeueing")
+			return reconcile.Result{RequeueAfter: delay}, nil
+		}
+		r.hookBackoff.reset(name)
+	}
+	if recordHash {
+		applied := map[string]string{AppliedHashAnnotation: desiredHash}
+		if r.options.skipUnchangedResync > 0 {
+			applied[AppliedGenerationAnnotation] = strconv.FormatInt(instance.GetGeneration(), 10)
+		}
+		if err := r.setAnnotations(ctx, instance, applied); err != nil {
+			log.Error(err, "recording applied manifest")
+			return reconcile.Result{}, err
+		}
+	}
+	r.waveBackoff.reset(name)
+	r.appliedManifests.set(name, desiredHash)
+
+	var rolloutResult reconcile.Result
+	if r.options.revisionHistoryLimit > 0 {
+		revision := rollbackTo
+		if revision == 0 {
+			revision, err = r.recordRevision(ctx, instance, manifestObjects)
+			if err != nil {
+				log.Error(err, "recording revision")
+				return reconcile.Result{}, err
+			}
+		}
+		if r.options.status != nil {
+			if revisioned, ok := r.options.status.(Revisioned); ok {
+				if err := revisioned.Revisioned(ctx, instance, revision); err != nil {
+					log.Error(err, "failed to report revision")
+				}
+			}
+		}
+
+		if r.options.rollbackDeadline > 0 && rollbackTo == 0 {
+			rolloutResult, err = r.checkRollout(ctx, instance, objects, ns, revision)
+			if err != nil {
+				log.Error(err, "checking rollout")
+				return reconcile.Result{}, err
+			}
+		}
 	}
 
 	if r.options.sink != nil {
@@ -267,7 +577,145 @@ func (r *Reconciler) reconcileExists(ctx context.Context, name types.NamespacedN
 			return reconcile.Result{}, err
 		}
 	}
-	return reconcile.Result{}, nil
+	if r.options.driftMode == DriftAutoCorrect {
+		if rolloutResult.RequeueAfter == 0 || rolloutResult.RequeueAfter > r.options.driftInterval {
+			rolloutResult.RequeueAfter = r.options.driftInterval
+		}
+	}
+	return rolloutResult, nil
+}
+
+// desiredManifest is the manifest built for a DeclarativeObject, ready to be applied
+type desiredManifest struct {
+	// objects are the objects to apply, hooks excepted
+	objects *manifest.Objects
+	// hooks are the hooks of the manifest, which are run rather than applied
+	hooks []*manifest.Object
+	// hash is the hash of the manifest, hooks included, before shard labels are added
+	hash string
+	// rollbackTo is the revision applied instead of the built manifest, or 0
+	rollbackTo int64
+}
+
+// buildDesired builds the manifest of instance, or loads the revision it is rolled back to, and
+// prepares its objects as they are applied: List objects are expanded, owner references are set,
+// hooks are split out and shard labels are added.  It is shared by reconcileExists and drift
+// detection, so that drift is measured against what is applied.  The live objects are taken into
+// account by selectObjects.
+func (r *Reconciler) buildDesired(ctx context.Context, name types.NamespacedName, instance DeclarativeObject) (*desiredManifest, error) {
+	log := log.Log
+
+	var fs filesys.FileSystem
+	if r.IsKustomizeOptionUsed() {
+		fs = filesys.MakeFsInMemory()
+	}
+
+	rollbackTo, err := r.revisionToApply(instance)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects *manifest.Objects
+	if rollbackTo != 0 {
+		log.WithValues("object", name.String()).WithValues("revision", rollbackTo).Info("rolling back")
+		objects, err = r.loadRevision(ctx, instance, rollbackTo)
+		if err != nil {
+			log.Error(err, "loading revision")
+			return nil, &LoadError{Err: fmt.Errorf("error loading revision: %v", err), Retryable: true}
+		}
+	} else {
+		objects, err = r.BuildDeploymentObjectsWithFs(ctx, name, instance, fs)
+		if err != nil {
+			log.Error(err, "building deployment objects")
+			return nil, err
+		}
+	}
+	log.WithValues("objects", fmt.Sprintf("%d", len(objects.Items))).Info("built deployment objects")
+	trace.SpanFromContext(ctx).SetAttributes(ObjectsAttribute.Int(len(objects.Items)))
+
+	objects, err = parseListKind(objects)
+	if err != nil {
+		log.Error(err, "Parsing list kind")
+		return nil, &TransformError{Err: fmt.Errorf("error parsing list kind: %v", err)}
+	}
+
+	if err := r.injectOwnerRef(ctx, instance, objects); err != nil {
+		return nil, err
+	}
+
+	_, hash, err := manifestHash(objects)
+	if err != nil {
+		return nil, err
+	}
+
+	hooks, err := splitHooks(objects)
+	if err != nil {
+		log.Error(err, "finding hooks")
+		return nil, err
+	}
+
+	if r.options.shard != nil {
+		// Labelled once hashed, so that resharding does not count as a change of the manifest
+		if err := r.options.shard.labelShard(objects); err != nil {
+			return nil, err
+		}
+	}
+
+	return &desiredManifest{objects: objects, hooks: hooks, hash: hash, rollbackTo: rollbackTo}, nil
+}
+
+// selectObjects removes the objects that are not to be applied from objects: those that have the
+// ignore annotation, and those that the adoption policy does not adopt.  They are removed from
+// inventory too, so that they are neither recorded nor pruned.  Ignored fields of the remaining
+// objects are preserved.  The objects managed by another DeclarativeObject are returned.
+// Objects are looked up in defaultNamespace as they are applied; those that are not found, or
+// whose kind is not yet defined, are applied as new objects.
+func (r *Reconciler) selectObjects(ctx context.Context, instance DeclarativeObject, objects *manifest.Objects, inventory map[ObjectRef]bool, defaultNamespace string) ([]ObjectRef, error) {
+	log := log.Log
+
+	var newItems []*manifest.Object
+	var conflicts []ObjectRef
+	for _, obj := range objects.Items {
+		unstruct, err := r.getLiveObject(ctx, obj, defaultNamespace)
+		if err != nil {
+			if !apierrors.IsNotFound(err) && !meta.IsNoMatchError(err) {
+				return nil, fmt.Errorf("unable to get %s %s: %v", obj.Kind, obj.Name, err)
+			}
+			unstruct = nil
+		}
+		if unstruct != nil {
+			ref := ObjectRef{Group: obj.Group, Kind: obj.Kind, Namespace: unstruct.GetNamespace(), Name: obj.Name}
+			annotations := unstruct.GetAnnotations()
+			if _, ok := annotations["addons.k8s.io/ignore"]; ok {
+				log.WithValues("kind", obj.Kind).WithValues("name", obj.Name).Info("Found ignore annotation on object, " +
+					"skipping object")
+				// Not applied, so not ours to record or to prune
+				delete(inventory, ref)
+				continue
+			}
+			adopt, conflict, err := r.adopts(ctx, instance, obj, unstruct)
+			if err != nil {
+				return nil, fmt.Errorf("error checking owner of %s %s: %v", obj.Kind, obj.Name, err)
+			}
+			if conflict {
+				conflicts = append(conflicts, ref)
+			}
+			if !adopt {
+				log.WithValues("kind", obj.Kind).WithValues("name", obj.Name).Info("object is not adopted by the adoption policy, skipping object")
+				delete(inventory, ref)
+				continue
+			}
+			preserved, err := preserveIgnoredFields(obj, unstruct)
+			if err != nil {
+				log.WithValues("kind", obj.Kind).WithValues("name", obj.Name).Error(err, "preserving ignored fields")
+				return nil, err
+			}
+			obj = preserved
+		}
+		newItems = append(newItems, obj)
+	}
+	objects.Items = newItems
+	return conflicts, nil
 }
 
 // BuildDeploymentObjects performs all manifest operations to build a final set of objects for deployment
@@ -284,16 +732,22 @@ func (r *Reconciler) BuildDeploymentObjectsWithFs(ctx context.Context, name type
 	manifestFiles, err := r.loadRawManifest(ctx, instance)
 	if err != nil {
 		log.Error(err, "error loading raw manifest")
-		return nil, err
+		return nil, classified(err, func(err error) ReconcileError {
+			return &LoadError{Err: err, Retryable: true}
+		})
 	}
 	manifestObjects := &manifest.Objects{}
 	// 2. Perform raw string operations
 	for manifestPath, manifestStr := range manifestFiles {
-		for _, t := range r.options.rawManifestOperations {
-			transformed, err := t(ctx, instance, manifestStr)
+		for i, t := range r.options.rawManifestOperations {
+			opCtx, opSpan := r.startSpan(ctx, "rawManifestOperation", IndexAttribute.Int(i))
+			transformed, err := t(opCtx, instance, manifestStr)
+			endSpan(opSpan, err)
 			if err != nil {
 				log.Error(err, "error performing raw manifest operations")
-				return nil, err
+				return nil, classified(err, func(err error) ReconcileError {
+					return &TransformError{Err: err}
+				})
 			}
 			manifestStr = transformed
 		}
@@ -302,7 +756,9 @@ func (r *Reconciler) BuildDeploymentObjectsWithFs(ctx context.Context, name type
 		objects, err := r.parseManifest(ctx, instance, manifestStr)
 		if err != nil {
 			log.Error(err, "error parsing manifest")
-			return nil, err
+			return nil, classified(err, func(err error) ReconcileError {
+				return &LoadError{Err: err}
+			})
 		}
 
 		// 4. Perform object transformations
@@ -310,7 +766,9 @@ func (r *Reconciler) BuildDeploymentObjectsWithFs(ctx context.Context, name type
 		if !r.IsKustomizeOptionUsed() {
 			if err := r.transformManifest(ctx, instance, objects); err != nil {
 				log.Error(err, "error transforming manifest")
-				return nil, err
+				return nil, classified(err, func(err error) ReconcileError {
+					return &TransformError{Err: err}
+				})
 			}
 		}
 
@@ -337,29 +795,22 @@ func (r *Reconciler) BuildDeploymentObjectsWithFs(ctx context.Context, name type
 	// Here, the manifest is built using Kustomize and then replaces the Object items with the created manifest
 	if r.IsKustomizeOptionUsed() {
 		// run kustomize to create final manifest
-		opts := krusty.MakeDefaultOptions()
-		k := krusty.MakeKustomizer(opts)
-		m, err := k.Run(fs, manifestObjects.Path)
+		manifestYaml, err := r.runKustomize(ctx, fs, manifestObjects.Path)
 		if err != nil {
-			log.Error(err, "running kustomize to create final manifest")
-			return nil, fmt.Errorf("error running kustomize: %v", err)
-		}
-
-		manifestYaml, err := m.AsYaml()
-		if err != nil {
-			log.Error(err, "creating final manifest yaml")
-			return nil, fmt.Errorf("error converting kustomize output to yaml: %v", err)
+			return nil, &TransformError{Err: err}
 		}
 
 		objects, err := r.parseManifest(ctx, instance, string(manifestYaml))
 		if err != nil {
 			log.Error(err, "creating final manifest yaml")
-			return nil, err
+			return nil, &TransformError{Err: err}
 		}
 
 		if err := r.transformManifest(ctx, instance, objects); err != nil {
 			log.Error(err, "error transforming manifest")
-			return nil, err
+			return nil, classified(err, func(err error) ReconcileError {
+				return &TransformError{Err: err}
+			})
 		}
 		manifestObjects.Items = objects.Items
 	}
@@ -370,11 +821,40 @@ func (r *Reconciler) BuildDeploymentObjectsWithFs(ctx context.Context, name type
 	return manifestObjects, nil
 }
 
+// runKustomize builds the kustomization at path in fs
+func (r *Reconciler) runKustomize(ctx context.Context, fs filesys.FileSystem, path string) ([]byte, error) {
+	log := log.Log
+
+	_, span := r.startSpan(ctx, "kustomize")
+	var err error
+	defer func() { endSpan(span, err) }()
+
+	opts := krusty.MakeDefaultOptions()
+	k := krusty.MakeKustomizer(opts)
+	m, err := k.Run(fs, path)
+	if err != nil {
+		log.Error(err, "running kustomize to create final manifest")
+		return nil, fmt.Errorf("error running kustomize: %v", err)
+	}
+
+	manifestYaml, err := m.AsYaml()
+	if err != nil {
+		log.Error(err, "creating final manifest yaml")
+		return nil, fmt.Errorf("error converting kustomize output to yaml: %v", err)
+	}
+	return manifestYaml, nil
+}
+
 // parseManifest parses the manifest into objects
 func (r *Reconciler) parseManifest(ctx context.Context, instance DeclarativeObject, manifestStr string) (*manifest.Objects, error) {
 	log := log.Log
 
+	ctx, span := r.startSpan(ctx, "parseManifest")
 	objects, err := manifest.ParseObjects(ctx, manifestStr)
+	if err == nil {
+		span.SetAttributes(ObjectsAttribute.Int(len(objects.Items)))
+	}
+	endSpan(span, err)
 	if err != nil {
 		log.Error(err, "error parsing manifest")
 		return nil, err
@@ -385,13 +865,18 @@ func (r *Reconciler) parseManifest(ctx context.Context, instance DeclarativeObje
 
 // transformManifest runs any transformations as required
 func (r *Reconciler) transformManifest(ctx context.Context, instance DeclarativeObject, objects *manifest.Objects) error {
-	transforms := r.options.objectTransformations
+	transforms := append([]ObjectTransform(nil), r.options.objectTransformations...)
 	if r.options.labelMaker != nil {
 		transforms = append(transforms, AddLabels(r.options.labelMaker(ctx, instance)))
 	}
-	// TODO(jrjohnson): apply namespace here
-	for _, t := range transforms {
-		err := t(ctx, instance, objects)
+	// Without a RESTMapper (i.e. before Init) the namespace is left to kubectl apply -n
+	if !r.options.preserveNamespace && r.restMapper != nil {
+		transforms = append(transforms, SetNamespaces(r.restMapper))
+	}
+	for i, t := range transforms {
+		transformCtx, span := r.startSpan(ctx, "objectTransform", IndexAttribute.Int(i))
+		err := t(transformCtx, instance, objects)
+		endSpan(span, err)
 		if err != nil {
 			return err
 		}
@@ -401,7 +886,9 @@ func (r *Reconciler) transformManifest(ctx context.Context, instance Declarative
 
 // loadRawManifest loads the raw manifest YAML from the repository
 func (r *Reconciler) loadRawManifest(ctx context.Context, o DeclarativeObject) (map[string]string, error) {
+	ctx, span := r.startSpan(ctx, "loadRawManifest")
 	s, err := r.options.manifestController.ResolveManifest(ctx, o)
+	endSpan(span, err)
 	if err != nil {
 		return nil, err
 	}
@@ -440,6 +927,58 @@ func (r *Reconciler) validateOptions() error {
 		errs = append(errs, "WithApplyPrune must be used with the WithLabels option")
 	}
 
+	if r.options.prune && r.options.inventoryPrune {
+		errs = append(errs, "WithInventoryPrune cannot be combined with the WithApplyPrune option")
+	}
+
+	if (r.options.pruneMaxPercent != 0 || r.options.pruneMaxCount != 0) && !r.options.prune && !r.options.inventoryPrune {
+		errs = append(errs, "WithPruneThreshold must be used with the WithApplyPrune or WithInventoryPrune option")
+	}
+
+	if r.options.pruneMaxPercent < 0 || r.options.pruneMaxPercent > 100 || r.options.pruneMaxCount < 0 {
+		errs = append(errs, "WithPruneThreshold requires a percentage between 0 and 100 and a non-negative count")
+	}
+
+	if r.options.prune && r.options.serverSideApply {
+		errs = append(errs, "WithApplyPrune is not supported with the WithServerSideApply option")
+	}
+
+	if r.options.rollbackDeadline > 0 && r.options.revisionHistoryLimit < 2 {
+		errs = append(errs, "WithAutoRollback must be used with the WithRevisionHistory option, keeping at least 2 revisions")
+	}
+
+	if r.options.driftMode != "" && r.options.driftInterval <= 0 {
+		errs = append(errs, "WithDriftDetection requires a positive interval")
+	}
+
+	if r.options.targetCluster != nil && r.options.finalizer == "" {
+		errs = append(errs, "WithTargetCluster must be used with the WithFinalizer option, as objects in a remote cluster have no owner references to delete them")
+	}
+
+	switch r.options.adoptionPolicy {
+	case "", AdoptUnowned, AdoptAll:
+	case AdoptNever:
+		if r.options.labelMaker == nil {
+			errs = append(errs, "WithAdoptionPolicy(AdoptNever) must be used with the WithLabels option")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("unknown adoption policy %q", r.options.adoptionPolicy))
+	}
+
+	if r.options.skipUnchangedResync < 0 {
+		errs = append(errs, "WithSkipUnchanged requires a positive resync interval")
+	}
+
+	if r.options.skipUnchangedResync > 0 && r.options.driftMode == DriftAutoCorrect {
+		errs = append(errs, "WithSkipUnchanged cannot be combined with WithDriftDetection(DriftAutoCorrect), which applies the manifest to correct drift")
+	}
+
+	if r.options.shard != nil {
+		if err := r.options.shard.validate(); err != nil {
+			errs = append(errs, fmt.Sprintf("WithSharding: %v", err))
+		}
+	}
+
 	if r.options.manifestController == nil {
 		errs = append(errs, "ManifestController must be set either by configuring DefaultManifestLoader or specifying the WithManifestController option")
 	}
@@ -451,14 +990,40 @@ func (r *Reconciler) validateOptions() error {
 	return nil
 }
 
+// requireNamespaced returns an error if the DeclarativeObject is cluster-scoped, as option
+// stores objects in its namespace
+func (r *Reconciler) requireNamespaced(option string) error {
+	gvk, err := apiutil.GVKForObject(r.prototype, r.mgr.GetScheme())
+	if err != nil {
+		return err
+	}
+	mapping, err := r.restMapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return err
+	}
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		return fmt.Errorf("%s requires a namespaced DeclarativeObject, %v is cluster-scoped", option, gvk)
+	}
+	return nil
+}
+
 func (r *Reconciler) injectOwnerRef(ctx context.Context, instance DeclarativeObject, objects *manifest.Objects) error {
 	if r.options.ownerFn == nil {
 		return nil
 	}
+	if r.target != nil {
+		// Owner references cannot refer to an owner in another cluster
+		return nil
+	}
 
 	log := log.Log
 	log.WithValues("object", fmt.Sprintf("%s/%s", instance.GetName(), instance.GetNamespace())).Info("injecting owner references")
 
+	defaultNamespace := ""
+	if !r.options.preserveNamespace {
+		defaultNamespace = instance.GetNamespace()
+	}
+
 	for _, o := range objects.Items {
 		owner, err := r.options.ownerFn(ctx, instance, *o, *objects)
 		if err != nil {
@@ -484,9 +1049,17 @@ func (r *Reconciler) injectOwnerRef(ctx context.Context, instance DeclarativeObj
 			continue
 		}
 
-		// TODO, error/skip if:
-		// - owner is namespaced and o is not
-		// - owner is in a different namespace than o
+		ok, reason, err := r.canOwn(owner, gvk, o, objects, defaultNamespace)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			log.WithValues("object", o).WithValues("reason", reason).V(1).Info("cannot set owner reference, recording owner in annotation")
+			if err := setOwnerAnnotation(o, owner, gvk); err != nil {
+				return err
+			}
+			continue
+		}
 
 		ownerRefs := []interface{}{
 			map[string]interface{}{
@@ -559,6 +1132,18 @@ func parseListKind(infos *manifest.Objects) (*manifest.Objects, error) {
 	return &ret, nil
 }
 
+// asUnstructured returns instance as an Unstructured, converting it if it is a typed object
+func asUnstructured(instance DeclarativeObject) (*unstructured.Unstructured, error) {
+	if u, ok := instance.(*unstructured.Unstructured); ok {
+		return u, nil
+	}
+	m, err := runtime.DefaultUnstructuredConverter.ToUnstructured(instance)
+	if err != nil {
+		return nil, fmt.Errorf("unable to convert %T to unstructured: %v", instance, err)
+	}
+	return &unstructured.Unstructured{Object: m}, nil
+}
+
 // CollectMetrics determines whether metrics of declarative reconciler is enabled
 func (r *Reconciler) CollectMetrics() bool {
 	return r.options.metrics
@@ -568,12 +1153,22 @@ func GetObjectFromCluster(obj *manifest.Object, r *Reconciler) (*unstructured.
 	Unstructured, error) {
 	getOptions := metav1.GetOptions{}
 	gvk := obj.GroupVersionKind()
+	ns := obj.UnstructuredObject().GetNamespace()
+
+	if r.objectCache != nil {
+		unstruct, cached, err := r.objectCache.get(context.Background(), gvk, ns, obj.Name)
+		if cached {
+			if err != nil {
+				return nil, fmt.Errorf("unable to get resource from cache: %v", err)
+			}
+			return unstruct, nil
+		}
+	}
 
 	mapping, err := r.restMapper.RESTMapping(obj.GroupKind(), gvk.Version)
 	if err != nil {
 		return nil, fmt.Errorf("unable to get resource: %v", err)
 	}
-	ns := obj.UnstructuredObject().GetNamespace()
 	unstruct, err := r.dynamicClient.Resource(mapping.Resource).Namespace(ns).Get(context.Background(),
 		obj.Name, getOptions)
 	if err != nil {
@@ -581,3 +1176,52 @@ func GetObjectFromCluster(obj *manifest.Object, r *Reconciler) (*unstructured.
 	}
 	return unstruct, nil
 }
+
+// getLiveObject returns the live object for obj, placed in a namespace as by resourceFor.  Objects
+// of kinds cached by WithObjectCache are read from the cache.
+func (r *Reconciler) getLiveObject(ctx context.Context, obj *manifest.Object, defaultNamespace string) (*unstructured.Unstructured, error) {
+	if r.objectCache != nil {
+		ns := obj.Namespace
+		if ns == "" || defaultNamespace != "" {
+			ns = defaultNamespace
+		}
+		live, cached, err := r.objectCache.get(ctx, obj.GroupVersionKind(), ns, obj.Name)
+		if cached {
+			return live, err
+		}
+	}
+
+	resource, err := r.resourceFor(obj, defaultNamespace)
+	if err != nil {
+		return nil, err
+	}
+	return resource.Get(ctx, obj.Name, metav1.GetOptions{})
+}
+
+// newApplierFor returns the applier for the cluster of config
+func (r *Reconciler) newApplierFor(config *rest.Config, restMapper meta.RESTMapper) (applier.Applier, error) {
+	if r.options.serverSideApply {
+		return applier.NewServerSideApplier(config, restMapper, r.options.fieldManager)
+	}
+	return newApplier(config, restMapper), nil
+}
+
+// resourceFor returns the dynamic client for obj.  Namespace-scoped objects are placed in
+// defaultNamespace if it is set or the object has no namespace, matching kubectl apply -n.
+func (r *Reconciler) resourceFor(obj *manifest.Object, defaultNamespace string) (dynamic.ResourceInterface, error) {
+	gvk := obj.GroupVersionKind()
+	mapping, err := r.restMapper.RESTMapping(obj.GroupKind(), gvk.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		return r.dynamicClient.Resource(mapping.Resource), nil
+	}
+
+	ns := obj.Namespace
+	if ns == "" || defaultNamespace != "" {
+		ns = defaultNamespace
+	}
+	return r.dynamicClient.Resource(mapping.Resource).Namespace(ns), nil
+}
@@ -0,0 +1,285 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+const (
+	// RevisionOfLabel is set on revision Secrets to the name of their DeclarativeObject, shortened
+	// as by LabelValue
+	RevisionOfLabel = "addons.k8s.io/revision-of"
+	// RevisionOfNameAnnotation is set on revision Secrets to the full name of their DeclarativeObject
+	RevisionOfNameAnnotation = "addons.k8s.io/revision-of-name"
+	// RevisionOfKindLabel is set on revision Secrets to the lowercase kind of their DeclarativeObject
+	RevisionOfKindLabel = "addons.k8s.io/revision-of-kind"
+	// RevisionLabel is set on revision Secrets to the number of the revision
+	RevisionLabel = "addons.k8s.io/revision"
+	// RevisionHashAnnotation is set on revision Secrets to the hash of the stored manifest
+	RevisionHashAnnotation = "addons.k8s.io/revision-hash"
+
+	revisionManifestKey = "manifest.json.gz"
+	revisionSecretType  = corev1.SecretType("addons.k8s.io/revision")
+)
+
+// revision is a manifest applied for a DeclarativeObject, stored in a Secret
+type revision struct {
+	number int64
+	secret *corev1.Secret
+}
+
+// RollbackTo returns the revision requested by the spec.rollbackTo field of instance, or 0 if not set
+func RollbackTo(instance DeclarativeObject) (int64, error) {
+	u, err := asUnstructured(instance)
+	if err != nil {
+		return 0, err
+	}
+
+	rollbackTo, _, err := unstructured.NestedInt64(u.Object, "spec", "rollbackTo")
+	if err != nil {
+		return 0, fmt.Errorf("unable to read spec.rollbackTo: %v", err)
+	}
+	return rollbackTo, nil
+}
+
+// listRevisions returns the stored revisions of instance, oldest first.  Secrets are read
+// directly from the API server, so that we don't cache every Secret in the cluster.
+func (r *Reconciler) listRevisions(ctx context.Context, instance DeclarativeObject) ([]revision, error) {
+	labels, err := r.revisionLabels(instance)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := &corev1.SecretList{}
+	if err := r.mgr.GetAPIReader().List(ctx, secrets, client.InNamespace(instance.GetNamespace()), client.MatchingLabels(labels)); err != nil {
+		return nil, fmt.Errorf("error listing revisions: %v", err)
+	}
+
+	var revisions []revision
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		// Shortened names may be shared by several DeclarativeObjects
+		if name, ok := secret.Annotations[RevisionOfNameAnnotation]; ok && name != instance.GetName() {
+			continue
+		}
+		n, err := strconv.ParseInt(secret.Labels[RevisionLabel], 10, 64)
+		if err != nil {
+			log.Log.WithValues("secret", secret.Name).Info("ignoring revision with invalid number")
+			continue
+		}
+		revisions = append(revisions, revision{number: n, secret: secret})
+	}
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].number < revisions[j].number
+	})
+	return revisions, nil
+}
+
+// recordRevision stores the applied objects as a new revision, unless they are the same as
+// the latest revision.  Revisions beyond the history limit are deleted, oldest first.
+// The number of the revision matching objects is returned.
+func (r *Reconciler) recordRevision(ctx context.Context, instance DeclarativeObject, objects *manifest.Objects) (int64, error) {
+	log := log.Log.WithValues("object", instance.GetNamespace()+"/"+instance.GetName())
+
+	m, hash, err := manifestHash(objects)
+	if err != nil {
+		return 0, err
+	}
+
+	revisions, err := r.listRevisions(ctx, instance)
+	if err != nil {
+		return 0, err
+	}
+
+	var number int64 = 1
+	if len(revisions) != 0 {
+		latest := revisions[len(revisions)-1]
+		if latest.secret.Annotations[RevisionHashAnnotation] == hash {
+			return latest.number, nil
+		}
+		number = latest.number + 1
+	}
+
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	if _, err := gz.Write([]byte(m)); err != nil {
+		return 0, fmt.Errorf("error compressing manifest: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		return 0, fmt.Errorf("error compressing manifest: %v", err)
+	}
+
+	labels, err := r.revisionLabels(instance)
+	if err != nil {
+		return 0, err
+	}
+	labels[RevisionLabel] = strconv.FormatInt(number, 10)
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        r.revisionName(instance, labels[RevisionOfKindLabel], number),
+			Namespace:   instance.GetNamespace(),
+			Labels:      labels,
+			Annotations: map[string]string{RevisionHashAnnotation: hash, RevisionOfNameAnnotation: instance.GetName()},
+		},
+		Type: revisionSecretType,
+		Data: map[string][]byte{revisionManifestKey: b.Bytes()},
+	}
+	if err := controllerutil.SetControllerReference(instance, secret, r.mgr.GetScheme()); err != nil {
+		return 0, fmt.Errorf("error setting owner of revision: %v", err)
+	}
+	if err := r.client.Create(ctx, secret); err != nil {
+		return 0, fmt.Errorf("error creating revision %d: %v", number, err)
+	}
+	log.WithValues("revision", number).Info("recorded revision")
+
+	revisions = append(revisions, revision{number: number, secret: secret})
+	for len(revisions) > r.options.revisionHistoryLimit {
+		oldest := revisions[0]
+		if err := r.client.Delete(ctx, oldest.secret); err != nil && !apierrors.IsNotFound(err) {
+			return number, fmt.Errorf("error deleting revision %d: %v", oldest.number, err)
+		}
+		revisions = revisions[1:]
+	}
+
+	return number, nil
+}
+
+// loadRevision returns the objects stored in a revision of instance
+func (r *Reconciler) loadRevision(ctx context.Context, instance DeclarativeObject, number int64) (*manifest.Objects, error) {
+	labels, err := r.revisionLabels(instance)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := &corev1.Secret{}
+	key := types.NamespacedName{Namespace: instance.GetNamespace(), Name: r.revisionName(instance, labels[RevisionOfKindLabel], number)}
+	if err := r.mgr.GetAPIReader().Get(ctx, key, secret); err != nil {
+		return nil, fmt.Errorf("error getting revision %d: %v", number, err)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(secret.Data[revisionManifestKey]))
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing revision %d: %v", number, err)
+	}
+	m, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing revision %d: %v", number, err)
+	}
+
+	objects, err := manifest.ParseObjects(ctx, string(m))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing revision %d: %v", number, err)
+	}
+	return objects, nil
+}
+
+// appliedRevision returns the objects of the revision last applied for instance: the one
+// reported in status.currentRevision, else the one requested by spec.rollbackTo, else the latest.
+// It returns nil if no revision has been recorded.
+func (r *Reconciler) appliedRevision(ctx context.Context, instance DeclarativeObject) (*manifest.Objects, error) {
+	u, err := asUnstructured(instance)
+	if err != nil {
+		return nil, err
+	}
+	number, _, err := unstructured.NestedInt64(u.Object, "status", "currentRevision")
+	if err != nil {
+		return nil, fmt.Errorf("unable to read status.currentRevision: %v", err)
+	}
+	if number == 0 {
+		if number, err = RollbackTo(instance); err != nil {
+			return nil, err
+		}
+	}
+
+	revisions, err := r.listRevisions(ctx, instance)
+	if err != nil {
+		return nil, err
+	}
+	if len(revisions) == 0 {
+		return nil, nil
+	}
+	found := false
+	for _, rev := range revisions {
+		if rev.number == number {
+			found = true
+		}
+	}
+	if !found {
+		number = revisions[len(revisions)-1].number
+	}
+	return r.loadRevision(ctx, instance, number)
+}
+
+// manifestHash returns the manifest that is stored for objects, and its hash
+func manifestHash(objects *manifest.Objects) (string, string, error) {
+	m, err := objects.JSONManifest()
+	if err != nil {
+		return "", "", fmt.Errorf("error creating manifest: %v", err)
+	}
+	sum := sha256.Sum256([]byte(m))
+	return m, hex.EncodeToString(sum[:]), nil
+}
+
+// LabelValue returns name if it is short enough to be the value of a label, or else its first
+// characters followed by a hash of the whole name, so that names longer than 63 characters can
+// be selected by label.
+func LabelValue(name string) string {
+	if len(name) <= validation.LabelValueMaxLength {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	hash := hex.EncodeToString(sum[:])[:10]
+	return name[:validation.LabelValueMaxLength-len(hash)-1] + "-" + hash
+}
+
+func (r *Reconciler) revisionLabels(instance DeclarativeObject) (map[string]string, error) {
+	gvk, err := apiutil.GVKForObject(instance, r.mgr.GetScheme())
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		RevisionOfLabel:     LabelValue(instance.GetName()),
+		RevisionOfKindLabel: strings.ToLower(gvk.Kind),
+	}, nil
+}
+
+func (r *Reconciler) revisionName(instance DeclarativeObject, kind string, number int64) string {
+	return fmt.Sprintf("%s-%s-rev-%d", kind, instance.GetName(), number)
+}
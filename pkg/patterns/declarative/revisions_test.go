@@ -0,0 +1,214 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+// newTestManifest returns the objects of a manifest with a single ConfigMap holding value
+func newTestManifest(t *testing.T, value string) *manifest.Objects {
+	objects, err := manifest.ParseObjects(context.Background(), `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: ns
+data:
+  value: `+value+`
+`)
+	assert.NoError(t, err)
+	return objects
+}
+
+// revisionNumbers returns the numbers of the revisions of instance, oldest first
+func revisionNumbers(t *testing.T, r *Reconciler, instance DeclarativeObject) []int64 {
+	revisions, err := r.listRevisions(context.Background(), instance)
+	assert.NoError(t, err)
+	var numbers []int64
+	for _, rev := range revisions {
+		numbers = append(numbers, rev.number)
+	}
+	return numbers
+}
+
+func Test_recordRevision(t *testing.T) {
+	ctx := context.Background()
+	instance := newTestInstance("ns", "guestbook", "uid-1")
+	r, _, c := newTestReconciler(t)
+	r.options.revisionHistoryLimit = 2
+	assert.NoError(t, c.Create(ctx, instance))
+
+	number, err := r.recordRevision(ctx, instance, newTestManifest(t, "one"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), number)
+
+	// An unchanged manifest is not recorded again
+	number, err = r.recordRevision(ctx, instance, newTestManifest(t, "one"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), number)
+	assert.Equal(t, []int64{1}, revisionNumbers(t, r, instance))
+
+	number, err = r.recordRevision(ctx, instance, newTestManifest(t, "two"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), number)
+
+	secret := &corev1.Secret{}
+	assert.NoError(t, c.Get(ctx, client.ObjectKey{Namespace: "ns", Name: "guestbook-guestbook-rev-2"}, secret))
+	assert.Equal(t, map[string]string{RevisionOfLabel: "guestbook", RevisionOfKindLabel: "guestbook", RevisionLabel: "2"}, secret.Labels)
+	assert.Equal(t, "guestbook", secret.Annotations[RevisionOfNameAnnotation])
+	assert.Equal(t, revisionSecretType, secret.Type)
+	// Revisions are deleted with their DeclarativeObject
+	assert.Len(t, secret.OwnerReferences, 1)
+	assert.Equal(t, instance.GetUID(), secret.OwnerReferences[0].UID)
+
+	// Revisions beyond the limit are deleted, oldest first
+	number, err = r.recordRevision(ctx, instance, newTestManifest(t, "three"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), number)
+	assert.Equal(t, []int64{2, 3}, revisionNumbers(t, r, instance))
+
+	// Going back to an earlier manifest records a new revision
+	number, err = r.recordRevision(ctx, instance, newTestManifest(t, "two"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), number)
+	assert.Equal(t, []int64{3, 4}, revisionNumbers(t, r, instance))
+
+	// Revisions of other DeclarativeObjects are separate
+	other := newTestInstance("ns", "other", "uid-2")
+	assert.NoError(t, c.Create(ctx, other))
+	number, err = r.recordRevision(ctx, other, newTestManifest(t, "one"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), number)
+	assert.Equal(t, []int64{3, 4}, revisionNumbers(t, r, instance))
+}
+
+func Test_recordRevisionLongName(t *testing.T) {
+	ctx := context.Background()
+	r, _, c := newTestReconciler(t)
+	r.options.revisionHistoryLimit = 2
+
+	// Both names are shortened to the same prefix in the label
+	name := strings.Repeat("guestbook", 8)
+	instance := newTestInstance("ns", name+"-1", "uid-1")
+	other := newTestInstance("ns", name+"-2", "uid-2")
+	for _, instance := range []*unstructured.Unstructured{instance, other} {
+		assert.NoError(t, c.Create(ctx, instance))
+		_, err := r.recordRevision(ctx, instance, newTestManifest(t, "one"))
+		assert.NoError(t, err)
+	}
+	number, err := r.recordRevision(ctx, instance, newTestManifest(t, "two"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), number)
+
+	assert.Equal(t, []int64{1, 2}, revisionNumbers(t, r, instance))
+	assert.Equal(t, []int64{1}, revisionNumbers(t, r, other))
+
+	secret := &corev1.Secret{}
+	assert.NoError(t, c.Get(ctx, client.ObjectKey{Namespace: "ns", Name: "guestbook-" + name + "-1-rev-2"}, secret))
+	assert.Empty(t, validation.IsValidLabelValue(secret.Labels[RevisionOfLabel]))
+	assert.Equal(t, name+"-1", secret.Annotations[RevisionOfNameAnnotation])
+}
+
+func Test_LabelValue(t *testing.T) {
+	assert.Equal(t, "guestbook", LabelValue("guestbook"))
+
+	long := strings.Repeat("a", 100)
+	value := LabelValue(long)
+	assert.Len(t, value, validation.LabelValueMaxLength)
+	assert.Empty(t, validation.IsValidLabelValue(value))
+	assert.True(t, strings.HasPrefix(value, strings.Repeat("a", 40)))
+	assert.NotEqual(t, value, LabelValue(long+"b"))
+}
+
+func Test_loadRevision(t *testing.T) {
+	ctx := context.Background()
+	instance := newTestInstance("ns", "guestbook", "uid-1")
+	r, _, c := newTestReconciler(t)
+	r.options.revisionHistoryLimit = 10
+	assert.NoError(t, c.Create(ctx, instance))
+
+	for _, value := range []string{"one", "two"} {
+		_, err := r.recordRevision(ctx, instance, newTestManifest(t, value))
+		assert.NoError(t, err)
+	}
+
+	objects, err := r.loadRevision(ctx, instance, 1)
+	assert.NoError(t, err)
+	want, err := newTestManifest(t, "one").JSONManifest()
+	assert.NoError(t, err)
+	got, err := objects.JSONManifest()
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	_, err = r.loadRevision(ctx, instance, 3)
+	assert.Error(t, err)
+}
+
+func Test_appliedRevision(t *testing.T) {
+	ctx := context.Background()
+	r, _, c := newTestReconciler(t)
+	r.options.revisionHistoryLimit = 10
+
+	value := func(objects *manifest.Objects) string {
+		v, _, _ := unstructured.NestedString(objects.Items[0].UnstructuredObject().Object, "data", "value")
+		return v
+	}
+
+	instance := newTestInstance("ns", "guestbook", "uid-1")
+	assert.NoError(t, c.Create(ctx, instance))
+
+	// Nothing has been applied yet
+	objects, err := r.appliedRevision(ctx, instance)
+	assert.NoError(t, err)
+	assert.Nil(t, objects)
+
+	for _, v := range []string{"one", "two", "three"} {
+		_, err := r.recordRevision(ctx, instance, newTestManifest(t, v))
+		assert.NoError(t, err)
+	}
+
+	// The latest revision, unless another one is reported or requested
+	objects, err = r.appliedRevision(ctx, instance)
+	assert.NoError(t, err)
+	assert.Equal(t, "three", value(objects))
+
+	assert.NoError(t, unstructured.SetNestedField(instance.Object, int64(1), "spec", "rollbackTo"))
+	objects, err = r.appliedRevision(ctx, instance)
+	assert.NoError(t, err)
+	assert.Equal(t, "one", value(objects))
+
+	assert.NoError(t, unstructured.SetNestedField(instance.Object, int64(2), "status", "currentRevision"))
+	objects, err = r.appliedRevision(ctx, instance)
+	assert.NoError(t, err)
+	assert.Equal(t, "two", value(objects))
+
+	// A revision that is no longer kept falls back to the latest
+	assert.NoError(t, unstructured.SetNestedField(instance.Object, int64(7), "status", "currentRevision"))
+	objects, err = r.appliedRevision(ctx, instance)
+	assert.NoError(t, err)
+	assert.Equal(t, "three", value(objects))
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"sigs.k8s.io/cli-utils/pkg/kstatus/status"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+const (
+	// RevisionHealthyAnnotation is set on revision Secrets once every object of the revision has
+	// a kstatus of Current.  Automatic rollbacks only go back to healthy revisions.
+	RevisionHealthyAnnotation = "addons.k8s.io/revision-healthy"
+	// RolledBackToAnnotation is set on the DeclarativeObject to the revision that WithAutoRollback
+	// rolled back to
+	RolledBackToAnnotation = "addons.k8s.io/rolled-back-to"
+	// RolledBackGenerationAnnotation is set on the DeclarativeObject to the generation whose rollout
+	// was rolled back.  The rollback lasts until the generation changes.
+	RolledBackGenerationAnnotation = "addons.k8s.io/rolled-back-generation"
+)
+
+// rolledBackTo returns the revision that the current generation of instance was rolled back to
+// by WithAutoRollback, or 0 if it was not rolled back
+func rolledBackTo(instance DeclarativeObject) int64 {
+	annotations := instance.GetAnnotations()
+	if annotations[RolledBackGenerationAnnotation] != strconv.FormatInt(instance.GetGeneration(), 10) {
+		return 0
+	}
+	number, err := strconv.ParseInt(annotations[RolledBackToAnnotation], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return number
+}
+
+// revisionToApply returns the revision to apply instead of building the manifest of instance:
+// the one requested by spec.rollbackTo, else the one WithAutoRollback rolled back to.  It returns
+// 0 if the manifest is to be built, and always when WithRevisionHistory is not set.
+func (r *Reconciler) revisionToApply(instance DeclarativeObject) (int64, error) {
+	if r.options.revisionHistoryLimit <= 0 {
+		return 0, nil
+	}
+	number, err := RollbackTo(instance)
+	if err != nil || number != 0 {
+		return number, err
+	}
+	if r.options.rollbackDeadline > 0 {
+		return rolledBackTo(instance), nil
+	}
+	return 0, nil
+}
+
+// rolloutStatus aggregates the kstatus of the live objects, in the same way as the
+// kstatus aggregator in addon/pkg/status
+func (r *Reconciler) rolloutStatus(ctx context.Context, objects *manifest.Objects, defaultNamespace string) (status.Status, error) {
+	inProgress := false
+	failed := false
+	for _, obj := range objects.Items {
+		res, err := r.objectStatus(ctx, obj, defaultNamespace)
+		if err != nil {
+			return status.UnknownStatus, err
+		}
+		switch res.Status {
+		case status.InProgressStatus, status.TerminatingStatus, status.NotFoundStatus:
+			inProgress = true
+		case status.FailedStatus:
+			failed = true
+		}
+	}
+
+	if inProgress {
+		return status.InProgressStatus, nil
+	}
+	if failed {
+		return status.FailedStatus, nil
+	}
+	return status.CurrentStatus, nil
+}
+
+// checkRollout checks the rollout of the applied revision.  A revision is marked healthy once its
+// objects are Current, and is rolled back if they are Failed or still InProgress after the deadline.
+func (r *Reconciler) checkRollout(ctx context.Context, instance DeclarativeObject, objects *manifest.Objects, defaultNamespace string, number int64) (reconcile.Result, error) {
+	log := log.Log.WithValues("object", instance.GetNamespace()+"/"+instance.GetName()).WithValues("revision", number)
+
+	revisions, err := r.listRevisions(ctx, instance)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	var current *revision
+	for i := range revisions {
+		if revisions[i].number == number {
+			current = &revisions[i]
+		}
+	}
+	if current == nil || current.secret.Annotations[RevisionHealthyAnnotation] == "true" {
+		return reconcile.Result{}, nil
+	}
+
+	rollout, err := r.rolloutStatus(ctx, objects, defaultNamespace)
+	if err != nil {
+		return reconcile.Result{}, fmt.Errorf("error checking rollout: %v", err)
+	}
+
+	if rollout == status.CurrentStatus {
+		log.Info("revision is healthy")
+		patch := client.MergeFrom(current.secret.DeepCopy())
+		if current.secret.Annotations == nil {
+			current.secret.Annotations = map[string]string{}
+		}
+		current.secret.Annotations[RevisionHealthyAnnotation] = "true"
+		if err := r.client.Patch(ctx, current.secret, patch); err != nil {
+			return reconcile.Result{}, fmt.Errorf("error marking revision %d healthy: %v", number, err)
+		}
+		return reconcile.Result{}, nil
+	}
+
+	age := time.Since(current.secret.CreationTimestamp.Time)
+	if rollout == status.FailedStatus || age > r.options.rollbackDeadline {
+		reason := fmt.Sprintf("revision %d is %s after %s", number, rollout, age.Round(time.Second))
+		return reconcile.Result{}, r.rollback(ctx, instance, current.secret.Annotations[RevisionHashAnnotation], reason)
+	}
+
+	log.WithValues("status", rollout).Info("waiting for revision to become healthy")
+	return reconcile.Result{RequeueAfter: r.options.rollbackDeadline - age}, nil
+}
+
+// rollback rolls instance back to the latest healthy revision that does not have the given
+// manifest hash, until its generation changes.  The spec is left alone: the rollback is recorded
+// in the RolledBackToAnnotation and RolledBackGenerationAnnotation, and reported through the
+// RolledBack interface of the Status.  Nothing is done if there is no such revision.
+func (r *Reconciler) rollback(ctx context.Context, instance DeclarativeObject, hash string, reason string) error {
+	log := log.Log.WithValues("object", instance.GetNamespace()+"/"+instance.GetName())
+
+	revisions, err := r.listRevisions(ctx, instance)
+	if err != nil {
+		return err
+	}
+	var good *revision
+	for i := len(revisions) - 1; i >= 0; i-- {
+		rev := revisions[i]
+		if rev.secret.Annotations[RevisionHealthyAnnotation] == "true" && rev.secret.Annotations[RevisionHashAnnotation] != hash {
+			good = &rev
+			break
+		}
+	}
+	if good == nil {
+		log.WithValues("reason", reason).Info("no healthy revision to roll back to")
+		r.recorder.Eventf(instance, "Warning", "RollbackSkipped", "%s, but there is no healthy revision to roll back to", reason)
+		return nil
+	}
+
+	if err := r.setAnnotations(ctx, instance, map[string]string{
+		RolledBackToAnnotation:         strconv.FormatInt(good.number, 10),
+		RolledBackGenerationAnnotation: strconv.FormatInt(instance.GetGeneration(), 10),
+	}); err != nil {
+		return fmt.Errorf("error recording rollback: %v", err)
+	}
+
+	log.WithValues("revision", good.number).WithValues("reason", reason).Info("rolled back")
+	r.recorder.Eventf(instance, "Warning", "RolledBack", "Rolled back to revision %d: %s", good.number, reason)
+	if r.options.status != nil {
+		if rolledBack, ok := r.options.status.(RolledBack); ok {
+			if err := rolledBack.RolledBack(ctx, instance, good.number, reason); err != nil {
+				log.Error(err, "failed to report rollback")
+			}
+		}
+	}
+	return nil
+}
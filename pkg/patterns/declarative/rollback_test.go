@@ -0,0 +1,173 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	recorder "k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+// markHealthy sets the RevisionHealthyAnnotation on revision number of instance
+func markHealthy(t *testing.T, c client.Client, number string) {
+	secret := &corev1.Secret{}
+	assert.NoError(t, c.Get(context.Background(), client.ObjectKey{Namespace: "ns", Name: "guestbook-guestbook-rev-" + number}, secret))
+	secret.Annotations[RevisionHealthyAnnotation] = "true"
+	assert.NoError(t, c.Update(context.Background(), secret))
+}
+
+// nextEvent returns the next Event recorded by r, or "" if there is none
+func nextEvent(r *Reconciler) string {
+	select {
+	case event := <-r.recorder.(*recorder.FakeRecorder).Events:
+		return event
+	default:
+		return ""
+	}
+}
+
+func Test_rollback(t *testing.T) {
+	ctx := context.Background()
+	r, _, c := newTestReconciler(t)
+	r.options.revisionHistoryLimit = 10
+	r.options.rollbackDeadline = time.Minute
+
+	instance := newTestInstance("ns", "guestbook", "uid-1")
+	instance.SetGeneration(3)
+	assert.NoError(t, c.Create(ctx, instance))
+
+	hashes := map[string]string{}
+	for _, v := range []string{"one", "two", "three"} {
+		_, err := r.recordRevision(ctx, instance, newTestManifest(t, v))
+		assert.NoError(t, err)
+		_, hashes[v], err = manifestHash(newTestManifest(t, v))
+		assert.NoError(t, err)
+	}
+	markHealthy(t, c, "1")
+	markHealthy(t, c, "2")
+
+	// The latest healthy revision other than the failed one is applied, without touching the spec
+	assert.NoError(t, r.rollback(ctx, instance, hashes["three"], "revision 3 is Failed"))
+	assert.Equal(t, "2", instance.GetAnnotations()[RolledBackToAnnotation])
+	assert.Equal(t, "3", instance.GetAnnotations()[RolledBackGenerationAnnotation])
+	_, found, _ := unstructured.NestedFieldNoCopy(instance.Object, "spec", "rollbackTo")
+	assert.False(t, found)
+	assert.True(t, strings.HasPrefix(nextEvent(r), "Warning RolledBack Rolled back to revision 2"))
+
+	number, err := r.revisionToApply(instance)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), number)
+
+	// A healthy revision with the failed manifest is skipped
+	assert.NoError(t, r.rollback(ctx, instance, hashes["two"], "apply failed"))
+	assert.Equal(t, "1", instance.GetAnnotations()[RolledBackToAnnotation])
+	nextEvent(r)
+
+	// Nothing is done without a healthy revision to go back to
+	other := newTestInstance("ns", "other", "uid-2")
+	assert.NoError(t, c.Create(ctx, other))
+	_, err = r.recordRevision(ctx, other, newTestManifest(t, "one"))
+	assert.NoError(t, err)
+	assert.NoError(t, r.rollback(ctx, other, hashes["two"], "apply failed"))
+	assert.Empty(t, other.GetAnnotations()[RolledBackToAnnotation])
+	assert.True(t, strings.HasPrefix(nextEvent(r), "Warning RollbackSkipped"))
+}
+
+func Test_revisionToApply(t *testing.T) {
+	rolledBack := func(generation int64, rollbackTo int64) DeclarativeObject {
+		instance := newTestInstance("ns", "guestbook", "uid-1")
+		instance.SetGeneration(generation)
+		instance.SetAnnotations(map[string]string{RolledBackToAnnotation: "2", RolledBackGenerationAnnotation: "3"})
+		if rollbackTo != 0 {
+			unstructured.SetNestedField(instance.Object, rollbackTo, "spec", "rollbackTo")
+		}
+		return instance
+	}
+
+	tests := []struct {
+		name         string
+		history      int
+		autoRollback bool
+		instance     DeclarativeObject
+		want         int64
+	}{
+		{name: "rolled back", history: 10, autoRollback: true, instance: rolledBack(3, 0), want: 2},
+		{name: "spec changed since the rollback", history: 10, autoRollback: true, instance: rolledBack(4, 0)},
+		{name: "spec.rollbackTo takes precedence", history: 10, autoRollback: true, instance: rolledBack(3, 1), want: 1},
+		{name: "spec.rollbackTo without auto rollback", history: 10, instance: rolledBack(3, 1), want: 1},
+		{name: "auto rollback disabled", history: 10, instance: rolledBack(3, 0)},
+		{name: "no revision history", instance: rolledBack(3, 1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Reconciler{}
+			r.options.revisionHistoryLimit = tt.history
+			if tt.autoRollback {
+				r.options.rollbackDeadline = time.Minute
+			}
+			number, err := r.revisionToApply(tt.instance)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, number)
+		})
+	}
+}
+
+func Test_checkRollout(t *testing.T) {
+	ctx := context.Background()
+	r, _, c := newTestReconciler(t, newTestConfigMap("ns", "config"))
+	r.options.revisionHistoryLimit = 10
+	r.options.rollbackDeadline = time.Minute
+
+	instance := newTestInstance("ns", "guestbook", "uid-1")
+	instance.SetGeneration(1)
+	assert.NoError(t, c.Create(ctx, instance))
+
+	// The objects of revision 1 are Current, so it is healthy
+	number, err := r.recordRevision(ctx, instance, newTestManifest(t, "one"))
+	assert.NoError(t, err)
+	result, err := r.checkRollout(ctx, instance, newTestManifest(t, "one"), "ns", number)
+	assert.NoError(t, err)
+	assert.Zero(t, result.RequeueAfter)
+	secret := &corev1.Secret{}
+	assert.NoError(t, c.Get(ctx, client.ObjectKey{Namespace: "ns", Name: "guestbook-guestbook-rev-1"}, secret))
+	assert.Equal(t, "true", secret.Annotations[RevisionHealthyAnnotation])
+
+	// The objects of revision 2 never appear, and the deadline has passed
+	missing, err := manifest.ParseObjects(ctx, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: missing
+  namespace: ns
+`)
+	assert.NoError(t, err)
+	number, err = r.recordRevision(ctx, instance, missing)
+	assert.NoError(t, err)
+	_, err = r.checkRollout(ctx, instance, missing, "ns", number)
+	assert.NoError(t, err)
+	assert.Equal(t, "1", instance.GetAnnotations()[RolledBackToAnnotation])
+	assert.Equal(t, "1", instance.GetAnnotations()[RolledBackGenerationAnnotation])
+}
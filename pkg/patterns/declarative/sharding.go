@@ -0,0 +1,112 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+// ShardLabel assigns a DeclarativeObject to a shard, overriding the hash of its name.  It is also
+// set on the objects applied for a DeclarativeObject, to the shard that applied them.
+const ShardLabel = "addons.k8s.io/shard"
+
+// Shard is the subset of DeclarativeObjects reconciled by one replica of an operator
+type Shard struct {
+	// ID is the shard of this replica, from 0 to Count-1
+	ID int
+	// Count is the number of shards
+	Count int
+}
+
+// Owns reports whether obj, a DeclarativeObject, belongs to the shard: the shard given by its
+// ShardLabel if it has one, or else the hash of its namespace and name
+func (s Shard) Owns(obj metav1.Object) bool {
+	if value, ok := obj.GetLabels()[ShardLabel]; ok {
+		if id, err := strconv.Atoi(value); err == nil {
+			return id == s.ID
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(obj.GetNamespace() + "/" + obj.GetName()))
+	return int(h.Sum32()%uint32(s.Count)) == s.ID
+}
+
+// Predicate filters the events of a watch on DeclarativeObjects to those of the shard
+func (s Shard) Predicate() predicate.Predicate {
+	return predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		return s.Owns(obj)
+	})
+}
+
+// LeaderElectionID returns the ID of the leader election lease of the shard, so that each shard
+// has its own leader
+func (s Shard) LeaderElectionID(id string) string {
+	return fmt.Sprintf("%s-shard-%d", id, s.ID)
+}
+
+// Labels returns the labels set on the objects applied by the shard
+func (s Shard) Labels() map[string]string {
+	return map[string]string{ShardLabel: strconv.Itoa(s.ID)}
+}
+
+func (s Shard) validate() error {
+	if s.Count <= 0 {
+		return fmt.Errorf("shard count must be positive, got %d", s.Count)
+	}
+	if s.ID < 0 || s.ID >= s.Count {
+		return fmt.Errorf("shard ID must be from 0 to %d, got %d", s.Count-1, s.ID)
+	}
+	return nil
+}
+
+// labelShard sets the ShardLabel on objects, so that watches can be restricted to the objects of the shard
+func (s Shard) labelShard(objects *manifest.Objects) error {
+	for _, obj := range objects.Items {
+		labels := obj.UnstructuredObject().GetLabels()
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		for k, v := range s.Labels() {
+			labels[k] = v
+		}
+		if err := obj.SetNestedStringMap(labels, "metadata", "labels"); err != nil {
+			return fmt.Errorf("error setting shard label on %s %s: %v", obj.Kind, obj.Name, err)
+		}
+	}
+	return nil
+}
+
+// sharded is implemented by the Reconciler, so that WatchAll can restrict its watches to the shard
+type sharded interface {
+	shard() *Shard
+}
+
+func (r *Reconciler) shard() *Shard {
+	return r.options.shard
+}
+
+// owns reports whether instance belongs to the shard of the Reconciler, if any
+func (r *Reconciler) owns(instance metav1.Object) bool {
+	return r.options.shard == nil || r.options.shard.Owns(instance)
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+func Test_ShardOwns(t *testing.T) {
+	shards := []Shard{{ID: 0, Count: 3}, {ID: 1, Count: 3}, {ID: 2, Count: 3}}
+
+	// Every object belongs to exactly one shard
+	counts := make([]int, len(shards))
+	for i := 0; i < 300; i++ {
+		obj := &metav1.ObjectMeta{Namespace: "ns", Name: fmt.Sprintf("addon-%d", i)}
+		owners := 0
+		for id, shard := range shards {
+			if shard.Owns(obj) {
+				owners++
+				counts[id]++
+			}
+		}
+		assert.Equal(t, 1, owners, obj.Name)
+	}
+	for id, count := range counts {
+		assert.NotZero(t, count, "shard %d", id)
+	}
+
+	labelled := &metav1.ObjectMeta{Namespace: "ns", Name: "addon", Labels: map[string]string{ShardLabel: "2"}}
+	assert.False(t, shards[0].Owns(labelled))
+	assert.False(t, shards[1].Owns(labelled))
+	assert.True(t, shards[2].Owns(labelled))
+
+	// An invalid label falls back to the hash of the name
+	invalid := &metav1.ObjectMeta{Namespace: "ns", Name: "addon", Labels: map[string]string{ShardLabel: "two"}}
+	unlabelled := &metav1.ObjectMeta{Namespace: "ns", Name: "addon"}
+	for _, shard := range shards {
+		assert.Equal(t, shard.Owns(unlabelled), shard.Owns(invalid))
+	}
+}
+
+func Test_ShardValidate(t *testing.T) {
+	assert.NoError(t, Shard{ID: 0, Count: 1}.validate())
+	assert.Error(t, Shard{ID: 0, Count: 0}.validate())
+	assert.Error(t, Shard{ID: 2, Count: 2}.validate())
+	assert.Error(t, Shard{ID: -1, Count: 2}.validate())
+}
+
+func Test_labelShard(t *testing.T) {
+	objects, err := manifest.ParseObjects(context.Background(), `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  labels:
+    app: guestbook
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: frontend
+`)
+	assert.NoError(t, err)
+
+	assert.NoError(t, Shard{ID: 1, Count: 2}.labelShard(objects))
+	assert.Equal(t, map[string]string{"app": "guestbook", ShardLabel: "1"}, objects.Items[0].UnstructuredObject().GetLabels())
+	assert.Equal(t, map[string]string{ShardLabel: "1"}, objects.Items[1].UnstructuredObject().GetLabels())
+
+	u := &unstructured.Unstructured{}
+	u.SetLabels(map[string]string{ShardLabel: "1"})
+	assert.True(t, Shard{ID: 1, Count: 2}.Owns(u))
+}
@@ -50,11 +50,76 @@ type VersionCheck interface {
 	VersionCheck(context.Context, DeclarativeObject, *manifest.Objects) (bool, error)
 }
 
+// Deleting is an optional interface for a Status, used when WithFinalizer is set.
+type Deleting interface {
+	// Deleting is triggered while the objects deployed for a DeclarativeObject are being torn down.
+	// The remaining objects are the ones that still exist in the cluster; once they are all gone
+	// it is triggered with none, just before the finalizer is removed.
+	Deleting(context.Context, DeclarativeObject, []ObjectRef) error
+}
+
+// Paused is an optional interface for a Status, used to report whether reconciliation is suspended.
+type Paused interface {
+	// Paused is triggered on every reconcile with whether reconciliation of the DeclarativeObject
+	// is paused (see IsPaused).  Objects are neither built nor applied while paused.
+	Paused(context.Context, DeclarativeObject, bool) error
+}
+
+// Revisioned is an optional interface for a Status, used when WithRevisionHistory is set.
+type Revisioned interface {
+	// Revisioned is triggered once the objects of a revision have been applied
+	Revisioned(context.Context, DeclarativeObject, int64) error
+}
+
+// RolledBack is an optional interface for a Status, used when WithAutoRollback is set.
+type RolledBack interface {
+	// RolledBack is triggered when a failed rollout is rolled back to a revision, with the reason
+	RolledBack(ctx context.Context, src DeclarativeObject, revision int64, reason string) error
+}
+
+// Drifted is an optional interface for a Status, used when WithDriftDetection is set.
+type Drifted interface {
+	// Drifted is triggered each time drift is checked, with the objects that have drifted from
+	// the manifest (none if there is no drift)
+	Drifted(context.Context, DeclarativeObject, []ObjectRef) error
+}
+
+// Conflicted is an optional interface for a Status, used to report objects managed by another DeclarativeObject.
+type Conflicted interface {
+	// Conflicted is triggered on every apply with the objects that are managed by another
+	// DeclarativeObject (none if there is no conflict), which are not applied unless the adoption
+	// policy is AdoptAll; see WithAdoptionPolicy
+	Conflicted(context.Context, DeclarativeObject, []ObjectRef) error
+}
+
+// PruneBlocked is an optional interface for a Status, used when WithPruneThreshold is set.
+type PruneBlocked interface {
+	// PruneBlocked is triggered on every apply with the objects that were not pruned because the
+	// prune exceeds the threshold (none if pruning is not blocked), and the value of the
+	// AllowPruneAnnotation that allows the prune
+	PruneBlocked(ctx context.Context, src DeclarativeObject, blocked []ObjectRef, allow string) error
+}
+
+// Failed is an optional interface for a Status, used to report why reconciliation failed.
+type Failed interface {
+	// Failed is triggered after every reconcile with the ReconcileError it failed with, or nil
+	// if it succeeded (or failed with an error that is not a ReconcileError)
+	Failed(context.Context, DeclarativeObject, ReconcileError) error
+}
+
 // StatusBuilder provides a pluggable implementation of Status
 type StatusBuilder struct {
 	ReconciledImpl   Reconciled
 	PreflightImpl    Preflight
 	VersionCheckImpl VersionCheck
+	DeletingImpl     Deleting
+	PausedImpl       Paused
+	RevisionedImpl   Revisioned
+	RolledBackImpl   RolledBack
+	DriftedImpl      Drifted
+	ConflictedImpl   Conflicted
+	PruneBlockedImpl PruneBlocked
+	FailedImpl       Failed
 }
 
 func (s *StatusBuilder) Reconciled(ctx context.Context, src DeclarativeObject, objs *manifest.Objects) error {
@@ -78,4 +143,68 @@ func (s *StatusBuilder) VersionCheck(ctx context.Context, src DeclarativeObject,
 	return true, nil
 }
 
+func (s *StatusBuilder) Deleting(ctx context.Context, src DeclarativeObject, remaining []ObjectRef) error {
+	if s.DeletingImpl != nil {
+		return s.DeletingImpl.Deleting(ctx, src, remaining)
+	}
+	return nil
+}
+
+func (s *StatusBuilder) Paused(ctx context.Context, src DeclarativeObject, paused bool) error {
+	if s.PausedImpl != nil {
+		return s.PausedImpl.Paused(ctx, src, paused)
+	}
+	return nil
+}
+
+func (s *StatusBuilder) Revisioned(ctx context.Context, src DeclarativeObject, revision int64) error {
+	if s.RevisionedImpl != nil {
+		return s.RevisionedImpl.Revisioned(ctx, src, revision)
+	}
+	return nil
+}
+
+func (s *StatusBuilder) RolledBack(ctx context.Context, src DeclarativeObject, revision int64, reason string) error {
+	if s.RolledBackImpl != nil {
+		return s.RolledBackImpl.RolledBack(ctx, src, revision, reason)
+	}
+	return nil
+}
+
+func (s *StatusBuilder) Drifted(ctx context.Context, src DeclarativeObject, drifted []ObjectRef) error {
+	if s.DriftedImpl != nil {
+		return s.DriftedImpl.Drifted(ctx, src, drifted)
+	}
+	return nil
+}
+
+func (s *StatusBuilder) Conflicted(ctx context.Context, src DeclarativeObject, conflicts []ObjectRef) error {
+	if s.ConflictedImpl != nil {
+		return s.ConflictedImpl.Conflicted(ctx, src, conflicts)
+	}
+	return nil
+}
+
+func (s *StatusBuilder) PruneBlocked(ctx context.Context, src DeclarativeObject, blocked []ObjectRef, allow string) error {
+	if s.PruneBlockedImpl != nil {
+		return s.PruneBlockedImpl.PruneBlocked(ctx, src, blocked, allow)
+	}
+	return nil
+}
+
+func (s *StatusBuilder) Failed(ctx context.Context, src DeclarativeObject, err ReconcileError) error {
+	if s.FailedImpl != nil {
+		return s.FailedImpl.Failed(ctx, src, err)
+	}
+	return nil
+}
+
 var _ Status = &StatusBuilder{}
+var _ Deleting = &StatusBuilder{}
+var _ Paused = &StatusBuilder{}
+var _ Revisioned = &StatusBuilder{}
+var _ RolledBack = &StatusBuilder{}
+var _ Drifted = &StatusBuilder{}
+var _ Conflicted = &StatusBuilder{}
+var _ PruneBlocked = &StatusBuilder{}
+var _ Failed = &StatusBuilder{}
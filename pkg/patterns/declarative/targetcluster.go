@@ -0,0 +1,288 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/applier"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+// KubeconfigSecretKeys are the keys of a Secret selected by WithTargetCluster that may hold the
+// kubeconfig, in order of preference.  "value" is the key used by Cluster API.
+var KubeconfigSecretKeys = []string{"kubeconfig", "value"}
+
+// targetCluster is a remote cluster that objects are deployed to
+type targetCluster struct {
+	// secret is the Secret holding the kubeconfig, at version
+	secret  types.NamespacedName
+	version secretVersion
+
+	config        *rest.Config
+	client        client.Client
+	dynamicClient dynamic.Interface
+	restMapper    *resettableRESTMapper
+	applier       applier.Applier
+}
+
+// secretVersion identifies the content of a Secret: a Secret that is deleted and created again
+// gets a new UID, so is not mistaken for the one it replaces
+type secretVersion struct {
+	uid             types.UID
+	resourceVersion string
+}
+
+// targetClusterRefresh is how long the clients of a target cluster are used before its
+// kubeconfig Secret is read again, to pick up a rotated kubeconfig
+const targetClusterRefresh = 5 * time.Minute
+
+// targetClusters caches the targetCluster of each version of a kubeconfig Secret.  The Secret is
+// only read again once targetClusterRefresh has passed since it was last read, and the cluster of
+// its previous version is dropped once it changes.  The cluster of a Secret is also dropped once
+// no DeclarativeObject deploys to it any more.
+type targetClusters struct {
+	mutex    sync.Mutex
+	clusters map[secretVersion]*targetCluster
+	// versions is the version of each Secret when it was last read
+	versions map[types.NamespacedName]secretVersion
+	// checked is when each Secret was last read
+	checked map[types.NamespacedName]time.Time
+	// users is the Secret of the cluster each DeclarativeObject deploys to
+	users map[types.NamespacedName]types.NamespacedName
+}
+
+// fresh returns the cluster of secret if the Secret was read within targetClusterRefresh of now
+func (t *targetClusters) fresh(secret types.NamespacedName, now time.Time) *targetCluster {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	version, ok := t.versions[secret]
+	if !ok || now.Sub(t.checked[secret]) >= targetClusterRefresh {
+		return nil
+	}
+	return t.clusters[version]
+}
+
+// get returns the cluster of secret at version, recording that the Secret was read at now
+func (t *targetClusters) get(secret types.NamespacedName, version secretVersion, now time.Time) *targetCluster {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	cluster := t.clusters[version]
+	if cluster == nil || cluster.secret != secret {
+		return nil
+	}
+	t.checked[secret] = now
+	return cluster
+}
+
+// set caches cluster, whose Secret was read at now, in place of the cluster of the previous
+// version of the Secret
+func (t *targetClusters) set(cluster *targetCluster, now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.clusters == nil {
+		t.clusters = map[secretVersion]*targetCluster{}
+		t.versions = map[types.NamespacedName]secretVersion{}
+		t.checked = map[types.NamespacedName]time.Time{}
+	}
+	if previous, ok := t.versions[cluster.secret]; ok {
+		delete(t.clusters, previous)
+	}
+	t.clusters[cluster.version] = cluster
+	t.versions[cluster.secret] = cluster.version
+	t.checked[cluster.secret] = now
+}
+
+// use records that the DeclarativeObject name deploys to the cluster of secret
+func (t *targetClusters) use(name, secret types.NamespacedName) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.users == nil {
+		t.users = map[types.NamespacedName]types.NamespacedName{}
+	}
+	t.users[name] = secret
+}
+
+// forget is called once the DeclarativeObject name is deleted, dropping the cluster it deployed
+// to unless another DeclarativeObject deploys to it too
+func (t *targetClusters) forget(name types.NamespacedName) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	secret, ok := t.users[name]
+	if !ok {
+		return
+	}
+	delete(t.users, name)
+	for _, other := range t.users {
+		if other == secret {
+			return
+		}
+	}
+	if version, ok := t.versions[secret]; ok {
+		delete(t.clusters, version)
+	}
+	delete(t.versions, secret)
+	delete(t.checked, secret)
+}
+
+type targetClusterKey struct{}
+
+// targetClusterFrom returns the remote cluster that ctx reconciles objects in, or nil
+func targetClusterFrom(ctx context.Context) *targetCluster {
+	cluster, _ := ctx.Value(targetClusterKey{}).(*targetCluster)
+	return cluster
+}
+
+// TargetClient returns a client for the cluster that the objects being reconciled in ctx are
+// deployed to.  This is c, unless the DeclarativeObject is deployed to a remote cluster by
+// WithTargetCluster.  The DeclarativeObject itself must still be read and updated with c.
+func TargetClient(ctx context.Context, c client.Client) client.Client {
+	if cluster := targetClusterFrom(ctx); cluster != nil {
+		return cluster.client
+	}
+	return c
+}
+
+// GetObjectFromTargetCluster is GetObjectFromCluster for the cluster that the objects being
+// reconciled in ctx are deployed to
+func GetObjectFromTargetCluster(ctx context.Context, obj *manifest.Object, r *Reconciler) (*unstructured.Unstructured, error) {
+	if cluster := targetClusterFrom(ctx); cluster != nil {
+		r = r.withTargetCluster(cluster)
+	}
+	return GetObjectFromCluster(obj, r)
+}
+
+// forTargetCluster returns the Reconciler that deploys the objects of instance, and the context
+// to reconcile it with.  This is r unless WithTargetCluster selects a remote cluster.
+func (r *Reconciler) forTargetCluster(ctx context.Context, instance DeclarativeObject) (context.Context, *Reconciler, error) {
+	if r.options.targetCluster == nil {
+		return ctx, r, nil
+	}
+
+	ref, err := r.options.targetCluster(ctx, instance)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error selecting target cluster: %v", err)
+	}
+	if ref == nil {
+		return ctx, r, nil
+	}
+	key := *ref
+	if key.Namespace == "" {
+		key.Namespace = instance.GetNamespace()
+	}
+
+	now := time.Now()
+	cluster := r.targetClusters.fresh(key, now)
+	if cluster == nil {
+		secret := &corev1.Secret{}
+		if err := r.mgr.GetAPIReader().Get(ctx, key, secret); err != nil {
+			return nil, nil, fmt.Errorf("error reading kubeconfig Secret %s: %v", key, err)
+		}
+
+		cluster = r.targetClusters.get(key, secretVersion{uid: secret.UID, resourceVersion: secret.ResourceVersion}, now)
+		if cluster == nil {
+			cluster, err = r.newTargetCluster(key, secret)
+			if err != nil {
+				return nil, nil, err
+			}
+			r.targetClusters.set(cluster, now)
+		}
+	}
+	r.targetClusters.use(types.NamespacedName{Namespace: instance.GetNamespace(), Name: instance.GetName()}, key)
+
+	return context.WithValue(ctx, targetClusterKey{}, cluster), r.withTargetCluster(cluster), nil
+}
+
+// newTargetCluster builds the clients for the cluster of the kubeconfig in secret
+func (r *Reconciler) newTargetCluster(key types.NamespacedName, secret *corev1.Secret) (*targetCluster, error) {
+	log := log.Log.WithValues("secret", key.String())
+
+	var kubeconfig []byte
+	for _, k := range KubeconfigSecretKeys {
+		if kubeconfig = secret.Data[k]; len(kubeconfig) != 0 {
+			break
+		}
+	}
+	if len(kubeconfig) == 0 {
+		return nil, fmt.Errorf("kubeconfig Secret %s has none of the keys %v", key, KubeconfigSecretKeys)
+	}
+
+	config, err := clientcmd.RESTConfigFromKubeConfig(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing kubeconfig in Secret %s: %v", key, err)
+	}
+
+	mapper, err := apiutil.NewDynamicRESTMapper(config)
+	if err != nil {
+		return nil, fmt.Errorf("error building RESTMapper for target cluster %s: %v", key, err)
+	}
+	restMapper := newResettableRESTMapper(mapper, config)
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("error building dynamic client for target cluster %s: %v", key, err)
+	}
+	c, err := client.New(config, client.Options{Scheme: r.mgr.GetScheme(), Mapper: restMapper})
+	if err != nil {
+		return nil, fmt.Errorf("error building client for target cluster %s: %v", key, err)
+	}
+	a, err := r.newApplierFor(config, restMapper)
+	if err != nil {
+		return nil, fmt.Errorf("error building applier for target cluster %s: %v", key, err)
+	}
+
+	log.WithValues("host", config.Host).Info("connected to target cluster")
+	return &targetCluster{
+		secret:        key,
+		version:       secretVersion{uid: secret.UID, resourceVersion: secret.ResourceVersion},
+		config:        config,
+		client:        c,
+		dynamicClient: dynamicClient,
+		restMapper:    restMapper,
+		applier:       a,
+	}, nil
+}
+
+// withTargetCluster returns a copy of r that deploys objects to cluster
+func (r *Reconciler) withTargetCluster(cluster *targetCluster) *Reconciler {
+	target := *r
+	target.target = cluster
+	target.config = cluster.config
+	target.dynamicClient = cluster.dynamicClient
+	target.restMapper = cluster.restMapper
+	target.applier = cluster.applier
+	// The cache watches the local cluster
+	target.objectCache = nil
+	return &target
+}
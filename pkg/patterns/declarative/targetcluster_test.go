@@ -0,0 +1,139 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+)
+
+type fakeRemoteWatch struct {
+	host    string
+	added   []schema.GroupVersionKind
+	stopped bool
+}
+
+func (w *fakeRemoteWatch) Add(trigger schema.GroupVersionKind, options metav1.ListOptions, target metav1.ObjectMeta) error {
+	w.added = append(w.added, trigger)
+	return nil
+}
+
+func (w *fakeRemoteWatch) Stop() {
+	w.stopped = true
+}
+
+func Test_targetClusters(t *testing.T) {
+	clusters := &targetClusters{}
+	secret := types.NamespacedName{Namespace: "ns", Name: "kubeconfig"}
+	v1 := secretVersion{uid: "uid-1", resourceVersion: "1"}
+
+	now := time.Now()
+
+	assert.Nil(t, clusters.fresh(secret, now))
+	assert.Nil(t, clusters.get(secret, v1, now))
+	cluster := &targetCluster{secret: secret, version: v1}
+	clusters.set(cluster, now)
+	assert.Equal(t, cluster, clusters.get(secret, v1, now))
+	assert.Nil(t, clusters.get(secret, secretVersion{uid: "uid-1", resourceVersion: "2"}, now))
+	assert.Nil(t, clusters.get(types.NamespacedName{Namespace: "ns", Name: "other"}, v1, now))
+	// A Secret that was deleted and created again is a new one
+	assert.Nil(t, clusters.get(secret, secretVersion{uid: "uid-2", resourceVersion: "1"}, now))
+
+	// The Secret is only read again once the clients have been used for targetClusterRefresh
+	assert.Equal(t, cluster, clusters.fresh(secret, now.Add(targetClusterRefresh/2)))
+	later := now.Add(targetClusterRefresh)
+	assert.Nil(t, clusters.fresh(secret, later))
+	assert.Equal(t, cluster, clusters.get(secret, v1, later))
+	assert.Equal(t, cluster, clusters.fresh(secret, later))
+
+	// A new version of the Secret replaces the previous one
+	v2 := secretVersion{uid: "uid-1", resourceVersion: "2"}
+	updated := &targetCluster{secret: secret, version: v2}
+	clusters.set(updated, later)
+	assert.Equal(t, updated, clusters.fresh(secret, later))
+	assert.Nil(t, clusters.get(secret, v1, later))
+	assert.Len(t, clusters.clusters, 1)
+}
+
+func Test_targetClustersForget(t *testing.T) {
+	clusters := &targetClusters{}
+	secret := types.NamespacedName{Namespace: "ns", Name: "kubeconfig"}
+	now := time.Now()
+	cluster := &targetCluster{secret: secret, version: secretVersion{uid: "uid-1", resourceVersion: "1"}}
+	clusters.set(cluster, now)
+
+	guestbook := types.NamespacedName{Namespace: "ns", Name: "guestbook"}
+	other := types.NamespacedName{Namespace: "ns", Name: "other"}
+	clusters.use(guestbook, secret)
+	clusters.use(other, secret)
+
+	// The cluster is kept while another DeclarativeObject deploys to it
+	clusters.forget(guestbook)
+	assert.Equal(t, cluster, clusters.fresh(secret, now))
+
+	clusters.forget(other)
+	assert.Nil(t, clusters.fresh(secret, now))
+	assert.Empty(t, clusters.clusters)
+	assert.Empty(t, clusters.versions)
+	assert.Empty(t, clusters.checked)
+	assert.Empty(t, clusters.users)
+}
+
+func Test_watchAllTargetCluster(t *testing.T) {
+	local := &fakeRemoteWatch{}
+	var created []*fakeRemoteWatch
+	w := &watchAll{
+		dw:         local,
+		registered: map[string]struct{}{},
+		forCluster: func(config rest.Config) (remoteWatch, error) {
+			dw := &fakeRemoteWatch{host: config.Host}
+			created = append(created, dw)
+			return dw, nil
+		},
+		remote: map[types.NamespacedName]*remoteClusterWatch{},
+	}
+
+	dw, _, err := w.watchFor(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, local, dw)
+
+	secret := types.NamespacedName{Namespace: "ns", Name: "kubeconfig"}
+	cluster := &targetCluster{secret: secret, version: secretVersion{uid: "uid-1", resourceVersion: "1"}, config: &rest.Config{Host: "https://one"}}
+	ctx := context.WithValue(context.Background(), targetClusterKey{}, cluster)
+
+	first, _, err := w.watchFor(ctx)
+	assert.NoError(t, err)
+	again, _, err := w.watchFor(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, first, again)
+	assert.Len(t, created, 1)
+	assert.Equal(t, "https://one", created[0].host)
+
+	rotated := &targetCluster{secret: secret, version: secretVersion{uid: "uid-1", resourceVersion: "2"}, config: &rest.Config{Host: "https://two"}}
+	second, _, err := w.watchFor(context.WithValue(context.Background(), targetClusterKey{}, rotated))
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, second)
+	assert.True(t, created[0].stopped)
+	assert.Equal(t, "https://two", created[1].host)
+}
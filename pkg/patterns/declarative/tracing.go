@@ -0,0 +1,70 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the name of the tracer that reconciles are traced with
+const TracerName = "sigs.k8s.io/kubebuilder-declarative-pattern"
+
+// Attributes set on the spans of a reconcile
+const (
+	// GVKAttribute is the GroupVersionKind of the DeclarativeObject
+	GVKAttribute = attribute.Key("addons.k8s.io/gvk")
+	// NamespaceAttribute is the namespace of the DeclarativeObject
+	NamespaceAttribute = attribute.Key("addons.k8s.io/namespace")
+	// NameAttribute is the name of the DeclarativeObject
+	NameAttribute = attribute.Key("addons.k8s.io/name")
+	// VersionAttribute is the version of the manifest, as resolved by the ManifestController
+	VersionAttribute = attribute.Key("addons.k8s.io/version")
+	// ObjectsAttribute is the number of objects in the manifest
+	ObjectsAttribute = attribute.Key("addons.k8s.io/objects")
+	// IndexAttribute is the position of a raw manifest operation or ObjectTransform in its chain
+	IndexAttribute = attribute.Key("addons.k8s.io/index")
+	// WaveAttribute is the apply wave
+	WaveAttribute = attribute.Key("addons.k8s.io/wave")
+)
+
+// tracer returns the tracer of the WithTracerProvider TracerProvider, or of the global one
+func (r *Reconciler) tracer() trace.Tracer {
+	tp := r.options.tracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(TracerName)
+}
+
+// startSpan starts a span that is a child of any span in ctx
+func (r *Reconciler) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return r.tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, recording err if it is not nil
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+type staticManifestController map[string]string
+
+func (c staticManifestController) ResolveManifest(ctx context.Context, object runtime.Object) (map[string]string, error) {
+	return c, nil
+}
+
+func Test_BuildDeploymentObjectsTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	noop := func(ctx context.Context, o DeclarativeObject, s string) (string, error) { return s, nil }
+	noopTransform := func(ctx context.Context, o DeclarativeObject, objects *manifest.Objects) error { return nil }
+	r := &Reconciler{
+		options: reconcilerParams{
+			manifestController: staticManifestController{"manifest.yaml": `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: one
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: two
+`},
+			rawManifestOperations: []ManifestOperation{noop, noop},
+			objectTransformations: []ObjectTransform{noopTransform},
+			tracerProvider:        tp,
+		},
+	}
+
+	_, err := r.BuildDeploymentObjects(context.Background(), types.NamespacedName{Name: "test"}, nil)
+	assert.NoError(t, err)
+
+	var names []string
+	var objects int64
+	for _, span := range exporter.GetSpans() {
+		names = append(names, span.Name)
+		for _, attr := range span.Attributes {
+			if attr.Key == ObjectsAttribute {
+				objects = attr.Value.AsInt64()
+			}
+		}
+	}
+	assert.Equal(t, []string{"loadRawManifest", "rawManifestOperation", "rawManifestOperation", "parseManifest", "objectTransform"}, names)
+	assert.Equal(t, int64(2), objects)
+}
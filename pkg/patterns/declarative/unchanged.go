@@ -0,0 +1,109 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// AppliedGenerationAnnotation is set on the DeclarativeObject to its generation when its manifest
+// was last fully applied, see WithSkipUnchanged
+const AppliedGenerationAnnotation = "addons.k8s.io/applied-generation"
+
+// unchanged reports whether applying the manifest with hash can be skipped for instance: the
+// manifest and the generation of instance are those last applied, no object watched by WatchAll
+// has changed since, and the last apply was less than the resync interval ago.  If so, it also
+// returns how long is left until the next resync.
+func (r *Reconciler) unchanged(name types.NamespacedName, instance DeclarativeObject, hash string) (time.Duration, bool) {
+	// Always taken, so that changes seen before this apply do not force the next one
+	changed := false
+	if tracker, ok := r.options.sink.(changeTracker); ok {
+		changed = tracker.takeChanged(name)
+	}
+
+	annotations := instance.GetAnnotations()
+	if annotations[AppliedHashAnnotation] != hash {
+		return 0, false
+	}
+	if annotations[AppliedGenerationAnnotation] != strconv.FormatInt(instance.GetGeneration(), 10) {
+		return 0, false
+	}
+	if changed {
+		return 0, false
+	}
+	// The time of the last apply is not persisted, so the first reconcile after a restart applies
+	appliedAt := r.appliedManifests.appliedAt(name)
+	if appliedAt.IsZero() {
+		return 0, false
+	}
+	resync := r.options.skipUnchangedResync - time.Since(appliedAt)
+	if resync <= 0 {
+		return 0, false
+	}
+	return resync, true
+}
+
+// changeTracker is implemented by the Sink of WatchAll, to report whether the objects deployed
+// for a DeclarativeObject have changed
+type changeTracker interface {
+	// takeChanged reports whether the objects of name have changed since the last call
+	takeChanged(name types.NamespacedName) bool
+}
+
+// changedObjects records the DeclarativeObjects whose deployed objects have changed
+type changedObjects struct {
+	mutex   sync.Mutex
+	changed map[types.NamespacedName]bool
+}
+
+func (c *changedObjects) add(name types.NamespacedName) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.changed == nil {
+		c.changed = map[types.NamespacedName]bool{}
+	}
+	c.changed[name] = true
+}
+
+func (c *changedObjects) take(name types.NamespacedName) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	changed := c.changed[name]
+	delete(c.changed, name)
+	return changed
+}
+
+// track records the DeclarativeObject of each event as changed before passing the event on, so
+// that the change is seen by the reconcile the event triggers
+func (c *changedObjects) track(events <-chan event.GenericEvent) <-chan event.GenericEvent {
+	out := make(chan event.GenericEvent)
+	go func() {
+		defer close(out)
+		for ev := range events {
+			c.add(types.NamespacedName{Namespace: ev.Object.GetNamespace(), Name: ev.Object.GetName()})
+			out <- ev
+		}
+	}()
+	return out
+}
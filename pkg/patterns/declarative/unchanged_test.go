@@ -0,0 +1,127 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// fakeSink is a Sink of WatchAll that has seen changes to changed
+type fakeSink struct {
+	Sink
+	changed *changedObjects
+}
+
+func (s *fakeSink) takeChanged(name types.NamespacedName) bool {
+	return s.changed.take(name)
+}
+
+func Test_unchanged(t *testing.T) {
+	name := types.NamespacedName{Namespace: "ns", Name: "guestbook"}
+	instanceWith := func(hash, generation string) DeclarativeObject {
+		u := &unstructured.Unstructured{}
+		u.SetNamespace(name.Namespace)
+		u.SetName(name.Name)
+		u.SetGeneration(2)
+		u.SetAnnotations(map[string]string{AppliedHashAnnotation: hash, AppliedGenerationAnnotation: generation})
+		return u
+	}
+
+	tests := []struct {
+		name      string
+		instance  DeclarativeObject
+		applied   bool
+		changed   bool
+		unchanged bool
+	}{
+		{
+			name:      "unchanged",
+			instance:  instanceWith("hash", "2"),
+			applied:   true,
+			unchanged: true,
+		},
+		{
+			name:     "manifest changed",
+			instance: instanceWith("old", "2"),
+			applied:  true,
+		},
+		{
+			name:     "generation changed",
+			instance: instanceWith("hash", "1"),
+			applied:  true,
+		},
+		{
+			name:     "watched object changed",
+			instance: instanceWith("hash", "2"),
+			applied:  true,
+			changed:  true,
+		},
+		{
+			name:     "not applied since start",
+			instance: instanceWith("hash", "2"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &fakeSink{changed: &changedObjects{}}
+			r := &Reconciler{appliedManifests: &appliedManifests{}}
+			r.options.sink = sink
+			r.options.skipUnchangedResync = time.Hour
+			if tt.applied {
+				r.appliedManifests.set(name, "hash")
+			}
+			if tt.changed {
+				sink.changed.add(name)
+			}
+
+			resync, unchanged := r.unchanged(name, tt.instance, "hash")
+			assert.Equal(t, tt.unchanged, unchanged)
+			if unchanged {
+				assert.True(t, resync > 0 && resync <= time.Hour)
+			}
+			// Changes are only reported once
+			assert.False(t, sink.changed.take(name))
+		})
+	}
+}
+
+func Test_changedObjectsTrack(t *testing.T) {
+	changed := &changedObjects{}
+	events := make(chan event.GenericEvent)
+	out := changed.track(events)
+
+	go func() {
+		events <- event.GenericEvent{Object: &unstructured.Unstructured{Object: map[string]interface{}{
+			"metadata": map[string]interface{}{"namespace": "ns", "name": "guestbook"},
+		}}}
+		close(events)
+	}()
+
+	ev := <-out
+	assert.Equal(t, "guestbook", ev.Object.GetName())
+	assert.True(t, changed.take(types.NamespacedName{Namespace: "ns", Name: "guestbook"}))
+	assert.False(t, changed.take(types.NamespacedName{Namespace: "ns", Name: "guestbook"}))
+	_, open := <-out
+	assert.False(t, open)
+}
@@ -21,10 +21,12 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"sync"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/rest"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
@@ -43,6 +45,13 @@ type DynamicWatch interface {
 	Add(trigger schema.GroupVersionKind, options metav1.ListOptions, target metav1.ObjectMeta) error
 }
 
+// remoteWatch is a DynamicWatch on a cluster selected by WithTargetCluster
+type remoteWatch interface {
+	DynamicWatch
+	// Stop stops all watches
+	Stop()
+}
+
 // WatchAll creates a Watch on ctrl for all objects reconciled by recnl
 func WatchAll(config *rest.Config, ctrl controller.Controller, recnl Source, labelMaker LabelMaker) (chan struct{}, error) {
 	if labelMaker == nil {
@@ -53,7 +62,8 @@ func WatchAll(config *rest.Config, ctrl controller.Controller, recnl Source, lab
 	if err != nil {
 		return nil, fmt.Errorf("creating dynamic watch: %v", err)
 	}
-	src := &source.Channel{Source: events}
+	changed := &changedObjects{}
+	src := &source.Channel{Source: changed.track(events)}
 	// Inject a stop channel that will never close. The controller does not have a concept of
 	// shutdown, so there is no oppritunity to stop the watch.
 	stopCh := make(chan struct{})
@@ -61,7 +71,18 @@ func WatchAll(config *rest.Config, ctrl controller.Controller, recnl Source, lab
 	if err := ctrl.Watch(src, &handler.EnqueueRequestForObject{}); err != nil {
 		return nil, fmt.Errorf("setting up dynamic watch on the controller: %v", err)
 	}
-	recnl.SetSink(&watchAll{dw, labelMaker, make(map[string]struct{})})
+	w := &watchAll{
+		dw:         dw,
+		labelMaker: labelMaker,
+		registered: make(map[string]struct{}),
+		forCluster: func(config rest.Config) (remoteWatch, error) { return dw.ForConfig(config) },
+		remote:     make(map[types.NamespacedName]*remoteClusterWatch),
+		changed:    changed,
+	}
+	if s, ok := recnl.(sharded); ok && s.shard() != nil {
+		w.shardLabels = s.shard().Labels()
+	}
+	recnl.SetSink(w)
 	return stopCh, nil
 }
 
@@ -69,35 +90,100 @@ type watchAll struct {
 	dw         DynamicWatch
 	labelMaker LabelMaker
 	registered map[string]struct{}
+	// shardLabels restrict the watches to the objects applied by the shard, see WithSharding
+	shardLabels map[string]string
+	// changed are the DeclarativeObjects whose watched objects have changed, see WithSkipUnchanged
+	changed *changedObjects
+
+	// forCluster creates a watch on a remote cluster, raising events on the same channel as dw
+	forCluster func(rest.Config) (remoteWatch, error)
+	// mutex guards remote and the registered watches, as DeclarativeObjects are reconciled concurrently
+	mutex sync.Mutex
+	// remote are the watches on each remote cluster, by kubeconfig Secret
+	remote map[types.NamespacedName]*remoteClusterWatch
+}
+
+// remoteClusterWatch is the watch on the cluster of a kubeconfig Secret at version
+type remoteClusterWatch struct {
+	version    secretVersion
+	dw         remoteWatch
+	registered map[string]struct{}
+}
+
+// watchFor returns the watch on the cluster that ctx reconciles objects in, and the watches
+// registered on it.  It must be called with the mutex held.
+func (w *watchAll) watchFor(ctx context.Context) (DynamicWatch, map[string]struct{}, error) {
+	cluster := targetClusterFrom(ctx)
+	if cluster == nil {
+		return w.dw, w.registered, nil
+	}
+
+	remote := w.remote[cluster.secret]
+	if remote != nil && remote.version == cluster.version {
+		return remote.dw, remote.registered, nil
+	}
+	if remote != nil {
+		// The kubeconfig has changed
+		remote.dw.Stop()
+		delete(w.remote, cluster.secret)
+	}
+
+	dw, err := w.forCluster(*cluster.config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating dynamic watch on target cluster %s: %v", cluster.secret, err)
+	}
+	remote = &remoteClusterWatch{version: cluster.version, dw: dw, registered: make(map[string]struct{})}
+	w.remote[cluster.secret] = remote
+	return remote.dw, remote.registered, nil
+}
+
+func (w *watchAll) takeChanged(name types.NamespacedName) bool {
+	return w.changed.take(name)
 }
 
 func (w *watchAll) Notify(ctx context.Context, dest DeclarativeObject, objs *manifest.Objects) error {
 	log := log.Log
 
-	labelSelector := strings.Builder{}
+	selectorLabels := map[string]string{}
 	for k, v := range w.labelMaker(ctx, dest) {
+		selectorLabels[k] = v
+	}
+	for k, v := range w.shardLabels {
+		selectorLabels[k] = v
+	}
+
+	labelSelector := strings.Builder{}
+	for k, v := range selectorLabels {
 		if labelSelector.Len() != 0 {
 			labelSelector.WriteRune(',')
 		}
 		fmt.Fprintf(&labelSelector, "%s=%s", k, fields.EscapeValue(v))
 	}
 
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	dw, registered, err := w.watchFor(ctx)
+	if err != nil {
+		return err
+	}
+
 	notify := metav1.ObjectMeta{Name: dest.GetName(), Namespace: dest.GetNamespace()}
 	filter := metav1.ListOptions{LabelSelector: labelSelector.String()}
 
 	for _, gvk := range uniqueGroupVersionKind(objs) {
 		key := fmt.Sprintf("%s,%s,%s", gvk.String(), labelSelector.String(), dest.GetNamespace())
-		if _, ok := w.registered[key]; ok {
+		if _, ok := registered[key]; ok {
 			continue
 		}
 
-		err := w.dw.Add(gvk, filter, notify)
+		err := dw.Add(gvk, filter, notify)
 		if err != nil {
 			log.WithValues("GroupVersionKind", gvk.String()).Error(err, "adding watch")
 			continue
 		}
 
-		w.registered[key] = struct{}{}
+		registered[key] = struct{}{}
 	}
 	return nil
 }
@@ -0,0 +1,171 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/cli-utils/pkg/kstatus/status"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+// ApplyWaveAnnotation assigns an object to an apply wave.  Waves are applied in ascending
+// order, and objects without the annotation are in wave 0.
+const ApplyWaveAnnotation = "addons.k8s.io/apply-wave"
+
+const (
+	// MinWaveBackoff is how long we first wait before checking again that a wave is ready
+	MinWaveBackoff = 5 * time.Second
+	// MaxWaveBackoff is the longest we wait before checking again that a wave is ready
+	MaxWaveBackoff = 5 * time.Minute
+)
+
+// applyWave is the set of objects to apply in a single wave
+type applyWave struct {
+	wave int
+	// objects includes the objects of all earlier waves, so that applying the
+	// final wave applies (and prunes against) the whole manifest
+	objects *manifest.Objects
+	// added are the objects that are new in this wave
+	added []*manifest.Object
+}
+
+// buildWaves splits objects into apply waves by ApplyWaveAnnotation.  The order of
+// objects within each wave is preserved.
+func buildWaves(objects *manifest.Objects) ([]applyWave, error) {
+	byWave := map[int][]*manifest.Object{}
+	for _, obj := range objects.Items {
+		wave := 0
+		if s, ok := obj.UnstructuredObject().GetAnnotations()[ApplyWaveAnnotation]; ok {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s annotation %q on %s %s: %v", ApplyWaveAnnotation, s, obj.Kind, obj.Name, err)
+			}
+			wave = n
+		}
+		byWave[wave] = append(byWave[wave], obj)
+	}
+
+	var numbers []int
+	for n := range byWave {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	var waves []applyWave
+	var applied []*manifest.Object
+	for _, n := range numbers {
+		applied = append(applied, byWave[n]...)
+		waves = append(waves, applyWave{
+			wave: n,
+			objects: &manifest.Objects{
+				Items: append([]*manifest.Object(nil), applied...),
+				Blobs: objects.Blobs,
+				Path:  objects.Path,
+			},
+			added: byWave[n],
+		})
+	}
+	return waves, nil
+}
+
+// waveReady reports whether every object added in wave has a kstatus of Current
+func (r *Reconciler) waveReady(ctx context.Context, wave applyWave, defaultNamespace string) (bool, error) {
+	log := log.Log
+
+	for _, obj := range wave.added {
+		res, err := r.objectStatus(ctx, obj, defaultNamespace)
+		if err != nil {
+			return false, err
+		}
+		if res.Status != status.CurrentStatus {
+			log.WithValues("wave", wave.wave).WithValues("kind", obj.Kind).WithValues("name", obj.Name).
+				WithValues("status", res.Status).WithValues("message", res.Message).Info("waiting for object to be ready")
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// objectStatus computes the kstatus of the live object for obj.  The object is read from the API
+// server rather than WithObjectCache, as a cache that has not seen the latest apply yet would
+// report the status of the previous generation.  An object that does not exist (yet) is NotFound.
+func (r *Reconciler) objectStatus(ctx context.Context, obj *manifest.Object, defaultNamespace string) (*status.Result, error) {
+	resource, err := r.resourceFor(obj, defaultNamespace)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get %s %s: %v", obj.Kind, obj.Name, err)
+	}
+	live, err := resource.Get(ctx, obj.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return &status.Result{Status: status.NotFoundStatus, Message: "object not found"}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get %s %s: %v", obj.Kind, obj.Name, err)
+	}
+
+	res, err := status.Compute(live)
+	if err != nil {
+		return nil, fmt.Errorf("unable to compute status of %s %s: %v", obj.Kind, obj.Name, err)
+	}
+	return res, nil
+}
+
+// waveBackoff tracks how long to wait before checking again that something a DeclarativeObject
+// waits for, such as an apply wave, is ready, doubling for each consecutive check of the same
+// DeclarativeObject
+type waveBackoff struct {
+	mutex sync.Mutex
+	delay map[types.NamespacedName]time.Duration
+}
+
+// next returns how long to wait before the next check for name
+func (b *waveBackoff) next(name types.NamespacedName) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.delay == nil {
+		b.delay = map[types.NamespacedName]time.Duration{}
+	}
+	delay, ok := b.delay[name]
+	if !ok {
+		delay = MinWaveBackoff
+	} else {
+		delay *= 2
+		if delay > MaxWaveBackoff {
+			delay = MaxWaveBackoff
+		}
+	}
+	b.delay[name] = delay
+	return delay
+}
+
+// reset is called once what name waited for is ready
+func (b *waveBackoff) reset(name types.NamespacedName) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.delay, name)
+}
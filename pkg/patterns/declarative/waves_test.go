@@ -0,0 +1,100 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package declarative
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/kubebuilder-declarative-pattern/pkg/patterns/declarative/pkg/manifest"
+)
+
+func Test_buildWaves(t *testing.T) {
+	objects, err := manifest.ParseObjects(context.Background(), `
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: webhook-system
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: webhook
+  annotations:
+    addons.k8s.io/apply-wave: "1"
+---
+apiVersion: example.org/v1
+kind: Widget
+metadata:
+  name: widget
+  annotations:
+    addons.k8s.io/apply-wave: "2"
+`)
+	if err != nil {
+		t.Fatalf("error parsing manifest: %v", err)
+	}
+
+	waves, err := buildWaves(objects)
+	if err != nil {
+		t.Fatalf("error building waves: %v", err)
+	}
+
+	names := func(objs []*manifest.Object) []string {
+		var out []string
+		for _, o := range objs {
+			out = append(out, o.Name)
+		}
+		return out
+	}
+
+	assert.Equal(t, 3, len(waves))
+	assert.Equal(t, 0, waves[0].wave)
+	assert.Equal(t, []string{"webhook-system"}, names(waves[0].added))
+	assert.Equal(t, 1, waves[1].wave)
+	assert.Equal(t, []string{"webhook"}, names(waves[1].added))
+	assert.Equal(t, []string{"webhook-system", "webhook"}, names(waves[1].objects.Items))
+	assert.Equal(t, 2, waves[2].wave)
+	assert.Equal(t, []string{"widget"}, names(waves[2].added))
+	assert.Equal(t, []string{"webhook-system", "webhook", "widget"}, names(waves[2].objects.Items))
+
+	objects.Items[0].UnstructuredObject().SetAnnotations(map[string]string{ApplyWaveAnnotation: "first"})
+	_, err = buildWaves(objects)
+	assert.Error(t, err)
+}
+
+func Test_waveReady(t *testing.T) {
+	objects, err := manifest.ParseObjects(context.Background(), `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+`)
+	assert.NoError(t, err)
+	wave := applyWave{objects: objects, added: objects.Items}
+
+	// Not created yet
+	r, _, _ := newTestReconciler(t)
+	ready, err := r.waveReady(context.Background(), wave, "ns")
+	assert.NoError(t, err)
+	assert.False(t, ready)
+
+	r, _, _ = newTestReconciler(t, newTestConfigMap("ns", "config"))
+	ready, err = r.waveReady(context.Background(), wave, "ns")
+	assert.NoError(t, err)
+	assert.True(t, ready)
+}